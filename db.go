@@ -1724,6 +1724,21 @@ func (d *DB) walPreallocateSize() int {
 	return size
 }
 
+// logWriterConfigLocked returns the configuration of a new WAL's LogWriter.
+// Options which change the WAL's format only take effect once the format
+// major version permits them. d.mu must be held when calling this.
+func (d *DB) logWriterConfigLocked() record.LogWriterConfig {
+	c := record.LogWriterConfig{
+		WALMinSyncInterval: d.opts.WALMinSyncInterval,
+		OnFsync:            d.opts.MetricEventListener.WALFsyncLatency,
+	}
+	if d.mu.formatVers.vers >= FormatWALExtendedChunks {
+		c.ChecksumType = d.opts.Experimental.WALChecksumType
+		c.EmitSyncMarkers = d.opts.Experimental.WALSyncMarkers
+	}
+	return c
+}
+
 func (d *DB) newMemTable(logNum FileNum, logSeqNum uint64) (*memTable, *flushableEntry) {
 	size := d.mu.mem.nextSize
 	if d.mu.mem.nextSize < d.opts.MemTableSize {
@@ -1949,10 +1964,7 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 
 		if !d.opts.DisableWAL {
 			d.mu.log.queue = append(d.mu.log.queue, fileInfo{fileNum: newLogNum, fileSize: newLogSize})
-			d.mu.log.LogWriter = record.NewLogWriter(newLogFile, newLogNum, record.LogWriterConfig{
-				OnFsync:            d.opts.MetricEventListener.WALFsyncLatency,
-				WALMinSyncInterval: d.opts.WALMinSyncInterval,
-			})
+			d.mu.log.LogWriter = record.NewLogWriter(newLogFile, newLogNum, d.logWriterConfigLocked())
 		}
 
 		immMem := d.mu.mem.mutable
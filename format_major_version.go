@@ -116,12 +116,27 @@ const (
 	// (without holding mutexes) until all necessary compactions for files marked
 	// for compaction are complete.
 	FormatPrePebblev1MarkedCompacted
+	// FormatTableFormatPebblev3 is a format major version that allows tables
+	// to be written in the Pebblev3 table format, which introduces compact
+	// footers and tables without point blocks. Previous Pebble versions will be
+	// unable to read such tables.
+	FormatTableFormatPebblev3
+	// FormatWALExtendedChunks is a format major version that allows WALs to
+	// be written with chunk types beyond the recyclable chunk types: the
+	// chunks checksummed with XXHash64 (see
+	// Options.Experimental.WALChecksumType) and sync markers (see
+	// Options.Experimental.WALSyncMarkers). Previous Pebble versions treat
+	// such a chunk as the end of the WAL, silently discarding the remainder,
+	// so they must not replay these WALs. Since they refuse to open a
+	// database at this format major version, a database cannot be downgraded
+	// once it has been ratcheted to it.
+	FormatWALExtendedChunks
 
 	// FormatNewest always contains the most recent format major version.
 	// NB: When adding new versions, the MaxTableFormat method should also be
 	// updated to return the maximum allowable version for the new
 	// FormatMajorVersion.
-	FormatNewest FormatMajorVersion = FormatPrePebblev1MarkedCompacted
+	FormatNewest FormatMajorVersion = FormatWALExtendedChunks
 )
 
 // MaxTableFormat returns the maximum sstable.TableFormat that can be used at
@@ -137,6 +152,8 @@ func (v FormatMajorVersion) MaxTableFormat() sstable.TableFormat {
 	case FormatRangeKeys, FormatMinTableFormatPebblev1, FormatPrePebblev1Marked,
 		FormatPrePebblev1MarkedCompacted:
 		return sstable.TableFormatPebblev2
+	case FormatTableFormatPebblev3, FormatWALExtendedChunks:
+		return sstable.TableFormatPebblev3
 	default:
 		panic(fmt.Sprintf("pebble: unsupported format major version: %s", v))
 	}
@@ -152,7 +169,8 @@ func (v FormatMajorVersion) MinTableFormat() sstable.TableFormat {
 		FormatRangeKeys:
 		return sstable.TableFormatLevelDB
 	case FormatMinTableFormatPebblev1, FormatPrePebblev1Marked,
-		FormatPrePebblev1MarkedCompacted:
+		FormatPrePebblev1MarkedCompacted, FormatTableFormatPebblev3,
+		FormatWALExtendedChunks:
 		return sstable.TableFormatPebblev1
 	default:
 		panic(fmt.Sprintf("pebble: unsupported format major version: %s", v))
@@ -275,6 +293,12 @@ var formatMajorVersionMigrations = map[FormatMajorVersion]func(*DB) error{
 		}
 		return d.finalizeFormatVersUpgrade(FormatPrePebblev1MarkedCompacted)
 	},
+	FormatTableFormatPebblev3: func(d *DB) error {
+		return d.finalizeFormatVersUpgrade(FormatTableFormatPebblev3)
+	},
+	FormatWALExtendedChunks: func(d *DB) error {
+		return d.finalizeFormatVersUpgrade(FormatWALExtendedChunks)
+	},
 }
 
 const formatVersionMarkerName = `format-version`
@@ -7,12 +7,14 @@ package pebble
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/datadriven"
+	"github.com/cockroachdb/pebble/record"
 	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 	"github.com/cockroachdb/pebble/vfs/atomicfs"
@@ -53,6 +55,10 @@ func TestRatchetFormat(t *testing.T) {
 	require.Equal(t, FormatPrePebblev1Marked, d.FormatMajorVersion())
 	require.NoError(t, d.RatchetFormatMajorVersion(FormatPrePebblev1MarkedCompacted))
 	require.Equal(t, FormatPrePebblev1MarkedCompacted, d.FormatMajorVersion())
+	require.NoError(t, d.RatchetFormatMajorVersion(FormatTableFormatPebblev3))
+	require.Equal(t, FormatTableFormatPebblev3, d.FormatMajorVersion())
+	require.NoError(t, d.RatchetFormatMajorVersion(FormatWALExtendedChunks))
+	require.Equal(t, FormatWALExtendedChunks, d.FormatMajorVersion())
 	require.NoError(t, d.Close())
 
 	// If we Open the database again, leaving the default format, the
@@ -212,6 +218,8 @@ func TestFormatMajorVersions_TableFormat(t *testing.T) {
 		FormatMinTableFormatPebblev1:       {sstable.TableFormatPebblev1, sstable.TableFormatPebblev2},
 		FormatPrePebblev1Marked:            {sstable.TableFormatPebblev1, sstable.TableFormatPebblev2},
 		FormatPrePebblev1MarkedCompacted:   {sstable.TableFormatPebblev1, sstable.TableFormatPebblev2},
+		FormatTableFormatPebblev3:          {sstable.TableFormatPebblev1, sstable.TableFormatPebblev3},
+		FormatWALExtendedChunks:            {sstable.TableFormatPebblev1, sstable.TableFormatPebblev3},
 	}
 
 	// Valid versions.
@@ -227,6 +235,72 @@ func TestFormatMajorVersions_TableFormat(t *testing.T) {
 	require.Panics(t, func() { _ = fmv.MinTableFormat() })
 }
 
+func TestFormatMajorVersions_WALChunkTypes(t *testing.T) {
+	for _, fmv := range []FormatMajorVersion{FormatTableFormatPebblev3, FormatWALExtendedChunks} {
+		t.Run(fmv.String(), func(t *testing.T) {
+			fs := vfs.NewMem()
+			opts := &Options{FS: fs, FormatMajorVersion: fmv}
+			opts.Experimental.WALChecksumType = record.ChecksumTypeXXHash64
+			opts.Experimental.WALSyncMarkers = true
+			d, err := Open("", opts)
+			require.NoError(t, err)
+			require.NoError(t, d.Set([]byte("a"), []byte("b"), Sync))
+			require.NoError(t, d.Close())
+
+			// The type of the first chunk of the WAL, which follows the
+			// checksum and length, is a recyclable chunk type (5) unless the
+			// format major version permits the XXHash64 chunk types (9).
+			ls, err := fs.List("")
+			require.NoError(t, err)
+			var logs []string
+			var logNum FileNum
+			for _, name := range ls {
+				if ft, fn, ok := base.ParseFilename(fs, name); ok && ft == fileTypeLog {
+					logs = append(logs, name)
+					logNum = fn
+				}
+			}
+			require.Len(t, logs, 1)
+			f, err := fs.Open(logs[0])
+			require.NoError(t, err)
+			var header [7]byte
+			_, err = io.ReadFull(f, header[:])
+			require.NoError(t, err)
+			want := byte(5)
+			if fmv >= FormatWALExtendedChunks {
+				want = 9
+			}
+			require.Equal(t, want, header[6])
+			require.NoError(t, f.Close())
+
+			// The synced write is followed by a sync marker only if the format
+			// major version permits it.
+			f, err = fs.Open(logs[0])
+			require.NoError(t, err)
+			r := record.NewReader(f, logNum)
+			for {
+				_, err = r.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+			}
+			_, ok := r.LastSyncMarker()
+			require.Equal(t, fmv >= FormatWALExtendedChunks, ok)
+			require.NoError(t, f.Close())
+
+			// The WAL is replayed either way.
+			d, err = Open("", opts)
+			require.NoError(t, err)
+			v, closer, err := d.Get([]byte("a"))
+			require.NoError(t, err)
+			require.Equal(t, "b", string(v))
+			require.NoError(t, closer.Close())
+			require.NoError(t, d.Close())
+		})
+	}
+}
+
 func TestSplitUserKeyMigration(t *testing.T) {
 	var d *DB
 	var opts *Options
@@ -22,6 +22,13 @@ var SSTableRawTombstonesOpt interface{}
 // tool/make_test_sstables.go.
 var SSTableWriterDisableKeyOrderChecks func(interface{})
 
+// SSTableWriterForceFooterFormat is a hook for forcing the table format
+// recorded in the footer of the table written by an sstable.Writer, regardless
+// of the format's compatibility with the features used by the table. It is
+// intended for internal use only in the construction of deliberately
+// mismatched sstables for testing readers.
+var SSTableWriterForceFooterFormat func(w interface{}, tableFormat uint32)
+
 // SSTableInternalTableOpt is an sstable.Writer option that sets properties for
 // sstables being created by the db itself (i.e. through flushes and
 // compactions), as opposed to those meant for ingestion.
@@ -418,11 +418,7 @@ func Open(dirname string, opts *Options) (db *DB, _ error) {
 			BytesPerSync:    d.opts.WALBytesPerSync,
 			PreallocateSize: d.walPreallocateSize(),
 		})
-		logWriterConfig := record.LogWriterConfig{
-			WALMinSyncInterval: d.opts.WALMinSyncInterval,
-			OnFsync:            d.opts.MetricEventListener.WALFsyncLatency,
-		}
-		d.mu.log.LogWriter = record.NewLogWriter(logFile, newLogNum, logWriterConfig)
+		d.mu.log.LogWriter = record.NewLogWriter(logFile, newLogNum, d.logWriterConfigLocked())
 		d.mu.versions.metrics.WAL.Files++
 	}
 	d.updateReadStateLocked(d.opts.DebugCheck)
@@ -147,7 +147,7 @@ func TestNewDBFilenames(t *testing.T) {
 			"LOCK",
 			"MANIFEST-000001",
 			"OPTIONS-000003",
-			"marker.format-version.000010.011",
+			"marker.format-version.000012.013",
 			"marker.manifest.000001.MANIFEST-000001",
 		},
 	}
@@ -18,6 +18,7 @@ import (
 	"github.com/cockroachdb/pebble/internal/cache"
 	"github.com/cockroachdb/pebble/internal/humanize"
 	"github.com/cockroachdb/pebble/internal/manifest"
+	"github.com/cockroachdb/pebble/record"
 	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 )
@@ -571,6 +572,22 @@ type Options struct {
 		// ability to optionally schedule additional CPU. See the documentation
 		// for CPUWorkPermissionGranter for more details.
 		CPUWorkPermissionGranter CPUWorkPermissionGranter
+
+		// WALChecksumType specifies the checksum used for each chunk of a WAL.
+		// It only takes effect once the database's format major version is at
+		// least FormatWALExtendedChunks, since earlier versions of Pebble would
+		// treat the chunks as the end of the WAL. Below that version, and by
+		// default, chunks are checksummed with CRC32c.
+		WALChecksumType record.ChecksumType
+
+		// WALSyncMarkers causes a sync marker to be written to the WAL before
+		// each sync it requests (see record.LogWriterConfig.EmitSyncMarkers).
+		// It only takes effect once the database's format major version is at
+		// least FormatWALExtendedChunks, since earlier versions of Pebble
+		// would treat the first marker as the end of the WAL, discarding the
+		// writes following it. Below that version, and by default, no markers
+		// are written.
+		WALSyncMarkers bool
 	}
 
 	// Filters is a map from filter policy name to filter policy. It is used for
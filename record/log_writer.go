@@ -5,9 +5,13 @@
 package record
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
+	"math/bits"
 	"runtime/pprof"
 	"sync"
 	"sync/atomic"
@@ -15,7 +19,7 @@ import (
 
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
-	"github.com/cockroachdb/pebble/internal/crc"
+	"github.com/cockroachdb/pebble/internal/invariants"
 )
 
 var walSyncLabels = pprof.Labels("pebble", "wal-sync")
@@ -251,6 +255,16 @@ type LogWriter struct {
 	s syncer
 	// logNum is the low 32-bits of the log's file number.
 	logNum uint32
+	// checksumType is the checksum used for each chunk.
+	checksumType ChecksumType
+	// selfCheck is set if each fragment is verified after it is framed into
+	// the current block. See LogWriterConfig.SelfCheck.
+	selfCheck bool
+	// emitSyncMarkers is set if a sync marker is written before each
+	// requested sync, and syncSeq is the sequence number of the last marker.
+	// See LogWriterConfig.EmitSyncMarkers.
+	emitSyncMarkers bool
+	syncSeq         uint64
 	// blockNum is the zero based block number for the current block.
 	blockNum int64
 	// err is any accumulated error. TODO(peter): This needs to be protected in
@@ -280,7 +294,32 @@ type LogWriter struct {
 		// Accumulated flush error.
 		err error
 		// minSyncInterval is the minimum duration between syncs.
-		minSyncInterval      durationFunc
+		minSyncInterval durationFunc
+		// backgroundSyncInterval is the maximum duration that data written
+		// without a sync waiter may remain unsynced. Zero if disabled.
+		backgroundSyncInterval time.Duration
+		// backgroundSyncDue is an atomic boolean which is set by the background
+		// sync timer to indicate that any unsynced data should be synced.
+		backgroundSyncDue uint32
+		// unsynced is true if data has been written since the last sync.
+		unsynced bool
+		// blocksSinceSync is the number of blocks data has been written to since
+		// the last sync. partialBlock, if non-nil, is a block which has been
+		// partially written and already counted in blocksSinceSync. Both are
+		// only accessed by the flush loop.
+		blocksSinceSync int
+		partialBlock    *block
+		// offsets tracks the bytes written and synced, from which a SyncError
+		// is constructed. It is only accessed by the flush loop, and by
+		// RotateTo while holding flusher.Mutex.
+		offsets logOffsets
+		// flushRequested is incremented by each call to Flush, and flushDone
+		// is set to the value of flushRequested observed at the start of each
+		// iteration of the flush loop once that iteration has written its data.
+		// flushed is signalled whenever flushDone advances.
+		flushRequested       uint64
+		flushDone            uint64
+		flushed              sync.Cond
 		onFsyncLatencyMetric recordValueFunc
 		pending              []*block
 		syncQ                syncQueue
@@ -293,16 +332,94 @@ type LogWriter struct {
 	afterFunc func(d time.Duration, f func()) syncTimer
 }
 
+// logOffsets counts the bytes written to the underlying writers of a
+// LogWriter, and the bytes known to have been synced, over the lifetime of the
+// LogWriter.
+type logOffsets struct {
+	flushed int64
+	synced  int64
+	// fileStart is the value of flushed at the start of the current file.
+	fileStart int64
+}
+
+// SyncError is the error with which a LogWriter fails once writing or syncing
+// its underlying writer has failed. It is delivered to the waiters of
+// SyncRecord, and returned by all subsequent operations. It records the range
+// of the current file whose durability is unknown: records in that range must
+// be considered suspect by recovery, while those before it were synced.
+type SyncError struct {
+	// Err is the error returned by the underlying writer.
+	Err error
+	// FirstUnsyncedOffset is the offset within the current file of the first
+	// byte which had not been synced when the failure occurred.
+	FirstUnsyncedOffset int64
+	// UnsyncedBytes is the number of bytes, starting at FirstUnsyncedOffset,
+	// which had been written, or were being written, to the underlying writer
+	// without being synced.
+	UnsyncedBytes int64
+}
+
+func (e *SyncError) Error() string {
+	return fmt.Sprintf("%v (%d bytes at offset %d may be unsynced)",
+		e.Err, e.UnsyncedBytes, e.FirstUnsyncedOffset)
+}
+
+// Unwrap returns the error returned by the underlying writer.
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
 // LogWriterConfig is a struct used for configuring new LogWriters
 type LogWriterConfig struct {
 	WALMinSyncInterval durationFunc
 	OnFsync            recordValueFunc
+	// BackgroundSyncInterval, if positive, bounds the time for which data
+	// written without a sync waiter may remain unsynced: data left unsynced
+	// for BackgroundSyncInterval is synced in the background. A background
+	// sync respects WALMinSyncInterval, like any other sync.
+	BackgroundSyncInterval time.Duration
+	// ChecksumType specifies the checksum used for each chunk. The default is
+	// ChecksumTypeCRC32c. Logs written with ChecksumTypeXXHash64 cannot be
+	// read by versions of Pebble that predate it, which treat the first such
+	// chunk as the end of the log. A DB only uses it once its format major
+	// version is at least FormatWALExtendedChunks.
+	ChecksumType ChecksumType
+	// MaxBufferedBlocks bounds the number of blocks, each of blockSize bytes,
+	// the LogWriter allocates to buffer records which have not yet been
+	// written to the underlying writer. Once all of them are waiting to be
+	// written, WriteRecord and SyncRecord block until the flush loop frees a
+	// block. The default, used if MaxBufferedBlocks is zero, is
+	// CapAllocatedBlocks. Values less than MinBufferedBlocks are raised to
+	// MinBufferedBlocks.
+	MaxBufferedBlocks int
+	// SelfCheck, if set, verifies each record fragment immediately after it
+	// is framed into the block buffer, recomputing its checksum and comparing
+	// its header and payload against the record being written. A mismatch,
+	// which indicates memory corruption or a bug in the framing code, causes
+	// a panic identifying the offset of the fragment within the log. The
+	// check is always performed in invariants builds.
+	SelfCheck bool
+	// EmitSyncMarkers, if set, causes a sync marker to be written before
+	// each sync requested through SyncRecord, recording the offset up to
+	// which the log is synced and the sequence number of the sync. Readers
+	// expose the last complete marker through Reader.LastSyncMarker, and may
+	// truncate replay at it. Markers are not written for Flush, background
+	// syncs or records written without a sync. Versions of Pebble that
+	// predate sync markers treat the first marker as the end of the log, and
+	// so silently discard every record following it, which is usually all of
+	// the records written after the first sync. A DB only emits markers once
+	// its format major version is at least FormatWALExtendedChunks.
+	EmitSyncMarkers bool
 }
 
-// CapAllocatedBlocks is the maximum number of blocks allocated by the
+// CapAllocatedBlocks is the default maximum number of blocks allocated by the
 // LogWriter.
 const CapAllocatedBlocks = 16
 
+// MinBufferedBlocks is the minimum number of blocks allocated by the
+// LogWriter: one block being filled, and one being written.
+const MinBufferedBlocks = 2
+
 // NewLogWriter returns a new LogWriter.
 func NewLogWriter(w io.Writer, logNum base.FileNum, logWriterConfig LogWriterConfig) *LogWriter {
 	c, _ := w.(io.Closer)
@@ -315,16 +432,26 @@ func NewLogWriter(w io.Writer, logNum base.FileNum, logWriterConfig LogWriterCon
 		// we are very unlikely to reach a file number of 4 billion and b) the log
 		// number is used as a validation check and using only the low 32-bits is
 		// sufficient for that purpose.
-		logNum: uint32(logNum),
+		logNum:          uint32(logNum),
+		checksumType:    logWriterConfig.ChecksumType,
+		selfCheck:       logWriterConfig.SelfCheck || invariants.Enabled,
+		emitSyncMarkers: logWriterConfig.EmitSyncMarkers,
 		afterFunc: func(d time.Duration, f func()) syncTimer {
 			return time.AfterFunc(d, f)
 		},
 	}
+	maxBlocks := logWriterConfig.MaxBufferedBlocks
+	if maxBlocks == 0 {
+		maxBlocks = CapAllocatedBlocks
+	} else if maxBlocks < MinBufferedBlocks {
+		maxBlocks = MinBufferedBlocks
+	}
 	r.free.cond.L = &r.free.Mutex
-	r.free.blocks = make([]*block, 0, CapAllocatedBlocks)
+	r.free.blocks = make([]*block, 0, maxBlocks)
 	r.free.allocated = 1
 	r.block = &block{}
 	r.flusher.ready.init(&r.flusher.Mutex, &r.flusher.syncQ)
+	r.flusher.flushed.L = &r.flusher.Mutex
 	r.flusher.closed = make(chan struct{})
 	r.flusher.pending = make([]*block, 0, cap(r.free.blocks))
 	r.flusher.metrics = &LogWriterMetrics{}
@@ -332,6 +459,7 @@ func NewLogWriter(w io.Writer, logNum base.FileNum, logWriterConfig LogWriterCon
 	f := &r.flusher
 	f.minSyncInterval = logWriterConfig.WALMinSyncInterval
 	f.onFsyncLatencyMetric = logWriterConfig.OnFsync
+	f.backgroundSyncInterval = logWriterConfig.BackgroundSyncInterval
 
 	go func() {
 		pprof.Do(context.Background(), walSyncLabels, r.flushLoop)
@@ -345,6 +473,11 @@ func (w *LogWriter) flushLoop(context.Context) {
 
 	// Initialize idleStartTime to when the loop starts.
 	idleStartTime := time.Now()
+	// backgroundSyncTimer sets flusher.backgroundSyncDue. It is armed when data
+	// is written without being synced, and is disarmed once backgroundSyncDue
+	// has been consumed.
+	var backgroundSyncTimer syncTimer
+	backgroundSyncArmed := false
 	var syncTimer syncTimer
 	defer func() {
 		// Capture the idle duration between the last piece of work and when the
@@ -353,6 +486,13 @@ func (w *LogWriter) flushLoop(context.Context) {
 		if syncTimer != nil {
 			syncTimer.Stop()
 		}
+		if backgroundSyncTimer != nil {
+			backgroundSyncTimer.Stop()
+		}
+		// Release any Flush callers. The loop only terminates once everything
+		// written has been flushed, or after an error.
+		f.flushDone = f.flushRequested
+		f.flushed.Broadcast()
 		close(f.closed)
 		f.Unlock()
 	}()
@@ -388,6 +528,11 @@ func (w *LogWriter) flushLoop(context.Context) {
 	//   requested, any previously queued flush work will be synced. This
 	//   motivates reading the syncing work (f.syncQ.load()) before picking up
 	//   the flush work (atomic.LoadInt32(&w.block.written)).
+	//
+	// - If a background sync interval is configured, a timer is armed when data
+	//   is written without being synced. When it fires it sets
+	//   flusher.backgroundSyncDue, and the loop syncs even though there are no
+	//   sync requests, unless syncing is blocked by min-sync-interval.
 
 	// The list of full blocks that need to be written. This is copied from
 	// f.pending on every loop iteration, though the number of elements is small
@@ -402,6 +547,12 @@ func (w *LogWriter) flushLoop(context.Context) {
 			if len(f.pending) > 0 || written > w.block.flushed || !f.syncQ.empty() {
 				break
 			}
+			if f.flushRequested > f.flushDone {
+				break
+			}
+			if f.unsynced && w.backgroundSyncDue() {
+				break
+			}
 			if f.close {
 				// If the writer is closed, pretend the sync timer fired immediately so
 				// that we can process any queued sync requests.
@@ -421,6 +572,9 @@ func (w *LogWriter) flushLoop(context.Context) {
 		copy(pending, f.pending)
 		f.pending = f.pending[:0]
 		f.metrics.PendingBufferLen.AddSample(int64(len(pending)))
+		// Any Flush call which returned before this point is satisfied by
+		// this iteration, which writes everything queued before it.
+		flushRequested := f.flushRequested
 
 		// Grab the list of sync waiters. Note that syncQueue.load() will return
 		// 0,0 while we're waiting for the min-sync-interval to expire. This
@@ -437,24 +591,70 @@ func (w *LogWriter) flushLoop(context.Context) {
 		written := atomic.LoadInt32(&w.block.written)
 		data := w.block.buf[w.block.flushed:written]
 		w.block.flushed = written
+		dataBlock := w.block
+
+		// Sync in the background if there are no sync requests, but the
+		// background sync timer has fired and there is data to sync.
+		backgroundSync := head == tail && w.backgroundSyncDue() &&
+			(f.unsynced || len(pending) > 0 || len(data) > 0)
 
 		// If flusher has an error, we propagate it to waiters. Note in spite of
 		// error we consume the pending list above to free blocks for writers.
 		if f.err != nil {
 			f.syncQ.pop(head, tail, f.err)
+			w.flushCompleted(flushRequested)
 			// Update the idleStartTime if work could not be done, so that we don't
 			// include the duration we tried to do work as idle. We don't bother
 			// with the rest of the accounting, which means we will undercount.
 			idleStartTime = time.Now()
 			continue
 		}
+		offsets := f.offsets
 		f.Unlock()
-		synced, syncLatency, bytesWritten, err := w.flushPending(data, pending, head, tail)
+		synced, syncLatency, bytesWritten, err := w.flushPending(
+			data, pending, head, tail, backgroundSync, offsets)
 		f.Lock()
 		if synced && f.onFsyncLatencyMetric != nil {
 			f.onFsyncLatencyMetric(syncLatency)
 		}
 		f.err = err
+		f.offsets.flushed += bytesWritten
+		if err == nil {
+			w.countFlushedBlocks(pending, dataBlock, len(data) > 0)
+			if synced {
+				f.offsets.synced = f.offsets.flushed
+				f.unsynced = false
+				f.metrics.Syncs++
+				f.metrics.BlocksPerSync.add(f.blocksSinceSync)
+				f.blocksSinceSync = 0
+				f.partialBlock = nil
+				if backgroundSync {
+					f.metrics.BackgroundSyncs++
+				}
+			} else if bytesWritten > 0 {
+				f.unsynced = true
+				f.metrics.Flushes++
+			}
+		}
+		w.flushCompleted(flushRequested)
+		if backgroundSyncArmed && !f.unsynced {
+			// Everything written has been synced, so the background sync timer is
+			// no longer needed.
+			backgroundSyncTimer.Stop()
+			atomic.StoreUint32(&f.backgroundSyncDue, 0)
+			backgroundSyncArmed = false
+		}
+		if f.backgroundSyncInterval > 0 && f.unsynced && !backgroundSyncArmed {
+			backgroundSyncArmed = true
+			if backgroundSyncTimer == nil {
+				backgroundSyncTimer = w.afterFunc(f.backgroundSyncInterval, func() {
+					atomic.StoreUint32(&f.backgroundSyncDue, 1)
+					f.ready.Signal()
+				})
+			} else {
+				backgroundSyncTimer.Reset(f.backgroundSyncInterval)
+			}
+		}
 		if f.err != nil {
 			f.syncQ.clearBlocked()
 			// Update the idleStartTime if work could not be done, so that we don't
@@ -488,8 +688,49 @@ func (w *LogWriter) flushLoop(context.Context) {
 	}
 }
 
+// countFlushedBlocks adds the blocks written by a flush of the full blocks
+// pending, and of the current block dataBlock if partial is set, to the count
+// of blocks written since the last sync. A block whose data is written across
+// several flushes is counted once. Requires flusher.Mutex to be held.
+func (w *LogWriter) countFlushedBlocks(pending []*block, dataBlock *block, partial bool) {
+	f := &w.flusher
+	for _, b := range pending {
+		if b != f.partialBlock {
+			f.blocksSinceSync++
+		}
+	}
+	if partial {
+		if dataBlock != f.partialBlock {
+			f.blocksSinceSync++
+		}
+		f.partialBlock = dataBlock
+	} else if len(pending) > 0 {
+		// The partially written block, if any, has been completed.
+		f.partialBlock = nil
+	}
+}
+
+// flushCompleted records that the data queued before the flushRequested'th
+// call to Flush has been written, releasing those calls. Requires
+// flusher.Mutex to be held.
+func (w *LogWriter) flushCompleted(flushRequested uint64) {
+	f := &w.flusher
+	if flushRequested > f.flushDone {
+		f.flushDone = flushRequested
+		f.flushed.Broadcast()
+	}
+}
+
+// backgroundSyncDue returns true if the background sync timer has fired and
+// syncing is not blocked by min-sync-interval.
+func (w *LogWriter) backgroundSyncDue() bool {
+	f := &w.flusher
+	return atomic.LoadUint32(&f.backgroundSyncDue) == 1 &&
+		atomic.LoadUint32(&f.syncQ.blocked) == 0
+}
+
 func (w *LogWriter) flushPending(
-	data []byte, pending []*block, head, tail uint32,
+	data []byte, pending []*block, head, tail uint32, backgroundSync bool, offsets logOffsets,
 ) (synced bool, syncLatency time.Duration, bytesWritten int64, err error) {
 	defer func() {
 		// Translate panics into errors. The errors will cause flushLoop to shut
@@ -512,11 +753,18 @@ func (w *LogWriter) flushPending(
 		_, err = w.w.Write(data)
 	}
 
-	synced = head != tail
-	if synced {
-		if err == nil && w.s != nil {
-			syncLatency, err = w.syncWithLatency()
+	synced = head != tail || backgroundSync
+	if synced && err == nil && w.s != nil {
+		syncLatency, err = w.syncWithLatency()
+	}
+	if err != nil {
+		err = &SyncError{
+			Err:                 err,
+			FirstUnsyncedOffset: offsets.synced - offsets.fileStart,
+			UnsyncedBytes:       offsets.flushed + bytesWritten - offsets.synced,
 		}
+	}
+	if synced {
 		f := &w.flusher
 		if popErr := f.syncQ.pop(head, tail, err); popErr != nil {
 			return synced, syncLatency, bytesWritten, popErr
@@ -618,10 +866,97 @@ func (w *LogWriter) Close() error {
 			return cerr
 		}
 	}
+	allocated, capacity := w.BufferedBlocks()
+	f.Lock()
+	f.metrics.BufferedBlocks, f.metrics.BufferCapacity = allocated, capacity
+	f.Unlock()
+
 	w.err = errors.New("pebble/record: closed LogWriter")
 	return err
 }
 
+// RotateTo finishes the current log file and switches the LogWriter to
+// writing to newFile, which is tagged with newLogNum. Any records written to
+// the current file are flushed and synced, and the current file is closed
+// (if it implements io.Closer) before records are written to newFile. The
+// LogWriter's flush loop and block buffers are retained across the rotation,
+// and offsets returned by subsequent calls to SyncRecord are relative to the
+// start of newFile.
+//
+// Sync requests queued before the rotation complete once the current file
+// has been synced. If flushing or syncing the current file fails, the error
+// is returned and the LogWriter is not rotated.
+//
+// External synchronisation provided by commitPipeline.mu.
+func (w *LogWriter) RotateTo(newFile io.Writer, newLogNum base.FileNum) error {
+	if w.err != nil {
+		return w.err
+	}
+	f := &w.flusher
+
+	// Terminate the current log, and wait for everything written to it to be
+	// flushed and synced. The sync request is queued behind any existing sync
+	// requests, all of which will be satisfied by the same sync.
+	w.emitEOFTrailer()
+	var wg sync.WaitGroup
+	var err error
+	wg.Add(1)
+	f.syncQ.push(&wg, &err)
+	f.ready.Signal()
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+
+	// No records may be written concurrently with RotateTo, so once the sync
+	// has completed the flush loop has no outstanding work, and the current
+	// block can be reused from its beginning.
+	f.Lock()
+	if len(f.pending) > 0 || w.block.flushed != atomic.LoadInt32(&w.block.written) {
+		f.Unlock()
+		return errors.New("pebble/record: unflushed data while rotating LogWriter")
+	}
+	oldCloser := w.c
+	w.w = newFile
+	w.c, _ = newFile.(io.Closer)
+	w.s, _ = newFile.(syncer)
+	// NB: see NewLogWriter for why it's ok to truncate the log number.
+	w.logNum = uint32(newLogNum)
+	f.offsets.fileStart += w.blockNum*blockSize + int64(w.block.written)
+	w.blockNum = 0
+	w.block.flushed = 0
+	atomic.StoreInt32(&w.block.written, 0)
+	f.Unlock()
+
+	if oldCloser != nil {
+		return oldCloser.Close()
+	}
+	return nil
+}
+
+// Flush writes all of the records written to the LogWriter before the call to
+// the underlying writer, without syncing it, making them visible to readers
+// of the file. It blocks until the records have been written, and returns
+// any error encountered writing them or an earlier error encountered by the
+// flush loop. Unlike SyncRecord, Flush may be called concurrently with
+// SyncRecord and WriteRecord; records written concurrently with Flush may or
+// may not be flushed by it.
+func (w *LogWriter) Flush() error {
+	f := &w.flusher
+	f.Lock()
+	defer f.Unlock()
+	if f.close {
+		return errors.New("pebble/record: closed LogWriter")
+	}
+	f.flushRequested++
+	req := f.flushRequested
+	f.ready.Signal()
+	for f.flushDone < req {
+		f.flushed.Wait()
+	}
+	return f.err
+}
+
 // WriteRecord writes a complete record. Returns the offset just past the end
 // of the record.
 // External synchronisation provided by commitPipeline.mu.
@@ -648,6 +983,9 @@ func (w *LogWriter) SyncRecord(p []byte, wg *sync.WaitGroup, err *error) (int64,
 	}
 
 	if wg != nil {
+		if w.emitSyncMarkers {
+			w.emitSyncMarker()
+		}
 		// If we've been asked to persist the record, add the WaitGroup to the sync
 		// queue and signal the flushLoop. Note that flushLoop will write partial
 		// blocks to the file if syncing has been requested. The contract is that
@@ -684,6 +1022,21 @@ func (w *LogWriter) emitEOFTrailer() {
 	atomic.StoreInt32(&b.written, i+int32(recyclableHeaderSize))
 }
 
+// verifyFragment verifies the fragment framed at offset i of the current
+// block, panicking if its header or payload do not match the payload p from
+// which it was framed.
+func (w *LogWriter) verifyFragment(i int32, p []byte) {
+	b := w.block
+	j := i + int32(recyclableHeaderSize+len(p))
+	if int(binary.LittleEndian.Uint16(b.buf[i+4:i+6])) != len(p) ||
+		binary.LittleEndian.Uint32(b.buf[i+7:i+11]) != w.logNum ||
+		binary.LittleEndian.Uint32(b.buf[i+0:i+4]) != w.checksumType.checksum(b.buf[i+6:j]) ||
+		!bytes.Equal(b.buf[i+recyclableHeaderSize:j], p) {
+		panic(errors.AssertionFailedf("pebble: WAL record fragment at offset %d failed verification",
+			w.blockNum*blockSize+int64(i)))
+	}
+}
+
 func (w *LogWriter) emitFragment(n int, p []byte) []byte {
 	b := w.block
 	i := b.written
@@ -703,24 +1056,79 @@ func (w *LogWriter) emitFragment(n int, p []byte) []byte {
 			b.buf[i+6] = recyclableMiddleChunkType
 		}
 	}
+	if w.checksumType == ChecksumTypeXXHash64 {
+		b.buf[i+6] += xxhashFullChunkType - recyclableFullChunkType
+	}
 
 	binary.LittleEndian.PutUint32(b.buf[i+7:i+11], w.logNum)
 
 	r := copy(b.buf[i+recyclableHeaderSize:], p)
 	j := i + int32(recyclableHeaderSize+r)
-	binary.LittleEndian.PutUint32(b.buf[i+0:i+4], crc.New(b.buf[i+6:j]).Value())
+	binary.LittleEndian.PutUint32(b.buf[i+0:i+4], w.checksumType.checksum(b.buf[i+6:j]))
 	binary.LittleEndian.PutUint16(b.buf[i+4:i+6], uint16(r))
+	if w.selfCheck {
+		w.verifyFragment(i, p[:r])
+	}
 	atomic.StoreInt32(&b.written, j)
+	w.maybeQueueBlock()
+	return p[r:]
+}
 
+// maybeQueueBlock queues the current block for flushing if there is no room
+// in it for another chunk.
+func (w *LogWriter) maybeQueueBlock() {
+	b := w.block
 	if blockSize-b.written < recyclableHeaderSize {
-		// There is no room for another fragment in the block, so fill the
+		// There is no room for another chunk in the block, so fill the
 		// remaining bytes with zeros and queue the block for flushing.
 		for i := b.written; i < blockSize; i++ {
 			b.buf[i] = 0
 		}
 		w.queueBlock()
 	}
-	return p[r:]
+}
+
+// emitSyncMarker frames a sync marker, recording the offset at which it
+// starts and the next sync sequence number. If the marker does not fit in the
+// remainder of the current block, the remainder is filled with a padding
+// marker and the marker is framed at the start of the next block.
+func (w *LogWriter) emitSyncMarker() {
+	var payload [syncMarkerLen]byte
+	if n := blockSize - w.block.written - recyclableHeaderSize; n < syncMarkerLen {
+		w.emitSyncMarkerChunk(payload[:n])
+	}
+	w.syncSeq++
+	binary.LittleEndian.PutUint64(payload[0:8], uint64(w.blockNum*blockSize+int64(w.block.written)))
+	binary.LittleEndian.PutUint64(payload[8:16], w.syncSeq)
+	w.emitSyncMarkerChunk(payload[:])
+}
+
+// emitSyncMarkerChunk frames a sync marker chunk with payload p, which must
+// fit in the remainder of the current block.
+func (w *LogWriter) emitSyncMarkerChunk(p []byte) {
+	b := w.block
+	i := b.written
+	b.buf[i+6] = syncMarkerChunkType
+	if w.checksumType == ChecksumTypeXXHash64 {
+		b.buf[i+6] = xxhashSyncMarkerChunkType
+	}
+	binary.LittleEndian.PutUint32(b.buf[i+7:i+11], w.logNum)
+	j := i + int32(recyclableHeaderSize+copy(b.buf[i+recyclableHeaderSize:], p))
+	binary.LittleEndian.PutUint32(b.buf[i+0:i+4], w.checksumType.checksum(b.buf[i+6:j]))
+	binary.LittleEndian.PutUint16(b.buf[i+4:i+6], uint16(len(p)))
+	atomic.StoreInt32(&b.written, j)
+	w.maybeQueueBlock()
+}
+
+// BufferedBlocks returns the number of blocks allocated by the LogWriter to
+// buffer records, and the maximum number it may allocate (see
+// LogWriterConfig.MaxBufferedBlocks). Blocks are retained for reuse once
+// allocated, so the allocated count is the LogWriter's current buffer memory
+// usage in units of blocks. It may be called concurrently with writes.
+func (w *LogWriter) BufferedBlocks() (allocated, capacity int64) {
+	w.free.Lock()
+	defer w.free.Unlock()
+	return int64(w.free.allocated), int64(cap(w.free.blocks))
 }
 
 // Metrics must be called after Close. The callee will no longer modify the
@@ -734,6 +1142,64 @@ type LogWriterMetrics struct {
 	WriteThroughput  base.ThroughputMetric
 	PendingBufferLen base.GaugeSampleMetric
 	SyncQueueLen     base.GaugeSampleMetric
+	// BackgroundSyncs is the number of syncs performed without a sync request,
+	// due to LogWriterConfig.BackgroundSyncInterval.
+	BackgroundSyncs int64
+	// Syncs is the number of times data was written to the underlying writer
+	// and then synced, including BackgroundSyncs. Flushes is the number of
+	// times data was written to the underlying writer without being synced,
+	// for example by Flush. The final sync performed by Close is not counted.
+	Syncs   int64
+	Flushes int64
+	// BufferedBlocks is the number of blocks allocated to buffer records, and
+	// BufferCapacity the maximum number which could have been allocated. See
+	// LogWriter.BufferedBlocks.
+	BufferedBlocks int64
+	BufferCapacity int64
+	// BlocksPerSync is the distribution of the number of blocks each sync
+	// covered, i.e. which had data written to them since the previous sync.
+	// Few blocks per sync indicate that syncs are frequent relative to the
+	// write rate.
+	BlocksPerSync BlocksPerSyncHistogram
+}
+
+// blocksPerSyncBuckets is the number of buckets of a BlocksPerSyncHistogram.
+const blocksPerSyncBuckets = 12
+
+// BlocksPerSyncHistogram counts syncs by the number of blocks they covered.
+// Bucket 0 counts syncs which covered no blocks, and bucket i > 0 syncs which
+// covered [2^(i-1), 2^i) blocks, with the final bucket also counting syncs
+// which covered more blocks.
+type BlocksPerSyncHistogram [blocksPerSyncBuckets]int64
+
+func (h *BlocksPerSyncHistogram) add(blocks int) {
+	i := bits.Len(uint(blocks))
+	if i >= len(h) {
+		i = len(h) - 1
+	}
+	h[i]++
+}
+
+// BucketBounds returns the range of block counts [lower, upper) counted by
+// bucket i. The upper bound of the final bucket is math.MaxInt64.
+func (h *BlocksPerSyncHistogram) BucketBounds(i int) (lower, upper int64) {
+	if i == 0 {
+		return 0, 1
+	}
+	lower = 1 << (i - 1)
+	if i == len(h)-1 {
+		return lower, math.MaxInt64
+	}
+	return lower, 1 << i
+}
+
+// Count returns the total number of syncs counted by the histogram.
+func (h *BlocksPerSyncHistogram) Count() int64 {
+	var n int64
+	for _, c := range h {
+		n += c
+	}
+	return n
 }
 
 // Merge merges metrics from x. Requires that x is non-nil.
@@ -741,5 +1207,13 @@ func (m *LogWriterMetrics) Merge(x *LogWriterMetrics) error {
 	m.WriteThroughput.Merge(x.WriteThroughput)
 	m.PendingBufferLen.Merge(x.PendingBufferLen)
 	m.SyncQueueLen.Merge(x.SyncQueueLen)
+	m.BackgroundSyncs += x.BackgroundSyncs
+	m.Syncs += x.Syncs
+	m.Flushes += x.Flushes
+	m.BufferedBlocks += x.BufferedBlocks
+	m.BufferCapacity += x.BufferCapacity
+	for i := range m.BlocksPerSync {
+		m.BlocksPerSync[i] += x.BlocksPerSync[i]
+	}
 	return nil
 }
@@ -6,6 +6,8 @@ package record
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/vfs"
 	"github.com/stretchr/testify/require"
 )
@@ -139,22 +142,78 @@ func TestSyncError(t *testing.T) {
 	injectedErr := errors.New("injected error")
 	w := NewLogWriter(syncErrorFile{f, injectedErr}, 0, LogWriterConfig{})
 
-	syncRecord := func() {
+	syncRecord := func() *SyncError {
 		var syncErr error
 		var syncWG sync.WaitGroup
 		syncWG.Add(1)
 		_, err = w.SyncRecord([]byte("hello"), &syncWG, &syncErr)
 		require.NoError(t, err)
 		syncWG.Wait()
-		if injectedErr != syncErr {
+		if !errors.Is(syncErr, injectedErr) {
 			t.Fatalf("unexpected %v but found %v", injectedErr, syncErr)
 		}
+		var se *SyncError
+		require.True(t, errors.As(syncErr, &se))
+		return se
 	}
-	// First waiter receives error.
-	syncRecord()
+	// First waiter receives error, which reports the record as unsynced.
+	se := syncRecord()
+	require.EqualValues(t, 0, se.FirstUnsyncedOffset)
+	require.EqualValues(t, recyclableHeaderSize+len("hello"), se.UnsyncedBytes)
 	// All subsequent waiters also receive the error.
-	syncRecord()
-	syncRecord()
+	require.Equal(t, se, syncRecord())
+	require.Equal(t, se, syncRecord())
+}
+
+func TestSyncErrorUnsyncedRange(t *testing.T) {
+	mem := vfs.NewMem()
+	oldFile, err := mem.Create("000001.log")
+	require.NoError(t, err)
+	file, err := mem.Create("000002.log")
+	require.NoError(t, err)
+	w := NewLogWriter(oldFile, 1, LogWriterConfig{})
+
+	syncRecord := func(rec []byte) error {
+		var syncErr error
+		var syncWG sync.WaitGroup
+		syncWG.Add(1)
+		_, err := w.SyncRecord(rec, &syncWG, &syncErr)
+		require.NoError(t, err)
+		syncWG.Wait()
+		return syncErr
+	}
+	require.NoError(t, syncRecord([]byte("old")))
+	// Offsets are relative to the start of the file being written.
+	f := &failingSyncFile{File: file}
+	require.NoError(t, w.RotateTo(f, 2))
+	require.NoError(t, syncRecord([]byte("synced")))
+	synced := int64(recyclableHeaderSize + len("synced"))
+	// A record which is flushed without being synced precedes the failed
+	// sync, and is also reported as unsynced.
+	_, err = w.WriteRecord([]byte("flushed"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+
+	f.fail = true
+	var se *SyncError
+	require.True(t, errors.As(syncRecord([]byte("failed")), &se))
+	require.Equal(t, synced, se.FirstUnsyncedOffset)
+	require.EqualValues(t, 2*recyclableHeaderSize+len("flushed")+len("failed"), se.UnsyncedBytes)
+	require.EqualError(t, se, fmt.Sprintf("injected sync error (%d bytes at offset %d may be unsynced)",
+		se.UnsyncedBytes, synced))
+}
+
+// failingSyncFile is a vfs.File whose syncs fail once fail is set.
+type failingSyncFile struct {
+	vfs.File
+	fail bool
+}
+
+func (f *failingSyncFile) Sync() error {
+	if f.fail {
+		return errors.New("injected sync error")
+	}
+	return f.File.Sync()
 }
 
 type syncFile struct {
@@ -217,6 +276,57 @@ func try(initialSleep, maxTotalSleep time.Duration, f func() error) error {
 	}
 }
 
+func TestLogWriterFlush(t *testing.T) {
+	f := &syncFile{}
+	w := NewLogWriter(f, 0, LogWriterConfig{})
+	for i := 0; i < 10; i++ {
+		_, err := w.WriteRecord([]byte("hello"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Flush())
+	require.EqualValues(t, w.Size(), atomic.LoadInt64(&f.writePos))
+	require.EqualValues(t, 0, atomic.LoadInt64(&f.syncPos))
+	// Flushing with nothing to write succeeds.
+	require.NoError(t, w.Flush())
+
+	// Flush may be called concurrently with SyncRecord.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				require.NoError(t, w.Flush())
+			}
+		}
+	}()
+	for i := 0; i < 10000; i++ {
+		_, err := w.SyncRecord([]byte("hello"), nil, nil)
+		require.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+	require.NoError(t, w.Flush())
+	require.EqualValues(t, w.Size(), atomic.LoadInt64(&f.writePos))
+
+	var syncWG sync.WaitGroup
+	var syncErr error
+	syncWG.Add(1)
+	_, err := w.SyncRecord([]byte("hello"), &syncWG, &syncErr)
+	require.NoError(t, err)
+	syncWG.Wait()
+	require.NoError(t, syncErr)
+	require.NoError(t, w.Close())
+	m := w.Metrics()
+	require.Less(t, int64(0), m.Flushes)
+	require.EqualValues(t, 1, m.Syncs)
+	require.Error(t, w.Flush())
+}
+
 func TestMinSyncInterval(t *testing.T) {
 	const minSyncInterval = 100 * time.Millisecond
 
@@ -325,6 +435,40 @@ func TestMinSyncIntervalClose(t *testing.T) {
 	wg.Wait()
 }
 
+func TestBackgroundSync(t *testing.T) {
+	const backgroundSyncInterval = 100 * time.Millisecond
+
+	f := &syncFile{}
+	w := NewLogWriter(f, 0, LogWriterConfig{BackgroundSyncInterval: backgroundSyncInterval})
+
+	timerC := make(chan func(), 1)
+	w.afterFunc = func(d time.Duration, f func()) syncTimer {
+		if d != backgroundSyncInterval {
+			t.Fatalf("expected backgroundSyncInterval %s, but found %s", backgroundSyncInterval, d)
+		}
+		timerC <- f
+		return &fakeTimer{f: f}
+	}
+
+	// Write a record without a sync waiter. It is written, but not synced.
+	_, err := w.SyncRecord([]byte("hello"), nil, nil)
+	require.NoError(t, err)
+	fire := <-timerC
+	require.NotEqualValues(t, 0, atomic.LoadInt64(&f.writePos))
+	require.EqualValues(t, 0, atomic.LoadInt64(&f.syncPos))
+
+	// Firing the timer syncs the record in the background.
+	fire()
+	require.NoError(t, try(time.Millisecond, 5*time.Second, func() error {
+		if w, s := atomic.LoadInt64(&f.writePos), atomic.LoadInt64(&f.syncPos); w != s {
+			return errors.Errorf("expected syncPos %d, but found %d", w, s)
+		}
+		return nil
+	}))
+	require.NoError(t, w.Close())
+	require.EqualValues(t, 1, w.Metrics().BackgroundSyncs)
+}
+
 type syncFileWithWait struct {
 	f       syncFile
 	writeWG sync.WaitGroup
@@ -370,6 +514,93 @@ func TestMetricsWithoutSync(t *testing.T) {
 	require.Less(t, int64(numRecords*recordSize), m.WriteThroughput.Bytes)
 }
 
+func TestMetricsBlocksPerSync(t *testing.T) {
+	mem := vfs.NewMem()
+	f, err := mem.Create("000001.log")
+	require.NoError(t, err)
+	w := NewLogWriter(f, 1, LogWriterConfig{})
+	syncRecord := func(n int) {
+		var wg sync.WaitGroup
+		var syncErr error
+		wg.Add(1)
+		_, err := w.SyncRecord(bytes.Repeat([]byte("a"), n), &wg, &syncErr)
+		require.NoError(t, err)
+		wg.Wait()
+		require.NoError(t, syncErr)
+	}
+
+	// The first sync covers two full blocks and part of a third, however
+	// many flushes they are written by.
+	for i := 0; i < 5; i++ {
+		_, err := w.WriteRecord(bytes.Repeat([]byte("a"), blockSize/2))
+		require.NoError(t, err)
+	}
+	syncRecord(10)
+	// The second covers the rest of the third block.
+	syncRecord(10)
+	// The third covers the rest of the third block and the next two blocks.
+	syncRecord(blockSize + blockSize/2)
+	require.NoError(t, w.Close())
+
+	m := w.Metrics()
+	require.EqualValues(t, 3, m.Syncs)
+	require.EqualValues(t, 3, m.BlocksPerSync.Count())
+	var expected BlocksPerSyncHistogram
+	expected[1] = 1 // 1 block
+	expected[2] = 2 // 3 blocks
+	require.Equal(t, expected, m.BlocksPerSync)
+	lower, upper := m.BlocksPerSync.BucketBounds(2)
+	require.Equal(t, [2]int64{2, 4}, [2]int64{lower, upper})
+
+	var merged LogWriterMetrics
+	require.NoError(t, merged.Merge(m))
+	require.NoError(t, merged.Merge(m))
+	require.EqualValues(t, 6, merged.BlocksPerSync.Count())
+}
+
+func TestMaxBufferedBlocks(t *testing.T) {
+	f := &syncFileWithWait{}
+	f.writeWG.Add(1)
+	w := NewLogWriter(f, 0, LogWriterConfig{MaxBufferedBlocks: 3})
+	allocated, capacity := w.BufferedBlocks()
+	require.EqualValues(t, 1, allocated)
+	require.EqualValues(t, 3, capacity)
+
+	// Each record occupies 16 bytes, so this writes ~10 blocks, more than may
+	// be buffered while writes to the file are blocked.
+	const numRecords = 20 << 10
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < numRecords; i++ {
+			if _, err := w.SyncRecord([]byte("hello"), nil, nil); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for {
+		if allocated, _ := w.BufferedBlocks(); allocated == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("records written without backpressure: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Unblock writes to the file, freeing blocks for the writer.
+	f.writeWG.Done()
+	require.NoError(t, <-done)
+	require.NoError(t, w.Close())
+	m := w.Metrics()
+	require.EqualValues(t, 3, m.BufferedBlocks)
+	require.EqualValues(t, 3, m.BufferCapacity)
+	require.Less(t, int64(numRecords*16), m.WriteThroughput.Bytes)
+}
+
 func TestMetricsWithSync(t *testing.T) {
 	f := &syncFileWithWait{}
 	f.syncWG.Add(1)
@@ -402,3 +633,94 @@ func TestMetricsWithSync(t *testing.T) {
 		syncLatencyMicros.ValueAtQuantile(90))
 	require.LessOrEqual(t, int64(syncLatency/2), int64(m.WriteThroughput.WorkDuration))
 }
+
+func TestLogWriterRotateTo(t *testing.T) {
+	mem := vfs.NewMem()
+	f1, err := mem.Create("000001.log")
+	require.NoError(t, err)
+	f2, err := mem.Create("000002.log")
+	require.NoError(t, err)
+
+	w := NewLogWriter(f1, 1, LogWriterConfig{})
+	// Write enough data to span multiple blocks, leaving a sync request
+	// outstanding across the rotation.
+	var records [][]byte
+	for i := 0; i < 10; i++ {
+		records = append(records, bytes.Repeat([]byte{byte('a' + i)}, blockSize/3))
+	}
+	for _, rec := range records[:5] {
+		_, err := w.WriteRecord(rec)
+		require.NoError(t, err)
+	}
+	var syncWG sync.WaitGroup
+	var syncErr error
+	syncWG.Add(1)
+	_, err = w.SyncRecord([]byte("sync"), &syncWG, &syncErr)
+	require.NoError(t, err)
+
+	require.NoError(t, w.RotateTo(f2, 2))
+	syncWG.Wait()
+	require.NoError(t, syncErr)
+	require.Equal(t, int64(0), w.Size())
+
+	for i, rec := range records[5:] {
+		offset, err := w.WriteRecord(rec)
+		require.NoError(t, err)
+		if i == 0 {
+			// Offsets are relative to the start of the new file.
+			require.Equal(t, int64(len(rec)+recyclableHeaderSize), offset)
+		}
+	}
+	require.NoError(t, w.Close())
+
+	readAll := func(name string, logNum base.FileNum) [][]byte {
+		f, err := mem.Open(name)
+		require.NoError(t, err)
+		defer f.Close()
+		r := NewReader(f, logNum)
+		var got [][]byte
+		for {
+			rr, err := r.Next()
+			if err == io.EOF {
+				return got
+			}
+			require.NoError(t, err)
+			b, err := io.ReadAll(rr)
+			require.NoError(t, err)
+			got = append(got, b)
+		}
+	}
+	require.Equal(t, append(records[:5:5], []byte("sync")), readAll("000001.log", 1))
+	require.Equal(t, records[5:], readAll("000002.log", 2))
+}
+
+func TestLogWriterSelfCheck(t *testing.T) {
+	for _, checksumType := range []ChecksumType{ChecksumTypeCRC32c, ChecksumTypeXXHash64} {
+		var buf bytes.Buffer
+		w := NewLogWriter(&buf, 1, LogWriterConfig{SelfCheck: true, ChecksumType: checksumType})
+		// The second record spans several blocks.
+		records := [][]byte{[]byte("hello"), bytes.Repeat([]byte("x"), 3*blockSize), []byte("world")}
+		for _, rec := range records {
+			_, err := w.WriteRecord(rec)
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+
+		r := NewReader(&buf, 1)
+		for _, want := range records {
+			rr, err := r.Next()
+			require.NoError(t, err)
+			got, err := io.ReadAll(rr)
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+		}
+	}
+
+	// Corrupting a framed fragment is detected.
+	w := &LogWriter{logNum: 1, blockNum: 2, block: &block{}}
+	w.emitFragment(0, []byte("hello"))
+	w.block.buf[recyclableHeaderSize+1] ^= 0xff
+	require.PanicsWithError(t,
+		fmt.Sprintf("pebble: WAL record fragment at offset %d failed verification", 2*blockSize),
+		func() { w.verifyFragment(0, []byte("hello")) })
+}
@@ -93,6 +93,31 @@
 // (i.e. full, first, middle, last). The CRC is computed over the type, log
 // number, and payload.
 //
+// A LogWriter may instead be configured to checksum its chunks using XXHash64,
+// which is cheaper to compute than CRC. Such chunks use the recyclable chunk
+// format, but are distinguished by 4 extra "xxhash" chunk types that map
+// directly to the recyclable chunk types. The checksum is the low 32 bits of
+// the XXHash64 of the type, log number, and payload. Readers that predate the
+// xxhash chunk types treat such chunks as invalid, and thus as the end of the
+// log.
+//
+// A LogWriter may also be configured to emit a sync marker chunk before each
+// sync requested through SyncRecord. A sync marker is not part of any record,
+// and uses the recyclable chunk format with one of 2 extra "sync marker" chunk
+// types, checksummed with CRC or XXHash64 respectively. Its payload holds the
+// offset at which the marker starts, all of which was synced by the sync that
+// followed the marker, and the sequence number of the sync, starting at 1:
+//
+//   +---------------------+-------------------+
+//   | Synced offset (8B)  | Sync seq num (8B) |
+//   +---------------------+-------------------+
+//
+// A sync marker chunk with a payload of any other length is padding, written
+// when the remainder of a block is too small to hold a marker. Readers skip
+// sync marker chunks, recording the last complete one, and readers that
+// predate them treat them as invalid, and thus as the end of the log. Such a
+// reader silently discards all records following the first marker.
+//
 // The wire format allows for limited recovery in the face of data corruption:
 // on a format error (such as a checksum mismatch), the reader moves to the
 // next block and looks for the next full or first chunk.
@@ -107,6 +132,7 @@ import (
 	"encoding/binary"
 	"io"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/crc"
@@ -123,15 +149,68 @@ const (
 	recyclableFirstChunkType  = 6
 	recyclableMiddleChunkType = 7
 	recyclableLastChunkType   = 8
+
+	xxhashFullChunkType   = 9
+	xxhashFirstChunkType  = 10
+	xxhashMiddleChunkType = 11
+	xxhashLastChunkType   = 12
+
+	syncMarkerChunkType       = 13
+	xxhashSyncMarkerChunkType = 14
+)
+
+// ChecksumType specifies the checksum used by a LogWriter to protect each
+// chunk it writes. Readers determine the checksum of each chunk from its
+// chunk type.
+type ChecksumType byte
+
+// The available checksum types.
+const (
+	ChecksumTypeCRC32c ChecksumType = iota
+	ChecksumTypeXXHash64
 )
 
+// String implements fmt.Stringer.
+func (t ChecksumType) String() string {
+	switch t {
+	case ChecksumTypeCRC32c:
+		return "crc32c"
+	case ChecksumTypeXXHash64:
+		return "xxhash64"
+	default:
+		return "unknown"
+	}
+}
+
+// checksum returns the checksum of b, which holds a chunk's type, log number
+// and payload.
+func (t ChecksumType) checksum(b []byte) uint32 {
+	if t == ChecksumTypeXXHash64 {
+		return uint32(xxhash.Sum64(b))
+	}
+	return crc.New(b).Value()
+}
+
 const (
 	blockSize            = 32 * 1024
 	blockSizeMask        = blockSize - 1
 	legacyHeaderSize     = 7
 	recyclableHeaderSize = legacyHeaderSize + 4
+	syncMarkerLen        = 16
 )
 
+// SyncMarker is the content of a sync marker chunk, written by a LogWriter
+// configured with LogWriterConfig.EmitSyncMarkers before each requested sync.
+type SyncMarker struct {
+	// SyncedOffset is the offset within the log at which the marker starts.
+	// All of the log before it was synced by the sync which followed the
+	// marker.
+	SyncedOffset int64
+	// Seq is the sequence number of the sync. The first sync of a LogWriter
+	// is numbered 1.
+	Seq uint64
+}
+
 var (
 	// ErrNotAnIOSeeker is returned if the io.Reader underlying a Reader does not implement io.Seeker.
 	ErrNotAnIOSeeker = errors.New("pebble/record: reader does not implement io.Seeker")
@@ -179,6 +258,10 @@ type Reader struct {
 	last bool
 	// err is any accumulated error.
 	err error
+	// syncMarker is the last complete sync marker read, if hasSyncMarker is
+	// set.
+	syncMarker    SyncMarker
+	hasSyncMarker bool
 	// buf is the buffer.
 	buf [blockSize]byte
 }
@@ -222,6 +305,33 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 				return ErrZeroedChunk
 			}
 
+			if chunkType == syncMarkerChunkType || chunkType == xxhashSyncMarkerChunkType {
+				err := r.readSyncMarker(chunkType)
+				switch {
+				case err == nil && wantFirst:
+					continue
+				case err == io.EOF && wantFirst:
+					// As with the first chunk of a record, a sync marker from a
+					// previous instance of the log is treated as EOF.
+					return io.EOF
+				case err == nil || err == io.EOF:
+					// A sync marker may not interrupt a record.
+					err = ErrInvalidChunk
+				}
+				if r.recovering {
+					r.err = err
+					r.recover()
+					continue
+				}
+				return err
+			}
+
+			checksumType := ChecksumTypeCRC32c
+			if chunkType >= xxhashFullChunkType && chunkType <= xxhashLastChunkType {
+				checksumType = ChecksumTypeXXHash64
+				chunkType -= (xxhashFullChunkType - recyclableFullChunkType)
+			}
+
 			headerSize := legacyHeaderSize
 			if chunkType >= recyclableFullChunkType && chunkType <= recyclableLastChunkType {
 				headerSize = recyclableHeaderSize
@@ -253,7 +363,7 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 				}
 				return ErrInvalidChunk
 			}
-			if checksum != crc.New(r.buf[r.begin-headerSize+6:r.end]).Value() {
+			if checksum != checksumType.checksum(r.buf[r.begin-headerSize+6:r.end]) {
 				if r.recovering {
 					r.recover()
 					continue
@@ -290,6 +400,49 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 	}
 }
 
+// readSyncMarker reads the sync marker chunk of the given type starting at
+// r.end, and advances r.end past it. It returns io.EOF if the chunk belongs to
+// a previous instance of the log.
+func (r *Reader) readSyncMarker(chunkType byte) error {
+	if r.end+recyclableHeaderSize > r.n {
+		return ErrInvalidChunk
+	}
+	checksum := binary.LittleEndian.Uint32(r.buf[r.end+0 : r.end+4])
+	length := binary.LittleEndian.Uint16(r.buf[r.end+4 : r.end+6])
+	if binary.LittleEndian.Uint32(r.buf[r.end+7:r.end+11]) != r.logNum {
+		return io.EOF
+	}
+	begin := r.end + recyclableHeaderSize
+	end := begin + int(length)
+	if end > r.n {
+		return ErrInvalidChunk
+	}
+	checksumType := ChecksumTypeCRC32c
+	if chunkType == xxhashSyncMarkerChunkType {
+		checksumType = ChecksumTypeXXHash64
+	}
+	if checksum != checksumType.checksum(r.buf[r.end+6:end]) {
+		return ErrInvalidChunk
+	}
+	if length == syncMarkerLen {
+		r.syncMarker = SyncMarker{
+			SyncedOffset: int64(binary.LittleEndian.Uint64(r.buf[begin : begin+8])),
+			Seq:          binary.LittleEndian.Uint64(r.buf[begin+8 : end]),
+		}
+		r.hasSyncMarker = true
+	}
+	r.begin, r.end = end, end
+	return nil
+}
+
+// LastSyncMarker returns the last complete sync marker read so far, and
+// whether one has been read. Once Next has returned io.EOF, it is the last
+// sync marker of the log, and the records before its SyncedOffset are known
+// to have been synced.
+func (r *Reader) LastSyncMarker() (SyncMarker, bool) {
+	return r.syncMarker, r.hasSyncMarker
+}
+
 // Next returns a reader for the next record. It returns io.EOF if there are no
 // more records. The reader returned becomes stale after the next Next call,
 // and should no longer be used.
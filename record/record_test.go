@@ -12,6 +12,7 @@ import (
 	"math"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -947,6 +948,116 @@ func TestTruncatedLog(t *testing.T) {
 	require.EqualValues(t, err, io.ErrUnexpectedEOF)
 }
 
+func TestLogWriterXXHash64(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewLogWriter(&buf, base.FileNum(1), LogWriterConfig{ChecksumType: ChecksumTypeXXHash64})
+	sizes := []int{10, blockSize - 100, 3 * blockSize, 1}
+	for i, size := range sizes {
+		_, err := w.WriteRecord(bytes.Repeat([]byte{byte('a' + i)}, size))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	data := buf.Bytes()
+	require.Equal(t, byte(xxhashFullChunkType), data[6])
+
+	r := NewReader(bytes.NewReader(data), base.FileNum(1))
+	for i, size := range sizes {
+		rr, err := r.Next()
+		require.NoError(t, err)
+		b, err := io.ReadAll(rr)
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat([]byte{byte('a' + i)}, size), b)
+	}
+	_, err := r.Next()
+	require.Equal(t, io.EOF, err)
+
+	// Corrupting the payload of the first record is detected.
+	data[recyclableHeaderSize]++
+	r = NewReader(bytes.NewReader(data), base.FileNum(1))
+	_, err = r.Next()
+	require.Equal(t, ErrInvalidChunk, err)
+}
+
+func TestLogWriterSyncMarkers(t *testing.T) {
+	for _, checksumType := range []ChecksumType{ChecksumTypeCRC32c, ChecksumTypeXXHash64} {
+		t.Run(checksumType.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewLogWriter(&buf, base.FileNum(1), LogWriterConfig{
+				ChecksumType:    checksumType,
+				EmitSyncMarkers: true,
+			})
+			// The first record leaves too little of the first block for a
+			// sync marker, which is then padded into the next block.
+			sizes := []int{blockSize - 2*recyclableHeaderSize - 9, 10, 3 * blockSize, 100, 1}
+			syncs := []bool{true, false, true, true, false}
+			for i, size := range sizes {
+				var wg *sync.WaitGroup
+				var syncErr error
+				if syncs[i] {
+					wg = &sync.WaitGroup{}
+					wg.Add(1)
+				}
+				_, err := w.SyncRecord(bytes.Repeat([]byte{byte('a' + i)}, size), wg, &syncErr)
+				require.NoError(t, err)
+				if wg != nil {
+					wg.Wait()
+					require.NoError(t, syncErr)
+				}
+			}
+			require.NoError(t, w.Close())
+			data := buf.Bytes()
+
+			read := func(data []byte) (n int, marker SyncMarker, ok bool) {
+				r := NewReader(bytes.NewReader(data), base.FileNum(1))
+				for ; ; n++ {
+					rr, err := r.Next()
+					if err != nil {
+						require.True(t, err == io.EOF || IsInvalidRecord(err), "%v", err)
+						break
+					}
+					b, err := io.ReadAll(rr)
+					require.NoError(t, err)
+					require.Equal(t, bytes.Repeat([]byte{byte('a' + n)}, sizes[n]), b)
+				}
+				marker, ok = r.LastSyncMarker()
+				return n, marker, ok
+			}
+
+			// The markers are invisible to readers of records. The last marker
+			// records the third sync, after the fourth record.
+			n, marker, ok := read(data)
+			require.Equal(t, len(sizes), n)
+			require.True(t, ok)
+			require.EqualValues(t, 3, marker.Seq)
+
+			// The log up to the marker's offset holds exactly the synced records.
+			n, marker, ok = read(data[:marker.SyncedOffset])
+			require.Equal(t, 4, n)
+			require.True(t, ok)
+			require.EqualValues(t, 2, marker.Seq)
+		})
+	}
+
+	// Without EmitSyncMarkers, no markers are written.
+	var buf bytes.Buffer
+	w := NewLogWriter(&buf, base.FileNum(1), LogWriterConfig{})
+	var wg sync.WaitGroup
+	var syncErr error
+	wg.Add(1)
+	_, err := w.SyncRecord([]byte("a"), &wg, &syncErr)
+	require.NoError(t, err)
+	wg.Wait()
+	require.NoError(t, syncErr)
+	require.NoError(t, w.Close())
+	r := NewReader(bytes.NewReader(buf.Bytes()), base.FileNum(1))
+	_, err = r.Next()
+	require.NoError(t, err)
+	_, err = r.Next()
+	require.Equal(t, io.EOF, err)
+	_, ok := r.LastSyncMarker()
+	require.False(t, ok)
+}
+
 func TestRecycleLogWithPartialBlock(t *testing.T) {
 	backing := make([]byte, 27)
 	w := NewLogWriter(bytes.NewBuffer(backing[:0]), base.FileNum(1), LogWriterConfig{})
@@ -1034,20 +1145,66 @@ func TestRecycleLogWithPartialRecord(t *testing.T) {
 }
 
 func BenchmarkRecordWrite(b *testing.B) {
-	for _, size := range []int{8, 16, 32, 64, 256, 1028, 4096, 65_536} {
-		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
-			w := NewLogWriter(io.Discard, 0 /* logNum */, LogWriterConfig{})
-			defer w.Close()
-			buf := make([]byte, size)
-
-			b.SetBytes(int64(len(buf)))
-			b.ResetTimer()
-			for i := 0; i < b.N; i++ {
-				if _, err := w.WriteRecord(buf); err != nil {
+	for _, checksumType := range []ChecksumType{ChecksumTypeCRC32c, ChecksumTypeXXHash64} {
+		for _, size := range []int{8, 16, 32, 64, 256, 1028, 4096, 65_536} {
+			b.Run(fmt.Sprintf("checksum=%s/size=%d", checksumType, size), func(b *testing.B) {
+				w := NewLogWriter(io.Discard, 0 /* logNum */, LogWriterConfig{ChecksumType: checksumType})
+				defer w.Close()
+				buf := make([]byte, size)
+
+				b.SetBytes(int64(len(buf)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := w.WriteRecord(buf); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+			})
+		}
+	}
+}
+
+func BenchmarkRecordRead(b *testing.B) {
+	for _, checksumType := range []ChecksumType{ChecksumTypeCRC32c, ChecksumTypeXXHash64} {
+		for _, size := range []int{8, 16, 32, 64, 256, 1028, 4096, 65_536} {
+			b.Run(fmt.Sprintf("checksum=%s/size=%d", checksumType, size), func(b *testing.B) {
+				// Write enough records to fill several blocks, and read them
+				// repeatedly.
+				var buf bytes.Buffer
+				w := NewLogWriter(&buf, 1 /* logNum */, LogWriterConfig{ChecksumType: checksumType})
+				rec := make([]byte, size)
+				n := 4 * blockSize / size
+				if n < 4 {
+					n = 4
+				}
+				for i := 0; i < n; i++ {
+					if _, err := w.WriteRecord(rec); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := w.Close(); err != nil {
 					b.Fatal(err)
 				}
-			}
-			b.StopTimer()
-		})
+				data := buf.Bytes()
+
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				var r *Reader
+				for i := 0; i < b.N; i++ {
+					if i%n == 0 {
+						r = NewReader(bytes.NewReader(data), 1 /* logNum */)
+					}
+					rr, err := r.Next()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := io.Copy(io.Discard, rr); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+			})
+		}
 	}
 }
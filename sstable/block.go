@@ -146,6 +146,25 @@ func (w *blockWriter) add(key InternalKey, value []byte) {
 	w.store(size, value)
 }
 
+// numRestarts returns the number of restart points the block will hold when
+// finished.
+func (w *blockWriter) numRestarts() int {
+	if w.nEntries == 0 {
+		// Every block must have at least one restart point. See finish.
+		return 1
+	}
+	return len(w.restarts)
+}
+
+// maxRestartSpan returns the largest number of entries which begin at a
+// restart point and precede the next, or the end of the block.
+func (w *blockWriter) maxRestartSpan() int {
+	if w.nEntries < w.restartInterval {
+		return w.nEntries
+	}
+	return w.restartInterval
+}
+
 func (w *blockWriter) finish() []byte {
 	// Write the restart points to the buffer.
 	if w.nEntries == 0 {
@@ -0,0 +1,105 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"io"
+
+	"github.com/cockroachdb/errors"
+)
+
+// FanOutFile is a file which replicates every write and sync to a set of
+// underlying files, allowing a Writer to write identical copies of a table to
+// several destinations at once.
+//
+// The first error returned by any of the underlying files is latched and
+// returned by every subsequent call. Once an error has been encountered, all
+// of the underlying files are closed, abandoning the partially written copies,
+// and no further data is written to any of them. The caller is responsible for
+// removing the copies of a table whose Writer returned an error.
+//
+// A FanOutFile must not be used concurrently.
+type FanOutFile struct {
+	files []WriteCloseSyncer
+	err   error
+	// closed is set once the underlying files have been closed, either by
+	// Close or on encountering an error.
+	closed bool
+}
+
+var _ WriteCloseSyncer = (*FanOutFile)(nil)
+
+var errFanOutFileClosed = errors.New("pebble: FanOutFile is closed")
+
+// NewFanOutFile returns a FanOutFile which replicates writes to each of the
+// given files. Closing the FanOutFile closes all of them.
+func NewFanOutFile(files ...WriteCloseSyncer) *FanOutFile {
+	return &FanOutFile{files: files}
+}
+
+// Write writes p to each of the underlying files in turn.
+func (f *FanOutFile) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	for i := range f.files {
+		n, err := f.files[i].Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return 0, f.abort(err)
+		}
+	}
+	return len(p), nil
+}
+
+// Sync syncs each of the underlying files in turn.
+func (f *FanOutFile) Sync() error {
+	if f.err != nil {
+		return f.err
+	}
+	for i := range f.files {
+		if err := f.files[i].Sync(); err != nil {
+			return f.abort(err)
+		}
+	}
+	return nil
+}
+
+// Close closes each of the underlying files. It returns the latched error, if
+// any, or else the first error encountered closing the files.
+func (f *FanOutFile) Close() error {
+	if f.closed {
+		return f.err
+	}
+	if err := f.closeAll(); f.err == nil {
+		f.err = err
+	}
+	if f.err != nil {
+		return f.err
+	}
+	f.err = errFanOutFileClosed
+	return nil
+}
+
+// abort latches err and closes all of the underlying files. The errors
+// encountered closing the files are ignored in favour of err.
+func (f *FanOutFile) abort(err error) error {
+	f.err = err
+	_ = f.closeAll()
+	return err
+}
+
+func (f *FanOutFile) closeAll() error {
+	f.closed = true
+	var err error
+	for i := range f.files {
+		if cerr := f.files[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
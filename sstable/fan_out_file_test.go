@@ -0,0 +1,81 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// closeTrackingFile is a memFile which records whether it has been closed,
+// and which fails writes once failAfter bytes have been written, if set.
+type closeTrackingFile struct {
+	memFile
+	failAfter int
+	closes    int
+}
+
+func (f *closeTrackingFile) Write(p []byte) (int, error) {
+	if f.failAfter > 0 && f.Len()+len(p) > f.failAfter {
+		return 0, errors.New("injected write error")
+	}
+	return f.memFile.Write(p)
+}
+
+func (f *closeTrackingFile) Close() error {
+	f.closes++
+	return nil
+}
+
+func TestFanOutFile(t *testing.T) {
+	write := func(w *Writer) error {
+		for i := 0; i < 1000; i++ {
+			if err := w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return w.Close()
+	}
+
+	t.Run("replicated", func(t *testing.T) {
+		files := []*closeTrackingFile{{}, {}, {}}
+		w := NewWriter(NewFanOutFile(files[0], files[1], files[2]), WriterOptions{BlockSize: 128})
+		require.NoError(t, write(w))
+		meta, err := w.Metadata()
+		require.NoError(t, err)
+		for _, f := range files {
+			require.Equal(t, 1, f.closes)
+			require.Equal(t, files[0].Data(), f.Data())
+			require.EqualValues(t, meta.Size, f.Len())
+		}
+		r, err := NewMemReader(files[2].Data(), ReaderOptions{})
+		require.NoError(t, err)
+		require.EqualValues(t, 1000, r.Properties.NumEntries)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("error", func(t *testing.T) {
+		files := []*closeTrackingFile{{}, {failAfter: 1024}, {}}
+		w := NewWriter(NewFanOutFile(files[0], files[1], files[2]), WriterOptions{BlockSize: 128})
+		require.EqualError(t, write(w), "injected write error")
+		// Every file is closed exactly once, and the file after the failed
+		// one receives no more data than the failed one accepted.
+		for _, f := range files {
+			require.Equal(t, 1, f.closes)
+		}
+		require.LessOrEqual(t, files[2].Len(), files[1].Len())
+	})
+
+	t.Run("close", func(t *testing.T) {
+		f := NewFanOutFile(&closeTrackingFile{})
+		require.NoError(t, f.Close())
+		require.Equal(t, errFanOutFileClosed, f.Close())
+		_, err := f.Write([]byte("a"))
+		require.Equal(t, errFanOutFileClosed, err)
+	})
+}
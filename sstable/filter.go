@@ -4,7 +4,10 @@
 
 package sstable
 
-import "sync/atomic"
+import (
+	"math"
+	"sync/atomic"
+)
 
 // FilterMetrics holds metrics for the filter policy.
 type FilterMetrics struct {
@@ -41,6 +44,9 @@ type BlockHandleWithProperties struct {
 type filterWriter interface {
 	addKey(key []byte)
 	finish() ([]byte, error)
+	// estimatedFPR returns the theoretical false positive rate of the filter
+	// returned by finish, or 0 if it cannot be estimated.
+	estimatedFPR(filter []byte) float64
 	metaName() string
 	policyName() string
 }
@@ -48,6 +54,9 @@ type filterWriter interface {
 type tableFilterReader struct {
 	policy  FilterPolicy
 	metrics *FilterMetrics
+	// transform is the FilterKeyTransform applied to the keys of the filter,
+	// if any.
+	transform *FilterKeyTransform
 }
 
 func newTableFilterReader(policy FilterPolicy) *tableFilterReader {
@@ -57,7 +66,17 @@ func newTableFilterReader(policy FilterPolicy) *tableFilterReader {
 	}
 }
 
-func (f *tableFilterReader) mayContain(data, key []byte) bool {
+// mayContain returns whether the filter may contain key. If the filter's keys
+// were transformed, key is transformed into *scratch before querying the
+// filter. scratch may be nil, in which case a buffer is allocated.
+func (f *tableFilterReader) mayContain(data, key []byte, scratch *[]byte) bool {
+	if f.transform != nil {
+		if scratch == nil {
+			scratch = new([]byte)
+		}
+		*scratch = f.transform.Transform(key, (*scratch)[:0])
+		key = *scratch
+	}
 	mayContain := f.policy.MayContain(TableFilter, data, key)
 	if mayContain {
 		atomic.AddInt64(&f.metrics.Misses, 1)
@@ -100,3 +119,24 @@ func (f *tableFilterWriter) metaName() string {
 func (f *tableFilterWriter) policyName() string {
 	return f.policy.Name()
 }
+
+// estimatedFPR returns the theoretical false positive rate of a filter in the
+// RocksDB full filter format (as written by the bloom package), computed using
+// the standard bloom filter formula (1 - e^(-kn/m))^k, where k is the number of
+// probes, n is the number of keys added to the filter and m is the number of
+// bits in the filter. It returns 0 if the filter is empty or doesn't appear to
+// be in the full filter format.
+func (f *tableFilterWriter) estimatedFPR(filter []byte) float64 {
+	// The full filter format is the filter bits, followed by a 1 byte probe
+	// count and a 4 byte cache line count.
+	const trailerLen = 5
+	if f.count == 0 || len(filter) <= trailerLen {
+		return 0
+	}
+	k := float64(filter[len(filter)-trailerLen])
+	m := float64(8 * (len(filter) - trailerLen))
+	if k == 0 {
+		return 0
+	}
+	return math.Pow(1-math.Exp(-k*float64(f.count)/m), k)
+}
@@ -5,6 +5,8 @@
 package sstable
 
 import (
+	"strings"
+
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
 )
@@ -23,8 +25,9 @@ const (
 	TableFormatRocksDBv2
 	TableFormatPebblev1 // Block properties.
 	TableFormatPebblev2 // Range keys.
+	TableFormatPebblev3 // Compact footers, tables without point blocks.
 
-	TableFormatMax = TableFormatPebblev2
+	TableFormatMax = TableFormatPebblev3
 )
 
 // ParseTableFormat parses the given magic bytes and version into its
@@ -46,6 +49,8 @@ func ParseTableFormat(magic []byte, version uint32) (TableFormat, error) {
 			return TableFormatPebblev1, nil
 		case 2:
 			return TableFormatPebblev2, nil
+		case 3:
+			return TableFormatPebblev3, nil
 		default:
 			return TableFormatUnspecified, base.CorruptionErrorf(
 				"pebble/table: unsupported pebble format version %d", errors.Safe(version),
@@ -69,6 +74,8 @@ func (f TableFormat) AsTuple() (string, uint32) {
 		return pebbleDBMagic, 1
 	case TableFormatPebblev2:
 		return pebbleDBMagic, 2
+	case TableFormatPebblev3:
+		return pebbleDBMagic, 3
 	default:
 		panic("sstable: unknown table format version tuple")
 	}
@@ -85,7 +92,75 @@ func (f TableFormat) String() string {
 		return "(Pebble,v1)"
 	case TableFormatPebblev2:
 		return "(Pebble,v2)"
+	case TableFormatPebblev3:
+		return "(Pebble,v3)"
 	default:
 		panic("sstable: unknown table format version tuple")
 	}
 }
+
+// FeatureFlags is a set of the table format features used by a table. See
+// WriterMetadata.FeatureFlags.
+type FeatureFlags uint32
+
+// The table format features recorded in FeatureFlags.
+const (
+	// FeatureTwoLevelIndex indicates that the table has a two-level index.
+	FeatureTwoLevelIndex FeatureFlags = 1 << iota
+	// FeatureBlockProperties indicates that the table's index entries carry
+	// block properties.
+	FeatureBlockProperties
+	// FeatureCompressedProperties indicates that the table's properties block
+	// may be compressed.
+	FeatureCompressedProperties
+	// FeatureRangeKeys indicates that the table contains range keys.
+	FeatureRangeKeys
+	// FeatureCompactFooter indicates that the table ends with a compact footer
+	// holding its metaindex and index blocks inline.
+	FeatureCompactFooter
+	// FeatureNoPointBlocks indicates that the table omits the data and index
+	// blocks because it contains no point keys.
+	FeatureNoPointBlocks
+)
+
+// tableFeatures lists each of the FeatureFlags, with its name and the
+// minimum table format which supports it.
+var tableFeatures = []struct {
+	flag      FeatureFlags
+	name      string
+	minFormat TableFormat
+}{
+	{FeatureTwoLevelIndex, "two-level index", TableFormatRocksDBv2},
+	{FeatureBlockProperties, "block properties", TableFormatPebblev1},
+	{FeatureCompressedProperties, "compressed properties", TableFormatPebblev1},
+	{FeatureRangeKeys, "range keys", TableFormatPebblev2},
+	{FeatureCompactFooter, "compact footer", TableFormatPebblev3},
+	{FeatureNoPointBlocks, "no point blocks", TableFormatPebblev3},
+}
+
+// MinimumTableFormat returns the oldest table format which supports all of
+// the features, or TableFormatLevelDB if there are none.
+func (f FeatureFlags) MinimumTableFormat() TableFormat {
+	format := TableFormatLevelDB
+	for _, feature := range tableFeatures {
+		if f&feature.flag != 0 && feature.minFormat > format {
+			format = feature.minFormat
+		}
+	}
+	return format
+}
+
+// String returns the names of the features, separated by commas.
+func (f FeatureFlags) String() string {
+	var buf strings.Builder
+	for _, feature := range tableFeatures {
+		if f&feature.flag == 0 {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(feature.name)
+	}
+	return buf.String()
+}
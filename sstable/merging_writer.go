@@ -0,0 +1,166 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
+)
+
+var errMergingWriterProducerFinished = errors.New("pebble: merging writer producer is finished")
+
+// MergingWriter merges the keys pushed by a fixed number of concurrent
+// producers into a single Writer. Each producer must push its keys in
+// increasing order, but the keys of different producers may be interleaved
+// arbitrarily. The MergingWriter adds the keys to the underlying Writer in
+// increasing order, subject to the same ordering requirements as Writer.Add.
+//
+// A key can only be added to the Writer once every producer that has not yet
+// finished has a key pending, since until then a producer could push a smaller
+// key. For this reason, Push blocks until the pushed key has been added to the
+// Writer, and a producer must call Finish once it has no more keys to push so
+// that the other producers can make progress.
+type MergingWriter struct {
+	w *Writer
+
+	mu   sync.Mutex
+	cond sync.Cond
+	// producers is indexed by producer ID.
+	producers []mergingWriterProducer
+	// active is the number of producers which have not finished.
+	active int
+	// pending is a heap of the IDs of producers with a key pending, ordered by
+	// the pending key.
+	pending mergingWriterHeap
+	// err is the first error encountered adding a key to the Writer. Once set,
+	// all calls to Push return it.
+	err error
+}
+
+type mergingWriterProducer struct {
+	key      InternalKey
+	value    []byte
+	pending  bool
+	finished bool
+}
+
+// NewMergingWriter returns a MergingWriter which merges the keys of
+// numProducers producers, with IDs in [0, numProducers), into w. Closing the
+// MergingWriter closes w.
+func NewMergingWriter(w *Writer, numProducers int) *MergingWriter {
+	m := &MergingWriter{
+		w:         w,
+		producers: make([]mergingWriterProducer, numProducers),
+		active:    numProducers,
+	}
+	m.cond.L = &m.mu
+	m.pending.m = m
+	return m
+}
+
+// Push adds the key/value pair to the table on behalf of the given producer,
+// blocking until the key has been added to the Writer. The keys pushed by a
+// single producer must be in increasing order. Push may be called
+// concurrently by different producers, but not concurrently by the same
+// producer.
+func (m *MergingWriter) Push(producerID int, key InternalKey, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	p := &m.producers[producerID]
+	if p.finished {
+		return errMergingWriterProducerFinished
+	}
+	p.key, p.value, p.pending = key, value, true
+	heap.Push(&m.pending, producerID)
+	m.maybeAddLocked()
+	for p.pending && m.err == nil {
+		m.cond.Wait()
+	}
+	if p.pending {
+		// The key was not added because another producer's key failed to be
+		// added to the Writer.
+		p.pending = false
+		p.key, p.value = InternalKey{}, nil
+	}
+	return m.err
+}
+
+// Finish indicates that the given producer will push no more keys.
+func (m *MergingWriter) Finish(producerID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := &m.producers[producerID]
+	if p.finished {
+		return
+	}
+	p.finished = true
+	m.active--
+	m.maybeAddLocked()
+}
+
+// maybeAddLocked adds pending keys to the Writer for as long as every active
+// producer has a key pending. m.mu must be held.
+func (m *MergingWriter) maybeAddLocked() {
+	for m.err == nil && m.active > 0 && m.pending.Len() == m.active {
+		id := heap.Pop(&m.pending).(int)
+		p := &m.producers[id]
+		m.err = m.w.Add(p.key, p.value)
+		p.pending = false
+		p.key, p.value = InternalKey{}, nil
+	}
+	m.cond.Broadcast()
+}
+
+// Close finishes writing the table and closes the underlying Writer. Every
+// producer must have called Finish.
+func (m *MergingWriter) Close() error {
+	m.mu.Lock()
+	active := m.active
+	m.mu.Unlock()
+	if active > 0 {
+		// Close the Writer regardless, so that the underlying file is closed.
+		err := m.w.Close()
+		return errors.CombineErrors(
+			errors.Newf("pebble: %d merging writer producers are not finished", active), err)
+	}
+	return m.w.Close()
+}
+
+// Writer returns the underlying Writer. It may be used to retrieve the
+// Writer's metadata once the MergingWriter is closed.
+func (m *MergingWriter) Writer() *Writer {
+	return m.w
+}
+
+// mergingWriterHeap is a heap of producer IDs, ordered by each producer's
+// pending key.
+type mergingWriterHeap struct {
+	m   *MergingWriter
+	ids []int
+}
+
+func (h *mergingWriterHeap) Len() int { return len(h.ids) }
+
+func (h *mergingWriterHeap) Less(i, j int) bool {
+	a, b := &h.m.producers[h.ids[i]], &h.m.producers[h.ids[j]]
+	return base.InternalCompare(h.m.w.compare, a.key, b.key) < 0
+}
+
+func (h *mergingWriterHeap) Swap(i, j int) { h.ids[i], h.ids[j] = h.ids[j], h.ids[i] }
+
+func (h *mergingWriterHeap) Push(x interface{}) { h.ids = append(h.ids, x.(int)) }
+
+func (h *mergingWriterHeap) Pop() interface{} {
+	n := len(h.ids)
+	x := h.ids[n-1]
+	h.ids = h.ids[:n-1]
+	return x
+}
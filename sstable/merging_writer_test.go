@@ -0,0 +1,83 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergingWriter(t *testing.T) {
+	const numProducers = 4
+	const numKeys = 2000
+
+	f := &memFile{}
+	m := NewMergingWriter(NewWriter(f, WriterOptions{BlockSize: 256}), numProducers)
+	var wg sync.WaitGroup
+	for p := 0; p < numProducers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			defer m.Finish(p)
+			rng := rand.New(rand.NewSource(int64(p)))
+			// Each producer pushes a random subset of the keys that belong to it.
+			for i := p; i < numKeys; i += numProducers {
+				if rng.Intn(4) == 0 {
+					continue
+				}
+				key := base.MakeInternalKey([]byte(fmt.Sprintf("%06d", i)), 0, InternalKeyKindSet)
+				require.NoError(t, m.Push(p, key, []byte(fmt.Sprint(p))))
+			}
+		}(p)
+	}
+	wg.Wait()
+	require.NoError(t, m.Close())
+
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+	it, err := r.NewIter(nil, nil)
+	require.NoError(t, err)
+	defer it.Close()
+	var prev []byte
+	var n int
+	for k, v := it.First(); k != nil; k, v = it.Next() {
+		require.Less(t, string(prev), string(k.UserKey))
+		var i int
+		_, err := fmt.Sscanf(string(k.UserKey), "%06d", &i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(i%numProducers), string(v))
+		prev = append(prev[:0], k.UserKey...)
+		n++
+	}
+	require.Equal(t, r.Properties.NumEntries, uint64(n))
+}
+
+func TestMergingWriterError(t *testing.T) {
+	m := NewMergingWriter(NewWriter(&memFile{}, WriterOptions{}), 2)
+	key := base.MakeInternalKey([]byte("a"), 0, InternalKeyKindSet)
+
+	// Both producers push the same key, which violates the Writer's strict
+	// ordering. Whichever key is added second fails.
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for p := 0; p < 2; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			errs[p] = m.Push(p, key, nil)
+			m.Finish(p)
+		}(p)
+	}
+	wg.Wait()
+	require.True(t, (errs[0] == nil) != (errs[1] == nil), "%v", errs)
+	require.Error(t, m.Push(0, key, nil))
+	require.Error(t, m.Close())
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"math"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/keyspan"
+	"github.com/cockroachdb/pebble/internal/rangekey"
+)
+
+// MVCCTimestampPropertyName is the name of the block property collector
+// which records the interval of the MVCC timestamps of the keys of each block,
+// index block and table, as enabled by
+// WriterOptions.EnableMVCCTimestampProperties. Blocks may be filtered on the
+// property with NewMVCCTimestampFilter.
+const MVCCTimestampPropertyName = "pebble.mvcc-timestamps"
+
+// MVCCTimestampDecoder decodes the MVCC timestamp of a key from its suffix,
+// the portion of the key following the prefix returned by Comparer.Split. It
+// is only called with non-empty suffixes.
+type MVCCTimestampDecoder func(suffix []byte) (uint64, error)
+
+// NewMVCCTimestampCollector returns a block property collector which records
+// the interval of the MVCC timestamps of the point and range keys of each
+// block, index block and table, under MVCCTimestampPropertyName. The
+// timestamp of each key is decoded by decode from the suffix of the key
+// determined by split. Keys without a suffix, and range key deletions, are
+// treated as spanning all timestamps, so that they are never filtered out.
+func NewMVCCTimestampCollector(split Split, decode MVCCTimestampDecoder) BlockPropertyCollector {
+	return NewBlockIntervalCollector(
+		MVCCTimestampPropertyName,
+		&mvccTimestampCollector{split: split, decode: decode},
+		&mvccTimestampCollector{split: split, decode: decode, rangeKeys: true})
+}
+
+// NewMVCCTimestampFilter returns a block property filter which excludes the
+// blocks and tables whose keys all have MVCC timestamps outside of
+// [lower, upper), as recorded by the collector returned by
+// NewMVCCTimestampCollector.
+func NewMVCCTimestampFilter(lower, upper uint64) *BlockIntervalFilter {
+	return NewBlockIntervalFilter(MVCCTimestampPropertyName, lower, upper)
+}
+
+// mvccTimestampCollector is a DataBlockIntervalCollector over the MVCC
+// timestamps of either point keys or, if rangeKeys is set, range keys.
+type mvccTimestampCollector struct {
+	split     Split
+	decode    MVCCTimestampDecoder
+	rangeKeys bool
+	interval  interval
+	keysBuf   []keyspan.Key
+}
+
+var _ DataBlockIntervalCollector = (*mvccTimestampCollector)(nil)
+
+// Add implements the DataBlockIntervalCollector interface.
+func (c *mvccTimestampCollector) Add(key InternalKey, value []byte) error {
+	if !c.rangeKeys {
+		return c.addSuffix(key.UserKey[c.split(key.UserKey):])
+	}
+	if key.Kind() == base.InternalKeyKindRangeKeyDelete {
+		// A range key deletion applies to keys of all timestamps.
+		c.interval.union(interval{lower: 0, upper: math.MaxUint64})
+		return nil
+	}
+	span, err := rangekey.Decode(key, value, c.keysBuf[:0])
+	if err != nil {
+		return err
+	}
+	c.keysBuf = span.Keys
+	for i := range span.Keys {
+		if err := c.addSuffix(span.Keys[i].Suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addSuffix adds the timestamp of the given suffix to the interval.
+func (c *mvccTimestampCollector) addSuffix(suffix []byte) error {
+	if len(suffix) == 0 {
+		c.interval.union(interval{lower: 0, upper: math.MaxUint64})
+		return nil
+	}
+	ts, err := c.decode(suffix)
+	if err != nil {
+		return err
+	}
+	upper := ts + 1
+	if upper == 0 {
+		// The interval is half-open, and cannot include math.MaxUint64.
+		upper = math.MaxUint64
+	}
+	c.interval.union(interval{lower: ts, upper: upper})
+	return nil
+}
+
+// FinishDataBlock implements the DataBlockIntervalCollector interface.
+func (c *mvccTimestampCollector) FinishDataBlock() (lower, upper uint64, err error) {
+	i := c.interval
+	c.interval = interval{}
+	return i.lower, i.upper, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/testkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeTestkeysTimestamp(suffix []byte) (uint64, error) {
+	ts, err := testkeys.ParseSuffix(suffix)
+	return uint64(ts), err
+}
+
+func TestMVCCTimestampProperties(t *testing.T) {
+	write := func(fn func(w *Writer)) *Reader {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			BlockSize:                     128,
+			Comparer:                      testkeys.Comparer,
+			DecodeMVCCTimestamp:           decodeTestkeysTimestamp,
+			EnableMVCCTimestampProperties: true,
+			TableFormat:                   TableFormatPebblev2,
+		})
+		fn(w)
+		require.NoError(t, w.Close())
+		r, err := NewMemReader(f.Data(), ReaderOptions{Comparer: testkeys.Comparer})
+		require.NoError(t, err)
+		return r
+	}
+	// scan returns the number of keys returned by an iterator filtered to
+	// timestamps in [lower, upper), or -1 if the table is excluded.
+	scan := func(r *Reader, lower, upper uint64) int {
+		filterer := NewBlockPropertiesFilterer(
+			[]BlockPropertyFilter{NewMVCCTimestampFilter(lower, upper)}, nil)
+		ok, err := filterer.IntersectsUserPropsAndFinishInit(r.Properties.UserProperties)
+		require.NoError(t, err)
+		if !ok {
+			return -1
+		}
+		iter, err := r.NewIterWithBlockPropertyFilters(
+			nil, nil, filterer, false /* useFilterBlock */, nil /* stats */)
+		require.NoError(t, err)
+		var n int
+		for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+			n++
+		}
+		require.NoError(t, iter.Close())
+		return n
+	}
+
+	// Each run of 100 keys has a distinct timestamp, so blocks of other
+	// timestamps are skipped.
+	r := write(func(w *Writer) {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key%04d@%d", i, i/100+1))
+			require.NoError(t, w.Set(key, []byte("value")))
+		}
+	})
+	require.Equal(t, 1000, scan(r, 0, 100))
+	n := scan(r, 3, 4)
+	require.GreaterOrEqual(t, n, 100)
+	require.Less(t, n, 150)
+	require.Equal(t, -1, scan(r, 11, 100))
+	require.NoError(t, r.Close())
+
+	// Unversioned keys span all timestamps.
+	r = write(func(w *Writer) {
+		require.NoError(t, w.Set([]byte("a"), []byte("value")))
+		require.NoError(t, w.Set([]byte("b@5"), []byte("value")))
+	})
+	require.Equal(t, 2, scan(r, 1000, 2000))
+	require.NoError(t, r.Close())
+
+	// The suffixes of range keys extend the table's interval.
+	r = write(func(w *Writer) {
+		require.NoError(t, w.Set([]byte("a@5"), []byte("value")))
+		require.NoError(t, w.RangeKeySet([]byte("b"), []byte("c"), []byte("@50"), nil))
+	})
+	require.Equal(t, -1, scan(r, 60, 100))
+	require.Equal(t, 0, scan(r, 50, 51))
+	require.NoError(t, r.Close())
+
+	// A decoder is required.
+	w := NewWriter(&memFile{}, WriterOptions{
+		Comparer:                      testkeys.Comparer,
+		EnableMVCCTimestampProperties: true,
+		TableFormat:                   TableFormatPebblev2,
+	})
+	require.Regexp(t, "requires DecodeMVCCTimestamp", w.Close())
+}
@@ -5,6 +5,9 @@
 package sstable
 
 import (
+	"hash"
+	"time"
+
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/cache"
 )
@@ -117,6 +120,39 @@ type ReaderOptions struct {
 	// written with {Batch,DB}.Merge. The MergerName is checked for consistency
 	// with the value stored in the sstable when it was written.
 	MergerName string
+
+	// FilterKeyTransform is applied to the keys with which the filter of a
+	// table written with a FilterKeyTransform of the same name is queried. The
+	// filter of a table written with a FilterKeyTransform is not used unless
+	// a FilterKeyTransform of the same name is provided.
+	FilterKeyTransform *FilterKeyTransform
+}
+
+// FilterKeyTransform derives the keys added to a table's filter from the keys
+// that would otherwise be added: each key's prefix, as returned by the
+// Comparer's Split function, or the whole key if there is no Split function
+// or if WriterOptions.FilterWholeKeys is set. The same transform is applied to
+// the keys with which the filter is queried, so the filter answers queries for
+// whatever the transform derives, such as a hash of part of the key.
+type FilterKeyTransform struct {
+	// Name is recorded in the properties of tables written with the transform,
+	// and identifies the transform to the Reader.
+	Name string
+
+	// Transform appends the key derived from key to dst, returning the
+	// resulting slice. It must be deterministic. The returned slice is only
+	// used until the next call, allowing dst to be reused across calls.
+	Transform func(key, dst []byte) []byte
+}
+
+// BlockHash names a hash function computed over the uncompressed contents of
+// each data block. See WriterOptions.DataBlockHash.
+type BlockHash struct {
+	// Name is recorded in the properties of tables written with the hash.
+	Name string
+
+	// New returns a new instance of the hash function, such as sha256.New.
+	New func() hash.Hash
 }
 
 func (o ReaderOptions) ensureDefaults() ReaderOptions {
@@ -129,6 +165,19 @@ func (o ReaderOptions) ensureDefaults() ReaderOptions {
 	return o
 }
 
+// UserKeyBounds is the span of user keys [Lower, Upper). A nil Lower or Upper
+// leaves the span unbounded on that side.
+type UserKeyBounds struct {
+	Lower []byte
+	Upper []byte
+}
+
+// KeyRange is the span of internal keys [Smallest, Largest], inclusive.
+type KeyRange struct {
+	Smallest InternalKey
+	Largest  InternalKey
+}
+
 // WriterOptions holds the parameters used to control building an sstable.
 type WriterOptions struct {
 	// BlockRestartInterval is the number of keys between restart points
@@ -184,6 +233,18 @@ type WriterOptions struct {
 	// filters should be preferred except under constrained memory situations.
 	FilterType FilterType
 
+	// FilterWholeKeys, when used in conjunction with a FilterPolicy and a
+	// Comparer that defines a Split function, adds the full user key of every
+	// point key to the filter in addition to the key's prefix. This allows
+	// readers that know the exact key they're looking for (e.g. an MVCC point
+	// lookup of userkey@ts) to query the filter more precisely than by prefix
+	// alone, at the cost of roughly doubling the number of filter entries. See
+	// Reader.FilterMayContain.
+	//
+	// The default value is false. Without a Split function, the filter is
+	// always built on whole keys and this option has no effect.
+	FilterWholeKeys bool
+
 	// IndexBlockSize is the target uncompressed size in bytes of each index
 	// block. When the index block size is larger than this target, two-level
 	// indexes are automatically enabled. Setting this option to a large value
@@ -198,6 +259,16 @@ type WriterOptions struct {
 	// with the value stored in the sstable when it was written.
 	MergerName string
 
+	// ComparerVersion and MergerVersion are optional versions of the Comparer
+	// and Merger, recorded in the table's properties alongside their names.
+	// They allow a reader to detect a table written with a comparer or merger
+	// which shares the name of, but is incompatible with, its own. The Writer
+	// records the versions verbatim.
+	//
+	// The default value is empty, in which case no version is recorded.
+	ComparerVersion string
+	MergerVersion   string
+
 	// TableFormat specifies the format version for writing sstables. The default
 	// is TableFormatRocksDBv2 which creates RocksDB compatible sstables. Use
 	// TableFormatLevelDB to create LevelDB compatible sstable which can be used
@@ -214,6 +285,18 @@ type WriterOptions struct {
 	// built and lives for the lifetime of writing that table.
 	BlockPropertyCollectors []func() BlockPropertyCollector
 
+	// EnableMVCCTimestampProperties adds the block property collector
+	// returned by NewMVCCTimestampCollector to BlockPropertyCollectors,
+	// recording the interval of the MVCC timestamps of the keys of each
+	// block, decoded by DecodeMVCCTimestamp from the suffixes determined by
+	// Comparer.Split. Readers may skip blocks outside of a time window with
+	// NewMVCCTimestampFilter. Requires TableFormatPebblev1 or later.
+	EnableMVCCTimestampProperties bool
+
+	// DecodeMVCCTimestamp decodes the MVCC timestamp of a key from its
+	// suffix. It is required by EnableMVCCTimestampProperties.
+	DecodeMVCCTimestamp MVCCTimestampDecoder
+
 	// Checksum specifies which checksum to use.
 	Checksum ChecksumType
 
@@ -221,6 +304,346 @@ type WriterOptions struct {
 	// compress data blocks and write datablocks to disk in parallel with the
 	// Writer client goroutine.
 	Parallelism bool
+
+	// WriteQueueSize is the number of data blocks which may be queued to be
+	// written to disk, without blocking the Writer client goroutine, when
+	// Parallelism is enabled. The default, used if WriteQueueSize is zero, is
+	// GOMAXPROCS. A smaller queue bounds the memory held by queued blocks,
+	// while a larger one absorbs bursts of writes. WriteQueueSize must not be
+	// negative.
+	WriteQueueSize int
+
+	// ContinueOnValidationError allows the Writer to remain usable after a key
+	// is rejected for failing validation (e.g. a key added out of order). The
+	// rejected key is not written and the error is returned to the caller, who
+	// may skip the key and continue adding keys. The errors for rejected keys
+	// are marked with ErrValidation. Errors encountered while writing blocks
+	// are always fatal to the Writer.
+	//
+	// The default value is false, in which case any error returned by the
+	// Writer is returned by all subsequent calls.
+	ContinueOnValidationError bool
+
+	// MaxValidationErrors is the number of the errors for keys rejected with
+	// ContinueOnValidationError set that the Writer retains, to be returned by
+	// Writer.TakeValidationErrors. Errors beyond the limit are returned to the
+	// caller but not retained. The default value of zero retains none.
+	MaxValidationErrors int
+
+	// Deterministic disables Parallelism and clears Now, and has no other
+	// effect. It is a convenience for callers which receive options from
+	// elsewhere and require that neither is in effect; clearing Now keeps the
+	// time at which the table was written out of its bytes.
+	Deterministic bool
+
+	// SuffixStats, if non-nil, enables the collection of statistics on the
+	// suffixes of the keys in the table. Each point key and each suffix of each
+	// range key is mapped to a bucket by SuffixStats, and the number of keys in
+	// each bucket is recorded in the user properties
+	// SuffixStatsPointKeysPropertyName and SuffixStatsRangeKeysPropertyName.
+	// The properties may be decoded with DecodeSuffixStats. The number of
+	// distinct buckets should be kept small, since the histogram is stored in
+	// the properties block.
+	SuffixStats SuffixBucketFunc
+
+	// SizeDistribution enables the estimation of the distribution of the
+	// sizes of the user keys and values of the table's point keys. The sizes
+	// are sampled, keeping the Writer's memory usage bounded, and their
+	// 50th, 90th and 99th percentiles are recorded in the user property
+	// SizeDistributionPropertyName, which may be decoded with
+	// DecodeSizeDistribution.
+	SizeDistribution bool
+
+	// SeqNumHistogram, if non-empty, enables a histogram of the sequence
+	// numbers of the table's point keys. It holds the strictly increasing
+	// bounds of the histogram's buckets: [0, SeqNumHistogram[0]),
+	// [SeqNumHistogram[0], SeqNumHistogram[1]) and so on, with the last
+	// bucket unbounded above. The number of point keys in each non-empty
+	// bucket is recorded in the user property SeqNumHistogramPropertyName,
+	// which may be decoded with DecodeSeqNumHistogram.
+	SeqNumHistogram []uint64
+
+	// SelfCheckBlocks causes the Writer to verify each block after writing it,
+	// by recomputing its checksum and decompressing it and comparing the
+	// result to the block before compression. A mismatch is returned as an
+	// error. This is expensive, and is intended for use in tests and fuzzing.
+	SelfCheckBlocks bool
+
+	// VerifyCollectorDeterminism causes the Writer to construct a second
+	// instance of each block property collector, feed it the same calls as
+	// the first, and fail with an error if the two return different
+	// properties for a data block. This catches collectors whose output
+	// depends on hidden state, such as map iteration order or the current
+	// time, at the cost of running every collector twice.
+	VerifyCollectorDeterminism bool
+
+	// PlainCompat restricts the Writer to the features of the LevelDB table
+	// format, so that the table may be read by external consumers which do
+	// not understand any of the Pebble or RocksDB extensions. The table format
+	// defaults to TableFormatLevelDB, which is the only format permitted, and
+	// the index is always single-level. NewWriter fails if options requiring
+	// other features are set, such as a checksum other than CRC32c, block
+	// property collectors, CompressProperties or OmitEmptyPointBlocks, and
+	// range deletions and range keys are rejected when added.
+	PlainCompat bool
+
+	// OmitEmptyPointBlocks causes a table without any point keys, such as one
+	// containing only range deletions or range keys, to be written without
+	// the empty data block and index block that are otherwise required. Such
+	// a table is marked by the Properties.NoPointBlocks property. Omitting the
+	// blocks requires TableFormatPebblev3 or later, since earlier versions of
+	// Pebble are unable to read such a table; the option has no effect on
+	// earlier formats.
+	OmitEmptyPointBlocks bool
+
+	// CompressProperties causes the properties block to be compressed using
+	// Compression, which is worthwhile when the table carries large user
+	// properties. By default the properties block is not compressed, since
+	// RocksDB requires it to be uncompressed. Requires TableFormatPebblev1 or
+	// later.
+	CompressProperties bool
+
+	// RecordPresentKeyKinds causes the Writer to record the kinds of the keys
+	// in the table in the Properties.PresentKeyKinds property, allowing a
+	// reader to determine which kinds of keys it must handle before iterating
+	// over the table. It has no effect on tables in the RocksDB formats, whose
+	// properties match those written by RocksDB.
+	RecordPresentKeyKinds bool
+
+	// KeyBounds, if set, causes the Writer to reject any point key, range
+	// deletion or range key that does not lie entirely within the bounds. The
+	// rejected key is not written, and the error is handled as described by
+	// ContinueOnValidationError.
+	KeyBounds UserKeyBounds
+
+	// KeyValidator, if non-nil, is called with the user key of every point
+	// key added to the Writer, and with the start and end keys of every range
+	// deletion and range key, allowing a schema for keys to be enforced when
+	// the table is written rather than when it is read. A key for which
+	// KeyValidator returns an error is rejected and not written, and the
+	// error, annotated with the key, is handled as described by
+	// ContinueOnValidationError.
+	KeyValidator func(userKey []byte) error
+
+	// CoalesceRangeDels causes the Writer to merge adjacent range deletion
+	// fragments, where the end key of one is the start key of the next, if
+	// they are covered by tombstones with identical sequence numbers, reducing
+	// the number of tombstones written to the range-del block. The tombstones
+	// must still be added in fragmented order, and the coalesced tombstones
+	// remain fragmented. Table properties count the tombstones written.
+	CoalesceRangeDels bool
+
+	// KeyRangeOverride, if non-nil, is the key range the table is to claim,
+	// which may be wider than the keys it contains. Close sets the
+	// SmallestPoint and LargestPoint of the WriterMetadata to the override
+	// instead of to the table's smallest and largest point keys. The override
+	// must contain every point key, range deletion and range key in the table;
+	// if it does not, Close returns an error without finishing the table.
+	// HasPointKeys is unaffected.
+	KeyRangeOverride *KeyRange
+
+	// ExpectedRangeDelBounds, if non-nil, are the bounds the table's range
+	// deletions are expected to fall within. Close checks that the smallest
+	// and largest range deletion keys, as reported by SmallestRangeDel and
+	// LargestRangeDel of the WriterMetadata, are contained in the bounds, and
+	// returns an error without finishing the table if they are not. The check
+	// is skipped if the table has no range deletions.
+	ExpectedRangeDelBounds *KeyRange
+
+	// FirstBlockEntryCount, if positive, causes the first data block to be
+	// flushed once it holds exactly FirstBlockEntryCount entries, regardless of
+	// its size. Subsequent data blocks are flushed according to BlockSize and
+	// BlockSizeThreshold as usual.
+	FirstBlockEntryCount int
+
+	// FixedBlockEntryCount, if positive, causes every data block to be flushed
+	// once it holds exactly FixedBlockEntryCount entries, regardless of its
+	// size, overriding BlockSize and BlockSizeThreshold. Only the final data
+	// block may hold fewer entries. FirstBlockEntryCount, if also set, takes
+	// precedence for the first data block.
+	FixedBlockEntryCount int
+
+	// MinDataBlocks, if greater than one, causes the Writer to produce a table
+	// with at least MinDataBlocks data blocks, provided at least that many
+	// point keys are added, regardless of their size. Until MinDataBlocks-1
+	// data blocks have been flushed, each data block is flushed as soon as
+	// it holds a single entry, after which blocks are flushed as usual.
+	// FirstBlockEntryCount, if also set, takes precedence for the first data
+	// block. It is intended for producing compact multi-block tables in tests.
+	MinDataBlocks int
+
+	// RequirePreFragmentedRangeKeys causes the Writer to reject a span added
+	// through RangeKeySet, RangeKeyUnset or RangeKeyDelete that overlaps the
+	// previously added span without sharing its start and end keys, instead
+	// of fragmenting the overlapping spans. The rejected span is not written,
+	// and the error is handled as described by ContinueOnValidationError.
+	// Spans with identical bounds are still coalesced.
+	RequirePreFragmentedRangeKeys bool
+
+	// BufferAndSortRangeKeys allows spans to be added through RangeKeySet,
+	// RangeKeyUnset and RangeKeyDelete in any order. The Writer buffers the
+	// spans in memory and, at Close, sorts them by start key and fragments
+	// them. Spans rejected by RequirePreFragmentedRangeKeys are then only
+	// reported by Close. Point keys must still be added in order.
+	BufferAndSortRangeKeys bool
+
+	// MaxBufferedRangeKeys, if positive, is the maximum number of spans which
+	// may be buffered when BufferAndSortRangeKeys is set. Adding a span beyond
+	// the limit returns an error, after which the Writer is no longer usable.
+	MaxBufferedRangeKeys int
+
+	// ValidateBoundsConsistency causes Close to verify, for a table containing
+	// both point keys and range keys, that the range keys lie within the
+	// bounds of the point keys: the start of the smallest range key must not
+	// sort before the smallest point key, and the end of the largest range
+	// key must not sort after the largest point key. Close returns an error,
+	// without finishing the table, if they do not.
+	ValidateBoundsConsistency bool
+
+	// AdaptiveRestartInterval causes the restart interval of each data block
+	// after the first to be chosen according to how compressible the keys of
+	// the preceding data block were: BlockRestartInterval is doubled if
+	// consecutive keys shared, on average, at least three quarters of their
+	// bytes, and halved if they shared less than a quarter. A longer interval
+	// packs keys with long shared prefixes more tightly, while a shorter one
+	// speeds up seeks within blocks whose keys gain little from prefix
+	// compression.
+	AdaptiveRestartInterval bool
+
+	// DisablePrefixCompression causes every entry of every data block to be a
+	// restart point, so that each entry stores its full key rather than
+	// eliding the prefix shared with the preceding key. Every entry of such a
+	// block may be decoded independently of the others. The blocks remain
+	// readable by any reader, since a restart interval of one is already
+	// supported. BlockRestartInterval and AdaptiveRestartInterval are ignored.
+	DisablePrefixCompression bool
+
+	// FullKeyIndexSeparators causes the separator of each index entry to be
+	// the full last key of its data block, rather than a shortened key
+	// between the last key of the block and the first key of the next. The
+	// index is larger, but each separator is exactly the largest key of its
+	// block. The tables remain readable by any reader, since readers accept
+	// any separator that is at least the largest key of its block.
+	FullKeyIndexSeparators bool
+
+	// FilterKeyTransform, if non-nil, is applied to each key before it is
+	// added to the filter. See FilterKeyTransform.
+	FilterKeyTransform *FilterKeyTransform
+
+	// DataBlockHash, if non-nil, causes the Writer to hash the uncompressed
+	// contents of each data block, and to record the hashes, keyed by the
+	// offset of the block, in a meta block, allowing identical blocks to be
+	// identified across tables. The name of the hash is recorded in
+	// Properties.DataBlockHashName. The hashes may be retrieved with
+	// Reader.DataBlockHashes, and are otherwise ignored by readers.
+	DataBlockHash *BlockHash
+
+	// DataBlockFirstByteRanges causes the Writer to record, for each data
+	// block, the smallest and largest first byte of the user keys in the
+	// block, keyed by the offset of the block, in a meta block. A filtered
+	// scan may skip the blocks whose range of first bytes cannot match its
+	// predicate. The ranges may be retrieved with
+	// Reader.DataBlockFirstByteRanges, and are otherwise ignored by readers.
+	DataBlockFirstByteRanges bool
+
+	// PropertiesTemplate, if non-nil, provides the static properties of a set
+	// of tables written with the same configuration. The ColumnFamilyName,
+	// and any ComparerVersion, MergerVersion or UserProperties not otherwise
+	// provided, are taken from the template. The names and versions of the
+	// comparer and merger, and the names of the compression, filter policy,
+	// prefix extractor and property collectors, if set in the template, must
+	// match those the Writer derives from its options, or the Writer fails
+	// with an error. All other properties, including every counter, are
+	// computed by the Writer.
+	PropertiesTemplate *Properties
+
+	// MaxUserPropertiesBytes, if positive, limits the total length of the
+	// names and values of the table's user properties, including those
+	// produced by the table and block property collectors. If the limit is
+	// exceeded, Close returns an error, naming the collector which produced
+	// the most output, without finishing the table.
+	MaxUserPropertiesBytes int
+
+	// PreFinishValidator, if non-nil, is called by Close with the table's
+	// metadata once every block has been written, but before the footer is
+	// written and the written data is flushed and synced. The metadata is
+	// fully populated, as returned by Metadata, and must not be modified. If
+	// PreFinishValidator returns an error, the table is left unfinished: Close
+	// closes the file without writing the footer, flushing or syncing it and
+	// returns the error, and the caller is expected to remove the file.
+	PreFinishValidator func(*WriterMetadata) error
+
+	// RewriteUserProperty, if non-nil, is called by Close with the name of
+	// each BlockPropertyCollector and the table property it returned from
+	// FinishTable, and the value it returns is stored in the table's user
+	// properties in place of the collector's. The value passed excludes the
+	// short ID the Writer prefixes to the property, and the Writer prefixes
+	// the same short ID to the rewritten value. RewriteUserProperty allows
+	// block property encodings to be migrated without modifying collectors.
+	// If it returns an error, Close fails with that error.
+	RewriteUserProperty func(name string, value []byte) ([]byte, error)
+
+	// AsyncFinish causes Close to return once the table has been completely
+	// written to the file, without waiting for the file to be synced and
+	// closed. The sync and close proceed in the background, and
+	// Writer.AwaitDurable waits for them to complete and returns any error
+	// they encounter. This allows a slow sync, e.g. of a file backed by remote
+	// storage, to overlap with writing the next table. Once Close returns, the
+	// table's metadata is available, but the table must not be considered
+	// durable until AwaitDurable returns nil.
+	AsyncFinish bool
+
+	// SmallTableThreshold, if positive, causes Close to end a table whose data
+	// fits in a single data block of fewer than SmallTableThreshold bytes,
+	// including its trailer, with a compact footer. The compact footer holds
+	// the contents of the metaindex block and index block inline, in place of
+	// writing them as separate blocks, saving their block trailers and the
+	// padding of the fixed size footer. The compact footer requires
+	// TableFormatPebblev3, and SmallTableThreshold has no effect on tables
+	// written in earlier formats.
+	SmallTableThreshold int
+
+	// IndexPartitionDataSizes causes the Writer, if it writes a two-level
+	// index, to record in each entry of the top-level index the total size of
+	// the data blocks indexed by the partition, so that a reader may plan
+	// reads across partitions. The size is encoded as an additional block
+	// property, which readers that are unaware of it ignore, and so requires
+	// TableFormatPebblev1 or later. See IndexPartitionDataSizePropertyName and
+	// Layout.IndexDataSizes.
+	IndexPartitionDataSizes bool
+
+	// RecordFlushTimes causes the Writer to record the time at which each data
+	// block is flushed, so that Writer.Metrics reports the time taken to flush
+	// the first data block and the intervals between subsequent flushes.
+	RecordFlushTimes bool
+
+	// RecordCompressionTimes causes the Writer to time the compression of
+	// each data block, and report the mean and maximum in WriterMetadata.
+	// Compression time is a rough proxy for the cost of decompressing the
+	// table's blocks.
+	RecordCompressionTimes bool
+
+	// BlockAlignment, if positive, causes the Writer to pad the table with
+	// zeros before each block so that every block starts at an offset which
+	// is a multiple of BlockAlignment, which benefits readers using direct
+	// I/O. The padding, of up to BlockAlignment-1 bytes per block, is included
+	// in the size of the table but is not referenced by any block handle.
+	BlockAlignment int
+
+	// MultipartPartSize, if positive, is the size of the parts in which the
+	// table is uploaded to object storage. The Writer then prefers to flush a
+	// data block early, rather than let it grow across a part boundary, so
+	// that each part boundary falls within the first entry of a data block.
+	// This costs at most one smaller than usual data block per part. The
+	// preference is advisory: the boundaries are located using the estimated
+	// size of the table, which is approximate when blocks are compressed.
+	MultipartPartSize int
+
+	// Now, if non-nil, is the clock used to set Properties.CreationTime when
+	// the Writer is closed, typically time.Now. If nil, or if Deterministic is
+	// set, CreationTime is left as zero, meaning unknown, and the table's bytes
+	// do not depend on when it was written.
+	Now func() time.Time
 }
 
 func (o WriterOptions) ensureDefaults() WriterOptions {
@@ -251,7 +674,15 @@ func (o WriterOptions) ensureDefaults() WriterOptions {
 	// By default, if the table format is not specified, fall back to using the
 	// most compatible format.
 	if o.TableFormat == TableFormatUnspecified {
-		o.TableFormat = TableFormatRocksDBv2
+		if o.PlainCompat {
+			o.TableFormat = TableFormatLevelDB
+		} else {
+			o.TableFormat = TableFormatRocksDBv2
+		}
+	}
+	if o.Deterministic {
+		o.Parallelism = false
+		o.Now = nil
 	}
 	return o
 }
@@ -0,0 +1,55 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+
+	"github.com/cockroachdb/pebble/internal/base"
+)
+
+// IndexPartitionDataSizePropertyName is the name of the user property which
+// is present if the Writer recorded, in each entry of a table's top-level
+// index, the total size of the data blocks indexed by the partition, as
+// enabled by WriterOptions.IndexPartitionDataSizes. Like the property of a
+// block property collector, its value is the shortID under which the sizes
+// are encoded in the block properties of the top-level index entries.
+const IndexPartitionDataSizePropertyName = "pebble.index-partition-data-size"
+
+// appendPartitionDataSize appends the data size of an index partition, as a
+// block property with the given shortID, to the encoded block properties of
+// its top-level index entry. The shortID must be greater than that of any
+// property in props.
+func appendPartitionDataSize(props []byte, id shortID, size uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], size)
+	props = append(props, byte(id))
+	// The length of the property is at most MaxVarintLen64, and so is encoded
+	// as a single byte uvarint.
+	props = append(props, byte(n))
+	return append(props, buf[:n]...)
+}
+
+// decodePartitionDataSize returns the data size of an index partition
+// recorded under the given shortID in the block properties of its top-level
+// index entry.
+func decodePartitionDataSize(props []byte, id shortID) (uint64, error) {
+	d := blockPropertiesDecoder{props: props}
+	for !d.done() {
+		propID, prop, err := d.next()
+		if err != nil {
+			return 0, err
+		}
+		if propID != id {
+			continue
+		}
+		size, n := binary.Uvarint(prop)
+		if n <= 0 || n != len(prop) {
+			return 0, base.CorruptionErrorf("pebble: invalid index partition data size")
+		}
+		return size, nil
+	}
+	return 0, base.CorruptionErrorf("pebble: missing index partition data size")
+}
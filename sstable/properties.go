@@ -13,6 +13,7 @@ import (
 	"sort"
 	"unsafe"
 
+	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/intern"
 )
 
@@ -64,6 +65,9 @@ type Properties struct {
 	ColumnFamilyName string `prop:"rocksdb.column.family.name"`
 	// The name of the comparer used in this table.
 	ComparerName string `prop:"rocksdb.comparator"`
+	// The version of the comparer used in this table, as provided by the
+	// writer. Empty if no version was provided.
+	ComparerVersion string `prop:"pebble.comparator.version"`
 	// The compression algorithm used to compress blocks.
 	CompressionName string `prop:"rocksdb.compression"`
 	// The compression options used to compress blocks.
@@ -71,6 +75,9 @@ type Properties struct {
 	// The time when the SST file was created. Since SST files are immutable,
 	// this is equivalent to last modified time.
 	CreationTime uint64 `prop:"rocksdb.creation.time"`
+	// The name of the BlockHash of the data blocks recorded in the table.
+	// Empty if the data blocks were not hashed.
+	DataBlockHashName string `prop:"pebble.data-block-hash"`
 	// The total size of all data blocks.
 	DataSize uint64 `prop:"rocksdb.data.size"`
 	// The external sstable version format. Version 2 is the one RocksDB has been
@@ -79,6 +86,9 @@ type Properties struct {
 	ExternalFormatVersion uint32 `prop:"rocksdb.external_sst_file.version"`
 	// Actual SST file creation time. 0 means unknown.
 	FileCreationTime uint64 `prop:"rocksdb.file.creation.time"`
+	// The name of the FilterKeyTransform applied to the keys of the filter.
+	// Empty if the keys were not transformed.
+	FilterKeyTransformName string `prop:"pebble.filter.key-transform"`
 	// The name of the filter policy used in this table. Empty if no filter
 	// policy is used.
 	FilterPolicyName string `prop:"rocksdb.filter.policy"`
@@ -103,6 +113,12 @@ type Properties struct {
 	IndexValueIsDeltaEncoded uint64 `prop:"rocksdb.index.value.is.delta.encoded"`
 	// The name of the merger used in this table. Empty if no merger is used.
 	MergerName string `prop:"rocksdb.merge.operator"`
+	// The version of the merger used in this table, as provided by the writer.
+	// Empty if no version was provided.
+	MergerVersion string `prop:"pebble.merge.operator.version"`
+	// True if the table contains no point keys and was written without a data
+	// block or index block. See WriterOptions.OmitEmptyPointBlocks.
+	NoPointBlocks bool `prop:"pebble.no-point-blocks"`
 	// The number of blocks in this table.
 	NumDataBlocks uint64 `prop:"rocksdb.num.data.blocks"`
 	// The number of deletion entries in this table, including both point and
@@ -110,6 +126,11 @@ type Properties struct {
 	NumDeletions uint64 `prop:"rocksdb.deleted.keys"`
 	// The number of entries in this table.
 	NumEntries uint64 `prop:"rocksdb.num.entries"`
+	// The number of distinct key prefixes, as determined by the Comparer's
+	// Split function, added to the table's filter. Only recorded in
+	// TableFormatPebblev1 and later formats, for tables with a filter built
+	// on prefixes.
+	NumFilterPrefixes uint64 `prop:"pebble.filter.num-prefixes"`
 	// The number of merge operands in the table.
 	NumMergeOperands uint64 `prop:"rocksdb.merge.operands"`
 	// The number of range deletions in this table.
@@ -127,6 +148,14 @@ type Properties struct {
 	PrefixExtractorName string `prop:"rocksdb.prefix.extractor.name"`
 	// If filtering is enabled, was the filter created on the key prefix.
 	PrefixFiltering bool `prop:"rocksdb.block.based.table.prefix.filtering"`
+	// A bitset of the kinds of the keys in this table, in which bit k is set
+	// if the table contains a point key, range deletion or range key of
+	// InternalKeyKind k. Only recorded if WriterOptions.RecordPresentKeyKinds
+	// is set, in TableFormatPebblev1 and later formats, and so zero if the
+	// table is empty, was written without the option, is in a RocksDB format
+	// or was written by a version of Pebble which did not record it. See
+	// HasKeyKind.
+	PresentKeyKinds uint64 `prop:"pebble.present-key-kinds"`
 	// A comma separated list of names of the property collectors used in this
 	// table.
 	PropertyCollectorNames string `prop:"rocksdb.property.collectors"`
@@ -152,6 +181,51 @@ type Properties struct {
 	Loaded map[uintptr]struct{}
 }
 
+// HasKeyKind returns true if the table contains a key of the given kind. The
+// result is only meaningful if PresentKeyKinds was recorded when the table was
+// written, which may be determined from Loaded for a non-empty table.
+func (p *Properties) HasKeyKind(kind InternalKeyKind) bool {
+	return p.PresentKeyKinds&(1<<kind) != 0
+}
+
+// applyTemplate seeds p, which holds the static properties computed by a
+// Writer, with those of the template t which the Writer does not compute. It
+// returns an error if a name the Writer computes is set in the template to a
+// different value. See WriterOptions.PropertiesTemplate.
+func (p *Properties) applyTemplate(t *Properties, filterPolicyName string) error {
+	if p.ComparerVersion == "" {
+		p.ComparerVersion = t.ComparerVersion
+	}
+	if p.MergerVersion == "" {
+		p.MergerVersion = t.MergerVersion
+	}
+	for _, n := range []struct {
+		prop, computed, template string
+	}{
+		{"comparer", p.ComparerName, t.ComparerName},
+		{"comparer version", p.ComparerVersion, t.ComparerVersion},
+		{"merger version", p.MergerVersion, t.MergerVersion},
+		{"merger", p.MergerName, t.MergerName},
+		{"compression", p.CompressionName, t.CompressionName},
+		{"filter policy", filterPolicyName, t.FilterPolicyName},
+		{"prefix extractor", p.PrefixExtractorName, t.PrefixExtractorName},
+		{"property collectors", p.PropertyCollectorNames, t.PropertyCollectorNames},
+	} {
+		if n.template != "" && n.template != n.computed {
+			return errors.Errorf("pebble: %s %q does not match properties template %q",
+				errors.Safe(n.prop), n.computed, n.template)
+		}
+	}
+	p.ColumnFamilyName = t.ColumnFamilyName
+	if len(t.UserProperties) > 0 {
+		p.UserProperties = make(map[string]string, len(t.UserProperties))
+		for k, v := range t.UserProperties {
+			p.UserProperties[k] = v
+		}
+	}
+	return nil
+}
+
 // NumPointDeletions returns the number of point deletions in this table.
 func (p *Properties) NumPointDeletions() uint64 {
 	return p.NumDeletions - p.NumRangeDeletions
@@ -296,6 +370,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 	if p.ComparerName != "" {
 		p.saveString(m, unsafe.Offsetof(p.ComparerName), p.ComparerName)
 	}
+	if p.ComparerVersion != "" {
+		p.saveString(m, unsafe.Offsetof(p.ComparerVersion), p.ComparerVersion)
+	}
 	if p.CompressionName != "" {
 		p.saveString(m, unsafe.Offsetof(p.CompressionName), p.CompressionName)
 	}
@@ -303,6 +380,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 		p.saveString(m, unsafe.Offsetof(p.CompressionOptions), p.CompressionOptions)
 	}
 	p.saveUvarint(m, unsafe.Offsetof(p.CreationTime), p.CreationTime)
+	if p.DataBlockHashName != "" {
+		p.saveString(m, unsafe.Offsetof(p.DataBlockHashName), p.DataBlockHashName)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.DataSize), p.DataSize)
 	if p.ExternalFormatVersion != 0 {
 		p.saveUint32(m, unsafe.Offsetof(p.ExternalFormatVersion), p.ExternalFormatVersion)
@@ -311,6 +391,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 	if p.FileCreationTime > 0 {
 		p.saveUvarint(m, unsafe.Offsetof(p.FileCreationTime), p.FileCreationTime)
 	}
+	if p.FilterKeyTransformName != "" {
+		p.saveString(m, unsafe.Offsetof(p.FilterKeyTransformName), p.FilterKeyTransformName)
+	}
 	if p.FilterPolicyName != "" {
 		p.saveString(m, unsafe.Offsetof(p.FilterPolicyName), p.FilterPolicyName)
 	}
@@ -328,8 +411,17 @@ func (p *Properties) save(w *rawBlockWriter) {
 	if p.MergerName != "" {
 		p.saveString(m, unsafe.Offsetof(p.MergerName), p.MergerName)
 	}
+	if p.MergerVersion != "" {
+		p.saveString(m, unsafe.Offsetof(p.MergerVersion), p.MergerVersion)
+	}
+	if p.NoPointBlocks {
+		p.saveBool(m, unsafe.Offsetof(p.NoPointBlocks), p.NoPointBlocks)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.NumDataBlocks), p.NumDataBlocks)
 	p.saveUvarint(m, unsafe.Offsetof(p.NumEntries), p.NumEntries)
+	if p.NumFilterPrefixes != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.NumFilterPrefixes), p.NumFilterPrefixes)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.NumDeletions), p.NumDeletions)
 	p.saveUvarint(m, unsafe.Offsetof(p.NumMergeOperands), p.NumMergeOperands)
 	p.saveUvarint(m, unsafe.Offsetof(p.NumRangeDeletions), p.NumRangeDeletions)
@@ -345,6 +437,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 		p.saveString(m, unsafe.Offsetof(p.PrefixExtractorName), p.PrefixExtractorName)
 	}
 	p.saveBool(m, unsafe.Offsetof(p.PrefixFiltering), p.PrefixFiltering)
+	if p.PresentKeyKinds != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.PresentKeyKinds), p.PresentKeyKinds)
+	}
 	if p.PropertyCollectorNames != "" {
 		p.saveString(m, unsafe.Offsetof(p.PropertyCollectorNames), p.PropertyCollectorNames)
 	}
@@ -15,6 +15,7 @@ import (
 	"testing/quick"
 	"time"
 
+	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/kr/pretty"
 	"github.com/stretchr/testify/require"
 )
@@ -64,11 +65,14 @@ func TestPropertiesSave(t *testing.T) {
 		ColumnFamilyID:           1,
 		ColumnFamilyName:         "column family name",
 		ComparerName:             "comparator name",
+		ComparerVersion:          "comparator version",
 		CompressionName:          "compression name",
 		CompressionOptions:       "compression option",
 		CreationTime:             2,
+		DataBlockHashName:        "data block hash name",
 		DataSize:                 3,
 		ExternalFormatVersion:    4,
+		FilterKeyTransformName:   "filter key transform name",
 		FilterPolicyName:         "filter policy name",
 		FilterSize:               5,
 		FixedKeyLen:              6,
@@ -80,21 +84,25 @@ func TestPropertiesSave(t *testing.T) {
 		IndexType:                12,
 		IndexValueIsDeltaEncoded: 13,
 		MergerName:               "merge operator name",
+		MergerVersion:            "merge operator version",
+		NoPointBlocks:            true,
 		NumDataBlocks:            14,
 		NumDeletions:             15,
 		NumEntries:               16,
-		NumMergeOperands:         17,
-		NumRangeDeletions:        18,
-		NumRangeKeyDels:          19,
-		NumRangeKeySets:          20,
-		NumRangeKeyUnsets:        21,
-		OldestKeyTime:            22,
+		NumFilterPrefixes:        17,
+		NumMergeOperands:         18,
+		NumRangeDeletions:        19,
+		NumRangeKeyDels:          20,
+		NumRangeKeySets:          21,
+		NumRangeKeyUnsets:        22,
+		OldestKeyTime:            23,
 		PrefixExtractorName:      "prefix extractor name",
 		PrefixFiltering:          true,
+		PresentKeyKinds:          24,
 		PropertyCollectorNames:   "prefix collector names",
-		RawKeySize:               23,
-		RawValueSize:             24,
-		TopLevelIndexSize:        25,
+		RawKeySize:               25,
+		RawValueSize:             26,
+		TopLevelIndexSize:        27,
 		WholeKeyFiltering:        true,
 		UserProperties: map[string]string{
 			"user-prop-a": "1",
@@ -127,3 +135,99 @@ func TestPropertiesSave(t *testing.T) {
 		check1(&props)
 	}
 }
+
+func TestPropertiesComparerMergerVersion(t *testing.T) {
+	f := &memFile{}
+	w := NewWriter(f, WriterOptions{ComparerVersion: "v2", MergerVersion: "v3"})
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.NoError(t, w.Close())
+
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, "v2", r.Properties.ComparerVersion)
+	require.Equal(t, "v3", r.Properties.MergerVersion)
+}
+
+type largePropertyCollector struct{}
+
+func (largePropertyCollector) Add(InternalKey, []byte) error { return nil }
+
+func (largePropertyCollector) Finish(userProps map[string]string) error {
+	userProps["test.large"] = strings.Repeat("large property ", 1000)
+	return nil
+}
+
+func (largePropertyCollector) Name() string { return "largePropertyCollector" }
+
+func TestPropertiesCompressed(t *testing.T) {
+	build := func(format TableFormat, compress bool) ([]byte, error) {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			Compression:        SnappyCompression,
+			CompressProperties: compress,
+			TableFormat:        format,
+			TablePropertyCollectors: []func() TablePropertyCollector{
+				func() TablePropertyCollector { return largePropertyCollector{} },
+			},
+		})
+		require.NoError(t, w.Set([]byte("a"), nil))
+		err := w.Close()
+		return f.Data(), err
+	}
+	propertiesLen := func(data []byte) uint64 {
+		r, err := NewMemReader(data, ReaderOptions{})
+		require.NoError(t, err)
+		defer r.Close()
+		require.Equal(t, strings.Repeat("large property ", 1000), r.Properties.UserProperties["test.large"])
+		require.NoError(t, r.ValidateBlockChecksums())
+		l, err := r.Layout()
+		require.NoError(t, err)
+		return l.Properties.Length
+	}
+
+	uncompressed, err := build(TableFormatPebblev1, false /* compress */)
+	require.NoError(t, err)
+	compressed, err := build(TableFormatPebblev1, true /* compress */)
+	require.NoError(t, err)
+	require.Less(t, propertiesLen(compressed), propertiesLen(uncompressed))
+
+	_, err = build(TableFormatRocksDBv2, true /* compress */)
+	require.Error(t, err)
+}
+
+func TestPropertiesPresentKeyKinds(t *testing.T) {
+	f := &memFile{}
+	w := NewWriter(f, WriterOptions{TableFormat: TableFormatPebblev2, RecordPresentKeyKinds: true})
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.NoError(t, w.Add(base.MakeInternalKey([]byte("b"), 0, base.InternalKeyKindSingleDelete), nil))
+	require.NoError(t, w.DeleteRange([]byte("c"), []byte("d")))
+	require.NoError(t, w.RangeKeySet([]byte("e"), []byte("f"), nil, nil))
+	require.NoError(t, w.Close())
+
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+	for _, kind := range []InternalKeyKind{
+		InternalKeyKindSet, base.InternalKeyKindSingleDelete,
+		InternalKeyKindRangeDelete, base.InternalKeyKindRangeKeySet,
+	} {
+		require.True(t, r.Properties.HasKeyKind(kind), "%s", kind)
+	}
+	for _, kind := range []InternalKeyKind{
+		InternalKeyKindDelete, InternalKeyKindMerge, base.InternalKeyKindSetWithDelete,
+		base.InternalKeyKindRangeKeyUnset, base.InternalKeyKindRangeKeyDelete,
+	} {
+		require.False(t, r.Properties.HasKeyKind(kind), "%s", kind)
+	}
+
+	// The property is not recorded by default.
+	f = &memFile{}
+	w = NewWriter(f, WriterOptions{TableFormat: TableFormatPebblev2})
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.NoError(t, w.Close())
+	r2, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	defer r2.Close()
+	require.Zero(t, r2.Properties.PresentKeyKinds)
+}
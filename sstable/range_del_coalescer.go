@@ -0,0 +1,106 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import "github.com/cockroachdb/pebble/internal/base"
+
+// rangeDelFragment is a fragment of the range deletion keyspace: the span
+// [start, end) and the trailers of the tombstones which cover it, in the order
+// in which they were added.
+type rangeDelFragment struct {
+	start, end []byte
+	trailers   []uint64
+}
+
+func (f *rangeDelFragment) empty() bool {
+	return len(f.trailers) == 0
+}
+
+// rangeDelCoalescer merges adjacent fragmented range tombstones, as enabled by
+// WriterOptions.CoalesceRangeDels. Two fragments are merged if the end key of
+// the first is the start key of the second, and the two are covered by
+// tombstones with identical sequence numbers and kinds. Since the merged
+// fragment is covered by exactly the same tombstones throughout, the
+// coalesced tombstones remain fragmented.
+//
+// The fragments must be added in the fragmented order required by
+// Writer.addTombstone.
+type rangeDelCoalescer struct {
+	cmp base.Compare
+	// pending is the span of one or more merged fragments, each of which has
+	// been completely added. It is extended if the next fragment abuts it and
+	// is covered by the same tombstones.
+	pending rangeDelFragment
+	// current is the fragment to which tombstones are being added.
+	current rangeDelFragment
+	// emit is called with each of the coalesced tombstones, in order.
+	emit func(key InternalKey, end []byte)
+}
+
+// add adds a tombstone, which must not precede those previously added.
+func (c *rangeDelCoalescer) add(key InternalKey, end []byte) {
+	if !c.current.empty() &&
+		(c.cmp(key.UserKey, c.current.start) != 0 || c.cmp(end, c.current.end) != 0) {
+		c.finishCurrent()
+	}
+	if c.current.empty() {
+		c.current.start = append(c.current.start[:0], key.UserKey...)
+		c.current.end = append(c.current.end[:0], end...)
+	}
+	c.current.trailers = append(c.current.trailers, key.Trailer)
+}
+
+// last returns the last tombstone added, if any.
+func (c *rangeDelCoalescer) last() (key InternalKey, end []byte, ok bool) {
+	if c.current.empty() {
+		return InternalKey{}, nil, false
+	}
+	key = InternalKey{
+		UserKey: c.current.start,
+		Trailer: c.current.trailers[len(c.current.trailers)-1],
+	}
+	return key, c.current.end, true
+}
+
+// finishCurrent merges the current fragment into the pending span if
+// possible, or else emits the pending span and replaces it with the current
+// fragment.
+func (c *rangeDelCoalescer) finishCurrent() {
+	if !c.pending.empty() && c.cmp(c.pending.end, c.current.start) == 0 &&
+		equalTrailers(c.pending.trailers, c.current.trailers) {
+		c.pending.end = append(c.pending.end[:0], c.current.end...)
+	} else {
+		c.emitPending()
+		c.pending, c.current = c.current, c.pending
+	}
+	c.current.trailers = c.current.trailers[:0]
+}
+
+func (c *rangeDelCoalescer) emitPending() {
+	for _, trailer := range c.pending.trailers {
+		c.emit(InternalKey{UserKey: c.pending.start, Trailer: trailer}, c.pending.end)
+	}
+	c.pending.trailers = c.pending.trailers[:0]
+}
+
+// finish emits all of the tombstones which have not yet been emitted.
+func (c *rangeDelCoalescer) finish() {
+	if !c.current.empty() {
+		c.finishCurrent()
+	}
+	c.emitPending()
+}
+
+func equalTrailers(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterCoalesceRangeDels(t *testing.T) {
+	type tombstone struct {
+		start, end string
+		seqNum     uint64
+	}
+	write := func(coalesce bool, tombstones []tombstone) (*Reader, *WriterMetadata) {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{CoalesceRangeDels: coalesce})
+		for _, ts := range tombstones {
+			key := base.MakeInternalKey([]byte(ts.start), ts.seqNum, InternalKeyKindRangeDelete)
+			require.NoError(t, w.Add(key, []byte(ts.end)))
+		}
+		require.NoError(t, w.Close())
+		meta, err := w.Metadata()
+		require.NoError(t, err)
+		r, err := NewMemReader(f.Data(), ReaderOptions{})
+		require.NoError(t, err)
+		return r, meta
+	}
+	read := func(r *Reader) []string {
+		iter, err := r.NewRawRangeDelIter()
+		require.NoError(t, err)
+		defer iter.Close()
+		var spans []string
+		for s := iter.First(); s != nil; s = iter.Next() {
+			spans = append(spans, s.String())
+		}
+		return spans
+	}
+
+	tombstones := []tombstone{
+		{"a", "b", 5},
+		{"b", "c", 5},
+		// The fragment [c,d) is covered by an additional tombstone, and so
+		// may not be merged with its neighbours.
+		{"c", "d", 5},
+		{"c", "d", 3},
+		{"d", "e", 5},
+		{"d", "e", 3},
+		{"e", "f", 5},
+		// The fragment [g,h) does not abut [e,f).
+		{"g", "h", 5},
+		{"h", "i", 5},
+		// The fragment [i,j) is covered by a tombstone with a different
+		// sequence number.
+		{"i", "j", 4},
+	}
+	r, meta := write(true, tombstones)
+	defer r.Close()
+	require.Equal(t, []string{
+		"a-c:{(#5,RANGEDEL)}",
+		"c-e:{(#5,RANGEDEL) (#3,RANGEDEL)}",
+		"e-f:{(#5,RANGEDEL)}",
+		"g-i:{(#5,RANGEDEL)}",
+		"i-j:{(#4,RANGEDEL)}",
+	}, read(r))
+	require.EqualValues(t, 6, r.Properties.NumRangeDeletions)
+	require.Equal(t, base.MakeInternalKey([]byte("a"), 5, InternalKeyKindRangeDelete), meta.SmallestRangeDel)
+	require.Equal(t, base.MakeRangeDeleteSentinelKey([]byte("j")), meta.LargestRangeDel)
+	require.EqualValues(t, 5, meta.LargestSeqNum)
+	require.EqualValues(t, 3, meta.SmallestSeqNum)
+
+	// The validation of the order of tombstones applies to the tombstones
+	// added, rather than those written.
+	w := NewWriter(&memFile{}, WriterOptions{CoalesceRangeDels: true})
+	require.NoError(t, w.DeleteRange([]byte("a"), []byte("b")))
+	require.NoError(t, w.DeleteRange([]byte("b"), []byte("c")))
+	require.EqualError(t, w.DeleteRange([]byte("b"), []byte("d")),
+		"pebble: overlapping tombstones must be fragmented: b-c:{(#0,RANGEDEL)} vs b-d:{(#0,RANGEDEL)}")
+	require.Error(t, w.Close())
+
+	// A TTL expiry workload deletes many contiguous spans, written with the
+	// same sequence number.
+	tombstones = tombstones[:0]
+	for i := 0; i < 1000; i++ {
+		tombstones = append(tombstones, tombstone{
+			start:  fmt.Sprintf("ttl/%08d", i),
+			end:    fmt.Sprintf("ttl/%08d", i+1),
+			seqNum: uint64(10 + i/100),
+		})
+	}
+	coalesced, _ := write(true, tombstones)
+	defer coalesced.Close()
+	uncoalesced, _ := write(false, tombstones)
+	defer uncoalesced.Close()
+	require.Len(t, read(coalesced), 10)
+	require.Len(t, read(uncoalesced), 1000)
+	coalescedLayout, err := coalesced.Layout()
+	require.NoError(t, err)
+	uncoalescedLayout, err := uncoalesced.Layout()
+	require.NoError(t, err)
+	require.Less(t, coalescedLayout.RangeDel.Length*50, uncoalescedLayout.RangeDel.Length)
+}
@@ -29,6 +29,39 @@ func (w *rawBlockWriter) add(key InternalKey, value []byte) {
 	w.store(size, value)
 }
 
+// metaindexEntry is an entry of the metaindex block: the name of a meta block
+// and its encoded block handle.
+type metaindexEntry struct {
+	name  string
+	value []byte
+}
+
+// metaindexBuilder accumulates the entries of the metaindex block, which may
+// be added in any order.
+type metaindexBuilder struct {
+	entries []metaindexEntry
+}
+
+func (b *metaindexBuilder) add(key InternalKey, value []byte) {
+	b.entries = append(b.entries, metaindexEntry{
+		name:  string(key.UserKey),
+		value: append([]byte(nil), value...),
+	})
+}
+
+// finish returns the metaindex block holding the added entries and the
+// additional entries, which must have distinct names, sorted by name.
+func (b *metaindexBuilder) finish(additional []metaindexEntry) []byte {
+	entries := append(b.entries, additional...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	var w rawBlockWriter
+	w.restartInterval = 1
+	for i := range entries {
+		w.add(InternalKey{UserKey: []byte(entries[i].name)}, entries[i].value)
+	}
+	return w.blockWriter.finish()
+}
+
 // rawBlockIter is an iterator over a single block of data. Unlike blockIter,
 // keys are stored in "raw" format (i.e. not as internal keys). Note that there
 // is significant similarity between this code and the code in blockIter. Yet
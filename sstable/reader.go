@@ -223,6 +223,9 @@ type singleLevelIterator struct {
 	// is high).
 	useFilter              bool
 	lastBloomFilterMatched bool
+	// filterKeyBuf is the scratch buffer used to transform keys before
+	// querying a filter whose keys were transformed. See FilterKeyTransform.
+	filterKeyBuf []byte
 }
 
 // singleLevelIterator implements the base.InternalIterator interface.
@@ -304,9 +307,12 @@ func (i *singleLevelIterator) init(
 	if r.err != nil {
 		return r.err
 	}
-	indexH, err := r.readIndex(stats)
-	if err != nil {
-		return err
+	var indexH cache.Handle
+	if !r.Properties.NoPointBlocks {
+		var err error
+		if indexH, err = r.readIndex(stats); err != nil {
+			return err
+		}
 	}
 
 	i.lower = lower
@@ -316,7 +322,13 @@ func (i *singleLevelIterator) init(
 	i.reader = r
 	i.cmp = r.Compare
 	i.stats = stats
-	err = i.index.initHandle(i.cmp, indexH, r.Properties.GlobalSeqNum)
+	var err error
+	if r.Properties.NoPointBlocks {
+		// The table has no index block, so iterate over an empty one.
+		err = i.index.init(i.cmp, emptyIndexBlock, r.Properties.GlobalSeqNum)
+	} else {
+		err = i.index.initHandle(i.cmp, indexH, r.Properties.GlobalSeqNum)
+	}
 	if err != nil {
 		// blockIter.Close releases indexH and always returns a nil error
 		_ = i.index.Close()
@@ -762,7 +774,7 @@ func (i *singleLevelIterator) seekPrefixGE(
 			i.data.invalidate()
 			return nil, nil
 		}
-		mayContain := i.reader.tableFilter.mayContain(dataH.Get(), prefix)
+		mayContain := i.reader.tableFilter.mayContain(dataH.Get(), prefix, &i.filterKeyBuf)
 		dataH.Release()
 		if !mayContain {
 			// This invalidation may not be necessary for correctness, and may
@@ -1599,7 +1611,7 @@ func (i *twoLevelIterator) SeekPrefixGE(
 			i.data.invalidate()
 			return nil, nil
 		}
-		mayContain := i.reader.tableFilter.mayContain(dataH.Get(), prefix)
+		mayContain := i.reader.tableFilter.mayContain(dataH.Get(), prefix, &i.filterKeyBuf)
 		dataH.Release()
 		if !mayContain {
 			// This invalidation may not be necessary for correctness, and may
@@ -2394,6 +2406,8 @@ type Reader struct {
 	propertiesBH      BlockHandle
 	metaIndexBH       BlockHandle
 	footerBH          BlockHandle
+	inlineIndex       []byte
+	sideBlocks        map[string]BlockHandle
 	opts              ReaderOptions
 	Compare           Compare
 	FormatKey         base.FormatKey
@@ -2527,6 +2541,133 @@ func (r *Reader) NewRawRangeKeyIter() (keyspan.FragmentIterator, error) {
 	return i, nil
 }
 
+// DataBlockHashes returns the hashes of the uncompressed contents of the
+// table's data blocks, keyed by the offset of each block, as recorded by a
+// Writer with WriterOptions.DataBlockHash set. The name of the hash is
+// Properties.DataBlockHashName. Returns nil if the table does not record
+// data block hashes.
+func (r *Reader) DataBlockHashes() (map[uint64][]byte, error) {
+	var hashes map[uint64][]byte
+	err := r.readSideBlock(metaBlockHashesName, func(key, value []byte) error {
+		if len(key) != 8 {
+			return base.CorruptionErrorf("pebble/table: invalid data block hash offset")
+		}
+		if hashes == nil {
+			hashes = make(map[uint64][]byte)
+		}
+		hashes[binary.BigEndian.Uint64(key)] = append([]byte(nil), value...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// DataBlockFirstByteRanges returns the smallest and largest first byte of the
+// user keys of each of the table's data blocks, keyed by the offset of the
+// block, as recorded by a Writer with WriterOptions.DataBlockFirstByteRanges
+// set. A block whose user keys are all empty has no entry. Returns nil if the
+// table does not record first byte ranges.
+func (r *Reader) DataBlockFirstByteRanges() (map[uint64][2]byte, error) {
+	var ranges map[uint64][2]byte
+	err := r.readSideBlock(metaFirstBytesName, func(key, value []byte) error {
+		if len(key) != 8 || len(value) != 2 {
+			return base.CorruptionErrorf("pebble/table: invalid data block first byte range")
+		}
+		if ranges == nil {
+			ranges = make(map[uint64][2]byte)
+		}
+		ranges[binary.BigEndian.Uint64(key)] = [2]byte{value[0], value[1]}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+// readSideBlock reads the optional meta block with the given name, and calls
+// fn with the key and value of each of its entries, in order. The key and
+// value passed to fn are only valid for the duration of the call. It is a
+// no-op if the table does not have the block. The handles of the optional
+// blocks are held in r.sideBlocks, which is only allocated if the table has
+// at least one of them.
+func (r *Reader) readSideBlock(name string, fn func(key, value []byte) error) error {
+	if r.err != nil {
+		return r.err
+	}
+	bh, ok := r.sideBlocks[name]
+	if !ok {
+		return nil
+	}
+	b, err := r.readBlock(bh, nil /* transform */, nil /* readaheadState */, nil /* stats */)
+	if err != nil {
+		return err
+	}
+	defer b.Release()
+	i, err := newRawBlockIter(bytes.Compare, b.Get())
+	if err != nil {
+		return err
+	}
+	for valid := i.First(); valid; valid = i.Next() {
+		if err := fn(i.Key().UserKey, i.Value()); err != nil {
+			_ = i.Close()
+			return err
+		}
+	}
+	return i.Close()
+}
+
+// PinnedBlockOffsets returns the offsets, in increasing order, of the data
+// blocks marked through Writer.MarkNextBlockPinned as hints that they should be
+// kept in the block cache. Returns nil if the table has no pinned blocks.
+func (r *Reader) PinnedBlockOffsets() ([]uint64, error) {
+	var offsets []uint64
+	err := r.readSideBlock(metaPinnedName, func(key, _ []byte) error {
+		if len(key) != 8 {
+			return base.CorruptionErrorf("pebble/table: invalid pinned block offset")
+		}
+		offsets = append(offsets, binary.BigEndian.Uint64(key))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
+
+// KeyExpiry is the expiration time of a point key, as recorded by
+// Writer.AddWithExpiry.
+type KeyExpiry struct {
+	Key InternalKey
+	// ExpiryUnix is the time in seconds since the Unix epoch at which the key
+	// expires.
+	ExpiryUnix uint64
+}
+
+// Expiries returns the expiration times of the table's point keys, in key
+// order, as recorded by Writer.AddWithExpiry. Keys added without an
+// expiration are omitted. Returns nil if the table does not record any
+// expirations.
+func (r *Reader) Expiries() ([]KeyExpiry, error) {
+	var expiries []KeyExpiry
+	err := r.readSideBlock(metaExpiriesName, func(k, value []byte) error {
+		key := base.DecodeInternalKey(k)
+		expiry, n := binary.Uvarint(value)
+		if !key.Valid() || n <= 0 {
+			return base.CorruptionErrorf("pebble/table: invalid key expiry")
+		}
+		key.UserKey = append([]byte(nil), key.UserKey...)
+		expiries = append(expiries, KeyExpiry{Key: key, ExpiryUnix: expiry})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expiries, nil
+}
+
 type rangeKeyFragmentBlockIter struct {
 	fragmentBlockIter
 }
@@ -2538,10 +2679,59 @@ func (i *rangeKeyFragmentBlockIter) Close() error {
 	return err
 }
 
+// FilterMayContain consults the table's filter, returning false if the table
+// is guaranteed not to contain a point key matching key. If exact is true, key
+// is a complete user key and is matched exactly when the table's filter was
+// built on whole keys (see WriterOptions.FilterWholeKeys), falling back to
+// matching its prefix otherwise. If exact is false, key is a prefix as
+// returned by the Comparer's Split function. FilterMayContain returns true if
+// the table has no filter, or if the filter cannot answer the query.
+func (r *Reader) FilterMayContain(key []byte, exact bool) (bool, error) {
+	if r.tableFilter == nil {
+		return true, nil
+	}
+	switch {
+	case exact && r.Properties.WholeKeyFiltering:
+	case exact && r.Properties.PrefixFiltering && r.Split != nil:
+		key = key[:r.Split(key)]
+	case !exact && r.Properties.PrefixFiltering:
+	default:
+		return true, nil
+	}
+	dataH, err := r.readFilter(nil /* stats */)
+	if err != nil {
+		return false, err
+	}
+	defer dataH.Release()
+	return r.tableFilter.mayContain(dataH.Get(), key, nil /* scratch */), nil
+}
+
+// emptyIndexBlock is used in place of the index block of a table written
+// without one. See Properties.NoPointBlocks.
+var emptyIndexBlock = func() block {
+	w := blockWriter{restartInterval: 1}
+	return w.finish()
+}()
+
 func (r *Reader) readIndex(stats *base.InternalIteratorStats) (cache.Handle, error) {
+	if r.inlineIndex != nil {
+		return r.readInlineIndex(), nil
+	}
 	return r.readBlock(r.indexBH, nil /* transform */, nil /* readaheadState */, stats)
 }
 
+// readInlineIndex returns the index block held inline in the table's compact
+// footer. The block is cached under its offset within the footer, which is
+// not the offset of any other block.
+func (r *Reader) readInlineIndex() cache.Handle {
+	if h := r.opts.Cache.Get(r.cacheID, r.fileNum, r.indexBH.Offset); h.Get() != nil {
+		return h
+	}
+	v := r.opts.Cache.Alloc(len(r.inlineIndex))
+	copy(v.Buf(), r.inlineIndex)
+	return r.opts.Cache.Set(r.cacheID, r.fileNum, r.indexBH.Offset, v)
+}
+
 func (r *Reader) readFilter(stats *base.InternalIteratorStats) (cache.Handle, error) {
 	return r.readBlock(r.filterBH, nil /* transform */, nil /* readaheadState */, stats)
 }
@@ -2736,7 +2926,12 @@ func (r *Reader) readMetaindex(metaindexBH BlockHandle) error {
 		return base.CorruptionErrorf("pebble/table: unexpected metaindex block size: %d vs %d",
 			errors.Safe(len(data)), errors.Safe(metaindexBH.Length))
 	}
+	return r.loadMetaindex(data)
+}
 
+// loadMetaindex loads the meta blocks referenced by the metaindex block
+// contents data.
+func (r *Reader) loadMetaindex(data []byte) error {
 	i, err := newRawBlockIter(bytes.Compare, data)
 	if err != nil {
 		return err
@@ -2755,12 +2950,12 @@ func (r *Reader) readMetaindex(metaindexBH BlockHandle) error {
 	}
 
 	if bh, ok := meta[metaPropertiesName]; ok {
-		b, err = r.readBlock(bh, nil /* transform */, nil /* readaheadState */, nil /* stats */)
+		b, err := r.readBlock(bh, nil /* transform */, nil /* readaheadState */, nil /* stats */)
 		if err != nil {
 			return err
 		}
 		r.propertiesBH = bh
-		err := r.Properties.load(b.Get(), bh.Offset)
+		err = r.Properties.load(b.Get(), bh.Offset)
 		b.Release()
 		if err != nil {
 			return err
@@ -2780,6 +2975,17 @@ func (r *Reader) readMetaindex(metaindexBH BlockHandle) error {
 		r.rangeKeyBH = bh
 	}
 
+	for _, name := range []string{
+		metaBlockHashesName, metaExpiriesName, metaFirstBytesName, metaPinnedName,
+	} {
+		if bh, ok := meta[name]; ok {
+			if r.sideBlocks == nil {
+				r.sideBlocks = make(map[string]BlockHandle)
+			}
+			r.sideBlocks[name] = bh
+		}
+	}
+
 	for name, fp := range r.opts.Filters {
 		types := []struct {
 			ftype  FilterType
@@ -2794,7 +3000,16 @@ func (r *Reader) readMetaindex(metaindexBH BlockHandle) error {
 
 				switch t.ftype {
 				case TableFilter:
+					var transform *FilterKeyTransform
+					if name := r.Properties.FilterKeyTransformName; name != "" {
+						// The filter holds transformed keys, and can only be
+						// queried using the same transform.
+						if transform = r.opts.FilterKeyTransform; transform == nil || transform.Name != name {
+							return nil
+						}
+					}
 					r.tableFilter = newTableFilterReader(fp)
+					r.tableFilter.transform = transform
 				default:
 					return base.CorruptionErrorf("unknown filter type: %v", errors.Safe(t.ftype))
 				}
@@ -2822,9 +3037,17 @@ func (r *Reader) Layout() (*Layout, error) {
 		RangeDel:   r.rangeDelBH,
 		RangeKey:   r.rangeKeyBH,
 		Properties: r.propertiesBH,
-		MetaIndex:  r.metaIndexBH,
 		Footer:     r.footerBH,
 	}
+	if r.inlineIndex != nil {
+		// The metaindex and index blocks are held inline in the footer.
+		l.CompactFooter = true
+	} else {
+		l.MetaIndex = r.metaIndexBH
+	}
+	if r.Properties.NoPointBlocks {
+		return l, nil
+	}
 
 	indexH, err := r.readIndex(nil /* stats */)
 	if err != nil {
@@ -2835,7 +3058,9 @@ func (r *Reader) Layout() (*Layout, error) {
 	var alloc []byte
 
 	if r.Properties.IndexPartitions == 0 {
-		l.Index = append(l.Index, r.indexBH)
+		if !l.CompactFooter {
+			l.Index = append(l.Index, r.indexBH)
+		}
 		iter, _ := newBlockIter(r.Compare, indexH.Get())
 		for key, value := iter.First(); key != nil; key, value = iter.Next() {
 			dataBH, err := decodeBlockHandleWithProperties(value)
@@ -2854,6 +3079,10 @@ func (r *Reader) Layout() (*Layout, error) {
 		}
 	} else {
 		l.TopIndex = r.indexBH
+		dataSizeID, hasDataSizes := r.Properties.UserProperties[IndexPartitionDataSizePropertyName]
+		if hasDataSizes && len(dataSizeID) != 1 {
+			return nil, base.CorruptionErrorf("pebble: invalid %s property", IndexPartitionDataSizePropertyName)
+		}
 		topIter, _ := newBlockIter(r.Compare, indexH.Get())
 		iter := &blockIter{}
 		for key, value := topIter.First(); key != nil; key, value = topIter.Next() {
@@ -2862,6 +3091,13 @@ func (r *Reader) Layout() (*Layout, error) {
 				return nil, errCorruptIndexEntry
 			}
 			l.Index = append(l.Index, indexBH.BlockHandle)
+			if hasDataSizes {
+				size, err := decodePartitionDataSize(indexBH.Props, shortID(dataSizeID[0]))
+				if err != nil {
+					return nil, err
+				}
+				l.IndexDataSizes = append(l.IndexDataSizes, size)
+			}
 
 			subIndex, err := r.readBlock(
 				indexBH.BlockHandle, nil /* transform */, nil /* readaheadState */, nil /* stats */)
@@ -2958,6 +3194,9 @@ func (r *Reader) EstimateDiskUsage(start, end []byte) (uint64, error) {
 	if r.err != nil {
 		return 0, r.err
 	}
+	if r.Properties.NoPointBlocks {
+		return 0, nil
+	}
 
 	indexH, err := r.readIndex(nil /* stats */)
 	if err != nil {
@@ -3111,7 +3350,13 @@ func NewReader(f ReadableFile, o ReaderOptions, extraOpts ...ReaderOption) (*Rea
 	r.checksumType = footer.checksum
 	r.tableFormat = footer.format
 	// Read the metaindex.
-	if err := r.readMetaindex(footer.metaindexBH); err != nil {
+	if footer.compact {
+		err = r.loadMetaindex(footer.inlineMetaindex)
+		r.inlineIndex = footer.inlineIndex
+	} else {
+		err = r.readMetaindex(footer.metaindexBH)
+	}
+	if err != nil {
 		r.err = err
 		return nil, r.Close()
 	}
@@ -3168,6 +3413,18 @@ type Layout struct {
 	Properties BlockHandle
 	MetaIndex  BlockHandle
 	Footer     BlockHandle
+
+	// IndexDataSizes holds, for each of the index partitions in Index, the
+	// total size of the data blocks it indexes, including their trailers. It
+	// is nil unless the table was written with a two-level index and
+	// WriterOptions.IndexPartitionDataSizes.
+	IndexDataSizes []uint64
+
+	// CompactFooter is set if the table ends with a compact footer, which
+	// holds the metaindex and index blocks inline. Index and MetaIndex are
+	// then empty. The compact footer's checksum is verified when the table is
+	// opened.
+	CompactFooter bool
 }
 
 // Describe returns a description of the layout. If the verbose parameter is
@@ -3206,7 +3463,9 @@ func (l *Layout) Describe(
 		blocks = append(blocks, block{l.MetaIndex, "meta-index"})
 	}
 	if l.Footer.Length != 0 {
-		if l.Footer.Length == levelDBFooterLen {
+		if l.CompactFooter {
+			blocks = append(blocks, block{l.Footer, "compact-footer"})
+		} else if l.Footer.Length == levelDBFooterLen {
 			blocks = append(blocks, block{l.Footer, "leveldb-footer"})
 		} else {
 			blocks = append(blocks, block{l.Footer, "footer"})
@@ -3228,6 +3487,19 @@ func (l *Layout) Describe(
 			continue
 		}
 
+		if b.name == "compact-footer" {
+			trailer, offset := make([]byte, compactFooterTrailerLen), b.Offset+b.Length-compactFooterTrailerLen
+			_, _ = r.file.ReadAt(trailer, int64(offset))
+			metaLen := binary.LittleEndian.Uint32(trailer[0:])
+			indexLen := binary.LittleEndian.Uint32(trailer[4:])
+			fmt.Fprintf(w, "%10d    meta-index (%d)\n", b.Offset, metaLen)
+			fmt.Fprintf(w, "%10d    index (%d)\n", b.Offset+uint64(metaLen), indexLen)
+			fmt.Fprintf(w, "%10d    checksum type: %s\n", offset+8, ChecksumType(trailer[8]))
+			fmt.Fprintf(w, "%10d    version: %d\n", offset+13, binary.LittleEndian.Uint32(trailer[13:]))
+			fmt.Fprintf(w, "%10d    magic number: 0x%x\n", offset+17, trailer[17:])
+			continue
+		}
+
 		if b.name == "footer" || b.name == "leveldb-footer" {
 			trailer, offset := make([]byte, b.Length), b.Offset
 			_, _ = r.file.ReadAt(trailer, int64(offset))
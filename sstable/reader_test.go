@@ -47,7 +47,7 @@ func (r *Reader) get(key []byte) (value []byte, err error) {
 		} else {
 			lookupKey = key
 		}
-		mayContain := r.tableFilter.mayContain(dataH.Get(), lookupKey)
+		mayContain := r.tableFilter.mayContain(dataH.Get(), lookupKey, nil /* scratch */)
 		dataH.Release()
 		if !mayContain {
 			return nil, base.ErrNotFound
@@ -1017,6 +1017,16 @@ var basicBenchmarks = []struct {
 			Compression:          ZstdCompression,
 		},
 	},
+	{
+		name: "restart=16,adaptive,compression=Snappy",
+		options: WriterOptions{
+			BlockSize:               32 << 10,
+			BlockRestartInterval:    16,
+			AdaptiveRestartInterval: true,
+			FilterPolicy:            nil,
+			Compression:             SnappyCompression,
+		},
+	},
 }
 
 func BenchmarkTableIterSeekGE(b *testing.B) {
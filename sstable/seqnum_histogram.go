@@ -0,0 +1,92 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
+)
+
+// SeqNumHistogramPropertyName is the name of the user property in which the
+// Writer records the histogram of the sequence numbers of a table's point
+// keys, as enabled by WriterOptions.SeqNumHistogram. The property may be
+// decoded with DecodeSeqNumHistogram.
+const SeqNumHistogramPropertyName = "pebble.seqnum-histogram"
+
+// seqNumHistogram tallies the number of point keys whose sequence numbers fall
+// in each of the ranges delimited by bounds: [0, bounds[0]),
+// [bounds[0], bounds[1]), ..., [bounds[len(bounds)-1], ∞).
+type seqNumHistogram struct {
+	bounds []uint64
+	counts []uint64
+}
+
+func newSeqNumHistogram(bounds []uint64) (*seqNumHistogram, error) {
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i-1] >= bounds[i] {
+			return nil, errors.Newf("pebble: SeqNumHistogram bounds must be strictly increasing: %d, %d",
+				bounds[i-1], bounds[i])
+		}
+	}
+	return &seqNumHistogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}, nil
+}
+
+func (h *seqNumHistogram) addPoint(seqNum uint64) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return seqNum < h.bounds[i] })
+	h.counts[i]++
+}
+
+// finish records the histogram, encoded as a sequence of (lower bound, count)
+// uvarint pairs for each non-empty bucket, in increasing order of lower bound.
+func (h *seqNumHistogram) finish(userProps map[string]string) {
+	buf := make([]byte, 0, len(h.counts)*2*binary.MaxVarintLen64)
+	var tmp [binary.MaxVarintLen64]byte
+	for i, count := range h.counts {
+		if count == 0 {
+			continue
+		}
+		var lower uint64
+		if i > 0 {
+			lower = h.bounds[i-1]
+		}
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], lower)]...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], count)]...)
+	}
+	if len(buf) > 0 {
+		userProps[SeqNumHistogramPropertyName] = string(buf)
+	}
+}
+
+// DecodeSeqNumHistogram decodes the histogram recorded in the
+// SeqNumHistogramPropertyName user property, returning the number of point
+// keys in each non-empty bucket, keyed by the bucket's lower bound: 0, or one
+// of the bounds passed in WriterOptions.SeqNumHistogram.
+func DecodeSeqNumHistogram(prop string) (map[uint64]uint64, error) {
+	m := make(map[uint64]uint64)
+	b := []byte(prop)
+	for len(b) > 0 {
+		lower, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, base.CorruptionErrorf("pebble: invalid seqnum histogram bound")
+		}
+		b = b[n:]
+		count, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, base.CorruptionErrorf("pebble: invalid seqnum histogram count")
+		}
+		b = b[n:]
+		if _, ok := m[lower]; ok {
+			return nil, errors.Newf("pebble: duplicate seqnum histogram bound %d", lower)
+		}
+		m[lower] = count
+	}
+	return m, nil
+}
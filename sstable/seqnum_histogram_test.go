@@ -0,0 +1,41 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterSeqNumHistogram(t *testing.T) {
+	f := &memFile{}
+	w := NewWriter(f, WriterOptions{SeqNumHistogram: []uint64{10, 100, 1000}})
+	for i := 0; i < 50; i++ {
+		// Sequence numbers 1, 21, 41, ..., 981.
+		key := base.MakeInternalKey([]byte(fmt.Sprintf("%08d", i)), uint64(1+20*i), InternalKeyKindSet)
+		require.NoError(t, w.Add(key, nil))
+	}
+	// Range deletions are not counted.
+	require.NoError(t, w.Add(base.MakeInternalKey([]byte("a"), 5, InternalKeyKindRangeDelete), []byte("b")))
+	require.NoError(t, w.Close())
+
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+	h, err := DecodeSeqNumHistogram(r.Properties.UserProperties[SeqNumHistogramPropertyName])
+	require.NoError(t, err)
+	// The bucket [1000, ∞) is empty, and so is omitted.
+	require.Equal(t, map[uint64]uint64{0: 1, 10: 4, 100: 45}, h)
+
+	// The bounds must be strictly increasing.
+	w = NewWriter(&memFile{}, WriterOptions{SeqNumHistogram: []uint64{10, 10}})
+	require.EqualError(t, w.Close(), "pebble: SeqNumHistogram bounds must be strictly increasing: 10, 10")
+
+	_, err = DecodeSeqNumHistogram("\x01")
+	require.Error(t, err)
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sort"
+
+	"github.com/cockroachdb/pebble/internal/base"
+)
+
+// SizeDistributionPropertyName is the name of the user property in which the
+// Writer records the distribution of the sizes of a table's point keys and
+// values, as enabled by WriterOptions.SizeDistribution. The property may be
+// decoded with DecodeSizeDistribution.
+const SizeDistributionPropertyName = "pebble.size-distribution"
+
+// sizeDistributionSamples is the number of key and value sizes retained by the
+// reservoir from which a table's size percentiles are estimated.
+const sizeDistributionSamples = 1024
+
+// SizePercentiles holds estimated percentiles of a distribution of sizes.
+type SizePercentiles struct {
+	P50, P90, P99 uint64
+}
+
+// SizeDistribution describes the sizes of the point keys and values of a
+// table. The percentiles are estimated from a uniform sample of the table's
+// point keys.
+type SizeDistribution struct {
+	// Count is the number of point keys in the table.
+	Count uint64
+	// KeySize holds the percentiles of the lengths of the user keys.
+	KeySize SizePercentiles
+	// ValueSize holds the percentiles of the lengths of the values.
+	ValueSize SizePercentiles
+}
+
+// sizeDistribution reservoir samples the key and value lengths of the point
+// keys added to a table, so that its memory usage is bounded regardless of
+// the number of keys.
+type sizeDistribution struct {
+	count      uint64
+	keySizes   []uint32
+	valueSizes []uint32
+	// rng is seeded with a constant so that the sample, and hence the table,
+	// is a deterministic function of the keys added.
+	rng *rand.Rand
+}
+
+func newSizeDistribution() *sizeDistribution {
+	return &sizeDistribution{rng: rand.New(rand.NewSource(1))}
+}
+
+func (d *sizeDistribution) addPoint(keyLen, valueLen int) {
+	d.count++
+	if len(d.keySizes) < sizeDistributionSamples {
+		d.keySizes = append(d.keySizes, uint32(keyLen))
+		d.valueSizes = append(d.valueSizes, uint32(valueLen))
+		return
+	}
+	if i := d.rng.Int63n(int64(d.count)); i < sizeDistributionSamples {
+		d.keySizes[i] = uint32(keyLen)
+		d.valueSizes[i] = uint32(valueLen)
+	}
+}
+
+func (d *sizeDistribution) finish(userProps map[string]string) {
+	if d.count == 0 {
+		return
+	}
+	dist := SizeDistribution{
+		Count:     d.count,
+		KeySize:   samplePercentiles(d.keySizes),
+		ValueSize: samplePercentiles(d.valueSizes),
+	}
+	userProps[SizeDistributionPropertyName] = dist.encode()
+}
+
+// samplePercentiles sorts samples, which must not be empty, and returns its
+// percentiles.
+func samplePercentiles(samples []uint32) SizePercentiles {
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	at := func(p int) uint64 {
+		return uint64(samples[(len(samples)-1)*p/100])
+	}
+	return SizePercentiles{P50: at(50), P90: at(90), P99: at(99)}
+}
+
+// encode encodes the distribution as a sequence of uvarints: the count,
+// followed by the p50, p90 and p99 key sizes, and then value sizes.
+func (d SizeDistribution) encode() string {
+	buf := make([]byte, 7*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, d.Count)
+	for _, p := range []SizePercentiles{d.KeySize, d.ValueSize} {
+		n += binary.PutUvarint(buf[n:], p.P50)
+		n += binary.PutUvarint(buf[n:], p.P90)
+		n += binary.PutUvarint(buf[n:], p.P99)
+	}
+	return string(buf[:n])
+}
+
+// DecodeSizeDistribution decodes the distribution of key and value sizes
+// recorded in the SizeDistributionPropertyName user property.
+func DecodeSizeDistribution(prop string) (SizeDistribution, error) {
+	var vals [7]uint64
+	b := []byte(prop)
+	for i := range vals {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return SizeDistribution{}, base.CorruptionErrorf("pebble: invalid size distribution")
+		}
+		vals[i] = v
+		b = b[n:]
+	}
+	if len(b) > 0 {
+		return SizeDistribution{}, base.CorruptionErrorf("pebble: invalid size distribution")
+	}
+	return SizeDistribution{
+		Count:     vals[0],
+		KeySize:   SizePercentiles{P50: vals[1], P90: vals[2], P99: vals[3]},
+		ValueSize: SizePercentiles{P50: vals[4], P90: vals[5], P99: vals[6]},
+	}, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterSizeDistribution(t *testing.T) {
+	write := func(n int) []byte {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{SizeDistribution: true})
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("%08d", i))
+			require.NoError(t, w.Set(key, bytes.Repeat([]byte("v"), i%100)))
+		}
+		require.NoError(t, w.Close())
+		return f.Data()
+	}
+	read := func(data []byte) SizeDistribution {
+		r, err := NewMemReader(data, ReaderOptions{})
+		require.NoError(t, err)
+		defer r.Close()
+		d, err := DecodeSizeDistribution(r.Properties.UserProperties[SizeDistributionPropertyName])
+		require.NoError(t, err)
+		return d
+	}
+
+	// With fewer keys than are sampled, the percentiles are exact.
+	require.Equal(t, SizeDistribution{
+		Count:     200,
+		KeySize:   SizePercentiles{P50: 8, P90: 8, P99: 8},
+		ValueSize: SizePercentiles{P50: 49, P90: 89, P99: 98},
+	}, read(write(200)))
+
+	// Otherwise they are estimated from a sample, which is deterministic.
+	data := write(100000)
+	require.Equal(t, data, write(100000))
+	d := read(data)
+	require.EqualValues(t, 100000, d.Count)
+	require.Equal(t, SizePercentiles{P50: 8, P90: 8, P99: 8}, d.KeySize)
+	require.InDelta(t, 50, d.ValueSize.P50, 5)
+	require.InDelta(t, 90, d.ValueSize.P90, 5)
+	require.InDelta(t, 99, d.ValueSize.P99, 2)
+
+	// No property is recorded for a table without point keys.
+	r, err := NewMemReader(write(0), ReaderOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, r.Properties.UserProperties, SizeDistributionPropertyName)
+	require.NoError(t, r.Close())
+
+	_, err = DecodeSizeDistribution("\x01\x02")
+	require.Error(t, err)
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
+)
+
+// SplittingWriter writes a single sorted stream of keys into two tables,
+// switching from the first to the second at a split key. Point keys less than
+// the split key are added to the first Writer, and the remaining point keys to
+// the second. Range deletions and range keys that span the split key are
+// truncated at it, with the part below the split key added to the first
+// Writer and the rest to the second.
+//
+// The first Writer is closed as soon as a point key, range deletion or range
+// key starting at or above the split key is added, after which adding a key
+// below the split key is an error. The keys must otherwise be added subject to
+// the same ordering requirements as the Writer.
+type SplittingWriter struct {
+	first, second *Writer
+	splitKey      []byte
+	// firstClosed is set once the first Writer has been closed.
+	firstClosed bool
+	// err is the first error encountered, and is returned by all subsequent
+	// calls.
+	err error
+}
+
+// NewSplittingWriter returns a SplittingWriter which adds keys less than
+// splitKey to first, and the rest to second. Both Writers must use the same
+// Comparer. Closing the SplittingWriter closes both Writers.
+func NewSplittingWriter(splitKey []byte, first, second *Writer) *SplittingWriter {
+	return &SplittingWriter{
+		first:    first,
+		second:   second,
+		splitKey: append([]byte(nil), splitKey...),
+	}
+}
+
+// Add adds a point key or range deletion to the table being written. A range
+// deletion spanning the split key is truncated at it. See Writer.Add.
+func (s *SplittingWriter) Add(key InternalKey, value []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	if key.Kind() != InternalKeyKindRangeDelete {
+		w, err := s.writerFor(key.UserKey)
+		if err != nil {
+			return err
+		}
+		return s.latch(w.Add(key, value))
+	}
+	start, end := key.UserKey, value
+	return s.addSpan(start, end, func(w *Writer, start, end []byte) error {
+		return w.Add(base.MakeInternalKey(start, key.SeqNum(), InternalKeyKindRangeDelete), end)
+	})
+}
+
+// RangeKeySet sets a range between start (inclusive) and end (exclusive) with
+// the given suffix to the given value, truncating it at the split key. See
+// Writer.RangeKeySet.
+func (s *SplittingWriter) RangeKeySet(start, end, suffix, value []byte) error {
+	return s.addSpan(start, end, func(w *Writer, start, end []byte) error {
+		return w.RangeKeySet(start, end, suffix, value)
+	})
+}
+
+// RangeKeyUnset un-sets a range between start (inclusive) and end (exclusive)
+// with the given suffix, truncating it at the split key. See
+// Writer.RangeKeyUnset.
+func (s *SplittingWriter) RangeKeyUnset(start, end, suffix []byte) error {
+	return s.addSpan(start, end, func(w *Writer, start, end []byte) error {
+		return w.RangeKeyUnset(start, end, suffix)
+	})
+}
+
+// RangeKeyDelete deletes a range between start (inclusive) and end
+// (exclusive), truncating it at the split key. See Writer.RangeKeyDelete.
+func (s *SplittingWriter) RangeKeyDelete(start, end []byte) error {
+	return s.addSpan(start, end, func(w *Writer, start, end []byte) error {
+		return w.RangeKeyDelete(start, end)
+	})
+}
+
+// addSpan adds the span [start, end) using add, splitting it into the parts
+// below and at or above the split key.
+func (s *SplittingWriter) addSpan(
+	start, end []byte, add func(w *Writer, start, end []byte) error,
+) error {
+	if s.err != nil {
+		return s.err
+	}
+	w, err := s.writerFor(start)
+	if err != nil {
+		return err
+	}
+	if w == s.second || s.first.compare(end, s.splitKey) <= 0 {
+		// The span lies entirely on one side of the split key.
+		return s.latch(add(w, start, end))
+	}
+	if err := s.latch(add(s.first, start, s.splitKey)); err != nil {
+		return err
+	}
+	return s.latch(add(s.second, s.splitKey, end))
+}
+
+// writerFor returns the Writer to which a key, or a span, starting at the
+// given user key belongs, closing the first Writer if the key is at or above
+// the split key.
+func (s *SplittingWriter) writerFor(start []byte) (*Writer, error) {
+	if s.first.compare(start, s.splitKey) < 0 {
+		if s.firstClosed {
+			return nil, s.latch(errors.Errorf(
+				"pebble: key %s added below split key %s after the first table was closed",
+				s.first.formatKey(start), s.first.formatKey(s.splitKey)))
+		}
+		return s.first, nil
+	}
+	if !s.firstClosed {
+		s.firstClosed = true
+		if err := s.first.Close(); err != nil {
+			return nil, s.latch(err)
+		}
+	}
+	return s.second, nil
+}
+
+func (s *SplittingWriter) latch(err error) error {
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	return err
+}
+
+// Close finishes writing both tables and closes both Writers. Once closed,
+// the Writers' metadata may be retrieved through First and Second.
+func (s *SplittingWriter) Close() error {
+	var err error
+	if !s.firstClosed {
+		s.firstClosed = true
+		err = s.first.Close()
+	}
+	err = errors.CombineErrors(err, s.second.Close())
+	if s.err != nil {
+		return s.err
+	}
+	return err
+}
+
+// First returns the Writer of keys below the split key.
+func (s *SplittingWriter) First() *Writer {
+	return s.first
+}
+
+// Second returns the Writer of keys at or above the split key.
+func (s *SplittingWriter) Second() *Writer {
+	return s.second
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/testkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplittingWriter(t *testing.T) {
+	opts := WriterOptions{
+		Comparer:    testkeys.Comparer,
+		TableFormat: TableFormatPebblev2,
+	}
+	firstFile, secondFile := &memFile{}, &memFile{}
+	s := NewSplittingWriter([]byte("m"), NewWriter(firstFile, opts), NewWriter(secondFile, opts))
+
+	add := func(key string, kind InternalKeyKind, value string) {
+		require.NoError(t, s.Add(base.MakeInternalKey([]byte(key), 1, kind), []byte(value)))
+	}
+	add("a", InternalKeyKindSet, "a")
+	add("b", InternalKeyKindRangeDelete, "q")
+	require.NoError(t, s.RangeKeySet([]byte("c"), []byte("t"), []byte("@1"), []byte("v")))
+	require.NoError(t, s.RangeKeyDelete([]byte("d"), []byte("e")))
+	add("d", InternalKeyKindSet, "d")
+	require.False(t, s.firstClosed)
+
+	// Crossing the split key closes the first table.
+	add("m", InternalKeyKindSet, "m")
+	require.True(t, s.firstClosed)
+	_, err := s.First().Metadata()
+	require.NoError(t, err)
+	require.NoError(t, s.RangeKeyUnset([]byte("p"), []byte("r"), []byte("@2")))
+	add("z", InternalKeyKindSet, "z")
+
+	// Keys below the split key may no longer be added.
+	require.EqualError(t, s.Add(base.MakeInternalKey([]byte("e"), 1, InternalKeyKindSet), nil),
+		"pebble: key e added below split key m after the first table was closed")
+	require.Error(t, s.Close())
+
+	read := func(data []byte) string {
+		r, err := NewMemReader(data, ReaderOptions{Comparer: testkeys.Comparer})
+		require.NoError(t, err)
+		defer r.Close()
+		var out string
+		iter, err := r.NewIter(nil, nil)
+		require.NoError(t, err)
+		for k, v := iter.First(); k != nil; k, v = iter.Next() {
+			out += fmt.Sprintf("%s=%s\n", k.UserKey, v)
+		}
+		require.NoError(t, iter.Close())
+		rangeDelIter, err := r.NewRawRangeDelIter()
+		require.NoError(t, err)
+		if rangeDelIter != nil {
+			for span := rangeDelIter.First(); span != nil; span = rangeDelIter.Next() {
+				out += fmt.Sprintf("rangedel %s-%s\n", span.Start, span.End)
+			}
+			require.NoError(t, rangeDelIter.Close())
+		}
+		rangeKeyIter, err := r.NewRawRangeKeyIter()
+		require.NoError(t, err)
+		if rangeKeyIter != nil {
+			for span := rangeKeyIter.First(); span != nil; span = rangeKeyIter.Next() {
+				out += fmt.Sprintf("rangekey %s\n", span)
+			}
+			require.NoError(t, rangeKeyIter.Close())
+		}
+		return out
+	}
+	require.Equal(t, `a=a
+d=d
+rangedel b-m
+rangekey c-d:{(#0,RANGEKEYSET,@1,v)}
+rangekey d-e:{(#0,RANGEKEYSET,@1,v) (#0,RANGEKEYDEL)}
+rangekey e-m:{(#0,RANGEKEYSET,@1,v)}
+`, read(firstFile.Data()))
+	require.Equal(t, `m=m
+z=z
+rangedel m-q
+rangekey m-p:{(#0,RANGEKEYSET,@1,v)}
+rangekey p-r:{(#0,RANGEKEYSET,@1,v) (#0,RANGEKEYUNSET,@2)}
+rangekey r-t:{(#0,RANGEKEYSET,@1,v)}
+`, read(secondFile.Data()))
+}
@@ -30,7 +30,7 @@ import (
 func RewriteKeySuffixes(
 	sst []byte,
 	rOpts ReaderOptions,
-	out writeCloseSyncer,
+	out WriteCloseSyncer,
 	o WriterOptions,
 	from, to []byte,
 	concurrency int,
@@ -44,7 +44,7 @@ func RewriteKeySuffixes(
 }
 
 func rewriteKeySuffixesInBlocks(
-	r *Reader, out writeCloseSyncer, o WriterOptions, from, to []byte, concurrency int,
+	r *Reader, out WriteCloseSyncer, o WriterOptions, from, to []byte, concurrency int,
 ) (*WriterMetadata, error) {
 	if o.Comparer == nil || o.Comparer.Split == nil {
 		return nil, errors.New("a valid splitter is required to define suffix to replace replace suffix")
@@ -372,10 +372,11 @@ type copyFilterWriter struct {
 	data           []byte
 }
 
-func (copyFilterWriter) addKey(key []byte)         { panic("unimplemented") }
-func (c copyFilterWriter) finish() ([]byte, error) { return c.data, nil }
-func (c copyFilterWriter) metaName() string        { return c.origMetaName }
-func (c copyFilterWriter) policyName() string      { return c.origPolicyName }
+func (copyFilterWriter) addKey(key []byte)               { panic("unimplemented") }
+func (c copyFilterWriter) finish() ([]byte, error)       { return c.data, nil }
+func (c copyFilterWriter) estimatedFPR(_ []byte) float64 { return 0 }
+func (c copyFilterWriter) metaName() string              { return c.origMetaName }
+func (c copyFilterWriter) policyName() string            { return c.origPolicyName }
 
 // RewriteKeySuffixesViaWriter is similar to RewriteKeySuffixes but uses just a
 // single loop over the Reader that writes each key to the Writer with the new
@@ -383,7 +384,7 @@ func (c copyFilterWriter) policyName() string      { return c.origPolicyName }
 // more work to rederive filters, props, etc, however re-doing that work makes
 // it less restrictive -- props no longer need to
 func RewriteKeySuffixesViaWriter(
-	r *Reader, out writeCloseSyncer, o WriterOptions, from, to []byte,
+	r *Reader, out WriteCloseSyncer, o WriterOptions, from, to []byte,
 ) (*WriterMetadata, error) {
 	if o.Comparer == nil || o.Comparer.Split == nil {
 		return nil, errors.New("a valid splitter is required to define suffix to replace replace suffix")
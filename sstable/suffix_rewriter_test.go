@@ -113,17 +113,17 @@ func TestRewriteSuffixProps(t *testing.T) {
 }
 
 // memFile is a file-like struct that buffers all data written to it in memory.
-// Implements the writeCloseSyncer interface.
+// Implements the WriteCloseSyncer interface.
 type memFile struct {
 	bytes.Buffer
 }
 
-// Close implements the writeCloseSyncer interface.
+// Close implements the WriteCloseSyncer interface.
 func (*memFile) Close() error {
 	return nil
 }
 
-// Sync implements the writeCloseSyncer interface.
+// Sync implements the WriteCloseSyncer interface.
 func (*memFile) Sync() error {
 	return nil
 }
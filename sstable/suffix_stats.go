@@ -0,0 +1,119 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/keyspan"
+	"github.com/cockroachdb/pebble/internal/rangekey"
+)
+
+// The names of the user properties in which the Writer records the per-suffix
+// bucket statistics enabled by WriterOptions.SuffixStats. The properties are
+// encoded as described in DecodeSuffixStats.
+const (
+	SuffixStatsPointKeysPropertyName = "pebble.suffix-stats.point-keys"
+	SuffixStatsRangeKeysPropertyName = "pebble.suffix-stats.range-keys"
+)
+
+// SuffixBucketFunc maps a key suffix, as determined by the Comparer's Split
+// function, to a bucket. An empty suffix is passed for keys without a suffix.
+type SuffixBucketFunc func(suffix []byte) uint64
+
+// suffixStats tallies the number of point keys and range keys in each suffix
+// bucket.
+type suffixStats struct {
+	split     Split
+	bucket    SuffixBucketFunc
+	points    map[uint64]uint64
+	rangeKeys map[uint64]uint64
+	keysBuf   []keyspan.Key
+}
+
+func newSuffixStats(split Split, bucket SuffixBucketFunc) *suffixStats {
+	return &suffixStats{
+		split:     split,
+		bucket:    bucket,
+		points:    make(map[uint64]uint64),
+		rangeKeys: make(map[uint64]uint64),
+	}
+}
+
+func (s *suffixStats) addPoint(key InternalKey) {
+	var suffix []byte
+	if s.split != nil {
+		suffix = key.UserKey[s.split(key.UserKey):]
+	}
+	s.points[s.bucket(suffix)]++
+}
+
+// addRangeKey tallies each of the suffixes of the encoded range key. A
+// RANGEKEYDEL, which has no suffix, is tallied with an empty suffix.
+func (s *suffixStats) addRangeKey(key InternalKey, value []byte) error {
+	span, err := rangekey.Decode(key, value, s.keysBuf[:0])
+	if err != nil {
+		return err
+	}
+	s.keysBuf = span.Keys
+	for i := range span.Keys {
+		s.rangeKeys[s.bucket(span.Keys[i].Suffix)]++
+	}
+	return nil
+}
+
+func (s *suffixStats) finish(userProps map[string]string) {
+	if len(s.points) > 0 {
+		userProps[SuffixStatsPointKeysPropertyName] = encodeSuffixStats(s.points)
+	}
+	if len(s.rangeKeys) > 0 {
+		userProps[SuffixStatsRangeKeysPropertyName] = encodeSuffixStats(s.rangeKeys)
+	}
+}
+
+// encodeSuffixStats encodes the histogram as a sequence of (bucket, count)
+// uvarint pairs, in increasing order of bucket.
+func encodeSuffixStats(m map[uint64]uint64) string {
+	buckets := make([]uint64, 0, len(m))
+	for b := range m {
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	buf := make([]byte, len(buckets)*2*binary.MaxVarintLen64)
+	var n int
+	for _, b := range buckets {
+		n += binary.PutUvarint(buf[n:], b)
+		n += binary.PutUvarint(buf[n:], m[b])
+	}
+	return string(buf[:n])
+}
+
+// DecodeSuffixStats decodes a per-suffix bucket histogram recorded in one of
+// the SuffixStats user properties, returning the number of keys in each
+// bucket.
+func DecodeSuffixStats(prop string) (map[uint64]uint64, error) {
+	m := make(map[uint64]uint64)
+	b := []byte(prop)
+	for len(b) > 0 {
+		bucket, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, base.CorruptionErrorf("pebble: invalid suffix stats bucket")
+		}
+		b = b[n:]
+		count, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, base.CorruptionErrorf("pebble: invalid suffix stats count")
+		}
+		b = b[n:]
+		if _, ok := m[bucket]; ok {
+			return nil, errors.Newf("pebble: duplicate suffix stats bucket %d", bucket)
+		}
+		m[bucket] = count
+	}
+	return m, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/testkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterSuffixStats(t *testing.T) {
+	// Bucket timestamps by tens, with unsuffixed keys in bucket 0.
+	bucket := func(suffix []byte) uint64 {
+		if len(suffix) == 0 {
+			return 0
+		}
+		ts, err := testkeys.ParseSuffix(suffix)
+		require.NoError(t, err)
+		return uint64(ts/10 + 1)
+	}
+	f := &memFile{}
+	w := NewWriter(f, WriterOptions{
+		Comparer:    testkeys.Comparer,
+		TableFormat: TableFormatPebblev2,
+		SuffixStats: bucket,
+	})
+	for _, k := range []string{"a", "a@25", "a@3", "b@21", "b@1", "c@5", "d"} {
+		require.NoError(t, w.Set([]byte(k), nil))
+	}
+	require.NoError(t, w.RangeKeySet([]byte("a"), []byte("c"), testkeys.Suffix(12), nil))
+	require.NoError(t, w.RangeKeyUnset([]byte("a"), []byte("c"), testkeys.Suffix(15)))
+	require.NoError(t, w.RangeKeyDelete([]byte("d"), []byte("e")))
+	require.NoError(t, w.Close())
+
+	r, err := NewMemReader(f.Data(), ReaderOptions{Comparer: testkeys.Comparer})
+	require.NoError(t, err)
+	defer r.Close()
+
+	points, err := DecodeSuffixStats(r.Properties.UserProperties[SuffixStatsPointKeysPropertyName])
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]uint64{0: 2, 1: 3, 3: 2}, points)
+	rangeKeys, err := DecodeSuffixStats(r.Properties.UserProperties[SuffixStatsRangeKeysPropertyName])
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]uint64{0: 1, 2: 2}, rangeKeys)
+
+	_, err = DecodeSuffixStats("\xff")
+	require.Error(t, err)
+}
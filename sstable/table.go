@@ -154,6 +154,33 @@ lower-level index blocks.
 The metaindex block also contains block handles as values, with keys being
 the names of the meta blocks.
 
+A small table in the Pebblev3 format or later, with a single data block, may
+instead end with a compact footer (see WriterOptions.SmallTableThreshold). The compact
+footer holds the contents of the metaindex block and of the single level
+index block inline, without block trailers, in place of separate blocks:
+
+<start_of_file>
+[data block]
+[meta blocks] (as above)
+[meta properties block]
+[compact footer]
+<end_of_file>
+
+compact footer format:
+   metaindex block contents
+   index block contents
+   metaindex length (4 bytes)
+   index length (4 bytes)
+   checksum type (char, 1 byte)
+   checksum (4 bytes)
+   footer version (4 bytes), with compactFooterVersionFlag set
+   table_magic_number (8 bytes)
+
+The checksum is computed over the footer from its start up to and including
+the checksum type, in the same way as a block's checksum. The footer version
+holds the table's format version, which is at least 3, so readers which do not
+understand the compact footer reject the table as being in an unknown format.
+
 */
 
 const (
@@ -176,16 +203,26 @@ const (
 
 	pebbleDBMagic = "\xf0\x9f\xaa\xb3\xf0\x9f\xaa\xb3" // 🪳🪳
 
+	// compactFooterVersionFlag is set in the footer version of a table with a
+	// compact footer.
+	compactFooterVersionFlag = 1 << 31
+	compactFooterTrailerLen  = 4 + 4 + 1 + 4 + 4 + 8
+	compactFooterMagicOffset = compactFooterTrailerLen - len(pebbleDBMagic)
+
 	minFooterLen = levelDBFooterLen
 	maxFooterLen = rocksDBFooterLen
 
 	levelDBFormatVersion  = 0
 	rocksDBFormatVersion2 = 2
 
-	metaRangeKeyName   = "pebble.range_key"
-	metaPropertiesName = "rocksdb.properties"
-	metaRangeDelName   = "rocksdb.range_del"
-	metaRangeDelV2Name = "rocksdb.range_del2"
+	metaBlockHashesName = "pebble.block_hashes"
+	metaExpiriesName    = "pebble.expiries"
+	metaFirstBytesName  = "pebble.first_bytes"
+	metaPinnedName      = "pebble.pinned_blocks"
+	metaRangeKeyName    = "pebble.range_key"
+	metaPropertiesName  = "rocksdb.properties"
+	metaRangeDelName    = "rocksdb.range_del"
+	metaRangeDelV2Name  = "rocksdb.range_del2"
 
 	// Index Types.
 	// A space efficient index block that is optimized for binary-search-based
@@ -203,6 +240,11 @@ const (
 	rocksDBCompressionOptions = "window_bits=-14; level=32767; strategy=0; max_dict_bytes=0; zstd_max_train_bytes=0; enabled=0; "
 )
 
+// reservedMetaindexPrefixes are the prefixes of the names of the metaindex
+// entries of the meta blocks written by the Writer itself: the filter block,
+// and the Pebble and RocksDB meta blocks.
+var reservedMetaindexPrefixes = []string{"fullfilter.", "pebble.", "rocksdb."}
+
 // ChecksumType specifies the checksum used for blocks.
 type ChecksumType byte
 
@@ -291,6 +333,12 @@ type footer struct {
 	metaindexBH BlockHandle
 	indexBH     BlockHandle
 	footerBH    BlockHandle
+	// compact is set for a compact footer, in which case inlineMetaindex and
+	// inlineIndex hold the contents of the metaindex and index blocks, and
+	// metaindexBH and indexBH locate those contents within the footer.
+	compact         bool
+	inlineMetaindex []byte
+	inlineIndex     []byte
 }
 
 func readFooter(f ReadableFile) (footer, error) {
@@ -327,6 +375,13 @@ func readFooter(f ReadableFile) (footer, error) {
 		footer.checksum = ChecksumTypeCRC32c
 
 	case rocksDBMagic, pebbleDBMagic:
+		if string(magic) == pebbleDBMagic && len(buf) >= compactFooterTrailerLen {
+			trailer := buf[len(buf)-compactFooterTrailerLen:]
+			version := binary.LittleEndian.Uint32(trailer[compactFooterMagicOffset-4:])
+			if version&compactFooterVersionFlag != 0 {
+				return readCompactFooter(f, stat.Size(), trailer)
+			}
+		}
 		// NOTE: The Pebble magic string implies the same footer format as that used
 		// by the RocksDBv2 table format.
 		if len(buf) < rocksDBFooterLen {
@@ -375,6 +430,74 @@ func readFooter(f ReadableFile) (footer, error) {
 	return footer, nil
 }
 
+// readCompactFooter reads the compact footer of the table f of the given
+// size, whose trailing compactFooterTrailerLen bytes are trailer.
+func readCompactFooter(f ReadableFile, size int64, trailer []byte) (footer, error) {
+	var footer footer
+	metaindexLen := uint64(binary.LittleEndian.Uint32(trailer[0:]))
+	indexLen := uint64(binary.LittleEndian.Uint32(trailer[4:]))
+	footerLen := metaindexLen + indexLen + compactFooterTrailerLen
+	if footerLen > uint64(size) {
+		return footer, base.CorruptionErrorf("pebble/table: invalid table (compact footer too long)")
+	}
+	version := binary.LittleEndian.Uint32(trailer[compactFooterMagicOffset-4:])
+	format, err := ParseTableFormat(trailer[compactFooterMagicOffset:], version&^compactFooterVersionFlag)
+	if err != nil {
+		return footer, err
+	}
+	if format < TableFormatPebblev3 {
+		return footer, base.CorruptionErrorf(
+			"pebble/table: invalid table (compact footer in format %s)", errors.Safe(format))
+	}
+	footer.format = format
+	switch footer.checksum = ChecksumType(trailer[8]); footer.checksum {
+	case ChecksumTypeCRC32c, ChecksumTypeXXHash64:
+	default:
+		return footer, base.CorruptionErrorf("pebble/table: unsupported checksum type %d", errors.Safe(footer.checksum))
+	}
+
+	buf := make([]byte, footerLen)
+	footer.footerBH = BlockHandle{Offset: uint64(size) - footerLen, Length: footerLen}
+	if _, err := f.ReadAt(buf, int64(footer.footerBH.Offset)); err != nil && err != io.EOF {
+		return footer, errors.Wrap(err, "pebble/table: invalid table (could not read footer)")
+	}
+	// The checksummed contents are laid out as a block: the checksum type
+	// takes the place of the block type in the trailer.
+	checksummed := BlockHandle{Offset: footer.footerBH.Offset, Length: metaindexLen + indexLen + 8}
+	if err := checkChecksum(footer.checksum, buf, checksummed, 0 /* fileNum */); err != nil {
+		return footer, err
+	}
+	footer.compact = true
+	footer.inlineMetaindex = buf[:metaindexLen:metaindexLen]
+	footer.inlineIndex = buf[metaindexLen : metaindexLen+indexLen : metaindexLen+indexLen]
+	footer.metaindexBH = BlockHandle{Offset: footer.footerBH.Offset, Length: metaindexLen}
+	footer.indexBH = BlockHandle{Offset: footer.footerBH.Offset + metaindexLen, Length: indexLen}
+	return footer, nil
+}
+
+// encodeCompact appends the compact footer, holding f.inlineMetaindex and
+// f.inlineIndex, to buf, using c to compute its checksum.
+func (f footer) encodeCompact(buf []byte, c *checksummer) []byte {
+	magic, version := f.format.AsTuple()
+	if magic != pebbleDBMagic {
+		panic("sstable: compact footer requires a Pebble table format")
+	}
+	var tmp [4]byte
+	appendUint32 := func(buf []byte, v uint32) []byte {
+		binary.LittleEndian.PutUint32(tmp[:], v)
+		return append(buf, tmp[:]...)
+	}
+	start := len(buf)
+	buf = append(buf, f.inlineMetaindex...)
+	buf = append(buf, f.inlineIndex...)
+	buf = appendUint32(buf, uint32(len(f.inlineMetaindex)))
+	buf = appendUint32(buf, uint32(len(f.inlineIndex)))
+	buf = append(buf, byte(f.checksum))
+	buf = appendUint32(buf, c.checksum(buf[start:len(buf)-1], buf[len(buf)-1:]))
+	buf = appendUint32(buf, version|compactFooterVersionFlag)
+	return append(buf, magic...)
+}
+
 func (f footer) encode(buf []byte) []byte {
 	switch magic, version := f.format.AsTuple(); magic {
 	case levelDBMagic:
@@ -420,7 +543,7 @@ func supportsTwoLevelIndex(format TableFormat) bool {
 	switch format {
 	case TableFormatLevelDB:
 		return false
-	case TableFormatRocksDBv2, TableFormatPebblev1, TableFormatPebblev2:
+	case TableFormatRocksDBv2, TableFormatPebblev1, TableFormatPebblev2, TableFormatPebblev3:
 		return true
 	default:
 		panic("sstable: unspecified table format version")
@@ -21,6 +21,7 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/bloom"
 	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/testkeys"
 	"github.com/cockroachdb/pebble/vfs"
 	"github.com/kr/pretty"
 	"github.com/stretchr/testify/require"
@@ -542,6 +543,91 @@ func TestBloomFilterFalsePositiveRate(t *testing.T) {
 	require.NoError(t, r.Close())
 }
 
+func TestFilterWholeKeys(t *testing.T) {
+	ks := testkeys.Alpha(3)
+	ks = ks.EveryN(ks.Count() / 2000)
+	build := func(wholeKeys bool) *Reader {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			Comparer:        testkeys.Comparer,
+			FilterPolicy:    bloom.FilterPolicy(10),
+			FilterWholeKeys: wholeKeys,
+		})
+		for i := 0; i < ks.Count(); i++ {
+			require.NoError(t, w.Set(testkeys.KeyAt(ks, i, 5), nil))
+			require.NoError(t, w.Set(testkeys.KeyAt(ks, i, 3), nil))
+		}
+		require.NoError(t, w.Close())
+		r, err := NewMemReader(f.Data(), ReaderOptions{
+			Comparer: testkeys.Comparer,
+			Filters:  map[string]FilterPolicy{bloom.FilterPolicy(10).Name(): bloom.FilterPolicy(10)},
+		})
+		require.NoError(t, err)
+		return r
+	}
+	prefixOnly := build(false)
+	defer prefixOnly.Close()
+	r := build(true)
+	defer r.Close()
+
+	require.True(t, r.Properties.PrefixFiltering)
+	require.True(t, r.Properties.WholeKeyFiltering)
+	require.False(t, prefixOnly.Properties.WholeKeyFiltering)
+	// Each prefix contributes one prefix entry and two whole key entries.
+	require.Greater(t, r.Properties.FilterSize, 2*prefixOnly.Properties.FilterSize)
+
+	// fpr returns the fraction of the queries for which the filter returned a
+	// positive result.
+	fpr := func(r *Reader, exact bool, key func(i int) []byte) float64 {
+		var positives int
+		for i := 0; i < ks.Count(); i++ {
+			ok, err := r.FilterMayContain(key(i), exact)
+			require.NoError(t, err)
+			if ok {
+				positives++
+			}
+		}
+		return float64(positives) / float64(ks.Count())
+	}
+	present := func(i int) []byte { return testkeys.KeyAt(ks, i, 5) }
+	absentSuffix := func(i int) []byte { return testkeys.KeyAt(ks, i, 4) }
+	prefix := func(i int) []byte { return testkeys.Key(ks, i) }
+	absentPrefix := func(i int) []byte { return append(testkeys.Key(ks, i), '!') }
+
+	for _, r := range []*Reader{prefixOnly, r} {
+		// No false negatives for either query style.
+		require.Equal(t, 1.0, fpr(r, true, present))
+		require.Equal(t, 1.0, fpr(r, false, prefix))
+		// Absent prefixes are filtered for either query style.
+		require.Less(t, fpr(r, false, absentPrefix), 0.05)
+		require.Less(t, fpr(r, true, absentPrefix), 0.05)
+	}
+	// Only the whole key filter is able to filter an absent suffix for a
+	// present prefix.
+	require.Equal(t, 1.0, fpr(prefixOnly, true, absentSuffix))
+	require.Less(t, fpr(r, true, absentSuffix), 0.05)
+}
+
+func TestWriterFilterFPR(t *testing.T) {
+	build := func(fp FilterPolicy) *WriterMetadata {
+		w := NewWriter(&memFile{}, WriterOptions{FilterPolicy: fp})
+		for i := 0; i < 10000; i++ {
+			require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), nil))
+		}
+		require.NoError(t, w.Close())
+		meta, err := w.Metadata()
+		require.NoError(t, err)
+		return meta
+	}
+	require.Equal(t, 0.0, build(nil).FilterFPR)
+	// According to the comments in the C++ LevelDB code, the false positive
+	// rate should be approximately 1% for bloom.FilterPolicy(10).
+	fpr10 := build(bloom.FilterPolicy(10)).FilterFPR
+	require.InDelta(t, 0.01, fpr10, 0.005)
+	fpr5 := build(bloom.FilterPolicy(5)).FilterFPR
+	require.Greater(t, fpr5, fpr10)
+}
+
 type countingFilterPolicy struct {
 	FilterPolicy
 	degenerate bool
@@ -42,6 +42,9 @@ type writeQueue struct {
 	tasks  chan *writeTask
 	wg     sync.WaitGroup
 	writer *Writer
+	// inflight tracks the tasks which have been added to the queue, but which
+	// haven't been processed yet.
+	inflight sync.WaitGroup
 
 	// err represents an error which is encountered when the write queue attempts
 	// to write a block to disk. The error is stored here to skip unnecessary block
@@ -68,6 +71,16 @@ func (w *writeQueue) performWrite(task *writeTask) error {
 	if bh, err = w.writer.writeCompressedBlock(task.buf.compressed, task.buf.tmp[:]); err != nil {
 		return err
 	}
+	if w.writer.selfCheckBlocks {
+		if err = w.writer.checkBlock(
+			bh, task.buf.uncompressed, task.buf.compressed, task.buf.tmp[:]); err != nil {
+			return err
+		}
+	}
+
+	w.writer.addDataBlockHash(bh, task.buf.uncompressed)
+	w.writer.addDataBlockFirstBytes(bh, task.buf)
+	w.writer.addPinnedDataBlock(bh, task.buf)
 
 	// Update the size estimates after writing the data block to disk.
 	w.writer.coordination.sizeEstimate.dataBlockWritten(
@@ -110,14 +123,25 @@ func (w *writeQueue) runWorker() {
 		}
 
 		w.releaseBuffers(task)
+		w.inflight.Done()
 	}
 	w.wg.Done()
 }
 
 func (w *writeQueue) add(task *writeTask) {
+	w.inflight.Add(1)
 	w.tasks <- task
 }
 
+// drain blocks until every task which has been added to the writeQueue has
+// been processed, and returns any error which was encountered while tasks
+// were processed. Like add, drain must only be called by the Writer client
+// goroutine.
+func (w *writeQueue) drain() error {
+	w.inflight.Wait()
+	return w.err
+}
+
 // addSync will perform the writeTask synchronously with the caller goroutine. Calls to addSync
 // are no longer valid once writeQueue.add has been called at least once.
 func (w *writeQueue) addSync(task *writeTask) error {
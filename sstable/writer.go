@@ -7,12 +7,17 @@ package sstable
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"hash"
 	"io"
 	"math"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/cockroachdb/errors"
@@ -32,6 +37,11 @@ const encodedBHPEstimatedSize = binary.MaxVarintLen64 * 2
 
 var errWriterClosed = errors.New("pebble: writer is closed")
 
+// ErrValidation marks the errors returned by a Writer for a key that it
+// rejected without writing, such as a key added out of order. Such errors may
+// be identified with errors.Is.
+var ErrValidation = errors.New("pebble: key rejected by validation")
+
 // WriterMetadata holds info about a finished sstable.
 type WriterMetadata struct {
 	Size          uint64
@@ -50,6 +60,52 @@ type WriterMetadata struct {
 	SmallestSeqNum   uint64
 	LargestSeqNum    uint64
 	Properties       Properties
+	// FilterFPR is the theoretical false positive rate of the table's filter,
+	// computed from the number of keys added to the filter and its size. It is
+	// 0 if the table has no filter.
+	FilterFPR float64
+	// BlockPropertySizes maps the name of each BlockPropertyCollector to the
+	// total number of bytes of data block and index block properties it
+	// produced across the table. Nil if there are no BlockPropertyCollectors.
+	BlockPropertySizes map[string]uint64
+	// TotalRestartPoints is the number of restart points across all of the
+	// table's data blocks. See MeanRestartPointsPerDataBlock.
+	TotalRestartPoints uint64
+	// MaxRestartSpan is the largest number of entries, across all of the
+	// table's data blocks, from a restart point up to the next restart point
+	// or the end of the block. A seek within a block scans up to this many
+	// entries after binary searching the restart points.
+	MaxRestartSpan uint64
+	// MaxBlockTombstoneFraction and MeanBlockTombstoneFraction are the maximum
+	// and mean, across the table's non-empty data blocks, of the fraction of
+	// each block's entries that are point tombstones (DEL or SINGLEDEL). Both
+	// are 0 if the table has no point keys.
+	MaxBlockTombstoneFraction  float64
+	MeanBlockTombstoneFraction float64
+	// MaxBlockCompressionTime and MeanBlockCompressionTime are the maximum
+	// and mean time taken to compress and checksum each of the table's data
+	// blocks. Both are 0 unless WriterOptions.RecordCompressionTimes is set.
+	MaxBlockCompressionTime  time.Duration
+	MeanBlockCompressionTime time.Duration
+	// IndexOffset is the offset of the index block referenced by the footer:
+	// the top-level index block if the table has a two-level index. It is 0 if
+	// the table has no index block (see WriterOptions.OmitEmptyPointBlocks).
+	// Note that the filter block and any index partitions precede it; the data
+	// blocks end at Properties.DataSize.
+	IndexOffset uint64
+	// FeatureFlags is the set of table format features used by the table.
+	// FeatureFlags.MinimumTableFormat is the oldest format in which a table
+	// with the same contents could have been written.
+	FeatureFlags FeatureFlags
+}
+
+// MeanRestartPointsPerDataBlock returns the average number of restart points
+// per data block, or 0 if the table has no data blocks.
+func (m *WriterMetadata) MeanRestartPointsPerDataBlock() float64 {
+	if m.Properties.NumDataBlocks == 0 {
+		return 0
+	}
+	return float64(m.TotalRestartPoints) / float64(m.Properties.NumDataBlocks)
 }
 
 // SetSmallestPointKey sets the smallest point key to the given key.
@@ -113,16 +169,25 @@ type flusher interface {
 	Flush() error
 }
 
-type writeCloseSyncer interface {
+// WriteCloseSyncer is the interface implemented by the files that tables are
+// written to, such as a vfs.File.
+type WriteCloseSyncer interface {
 	io.WriteCloser
 	Sync() error
 }
 
 // Writer is a table writer.
+//
+// The first error encountered by a Writer is latched: once latched, the error
+// is returned by every subsequent operation, including Close, and by Err. An
+// error resulting from a key that is rejected by validation before any of the
+// Writer's state has been mutated (e.g. a key added out of order) is latched
+// in the same way, unless WriterOptions.ContinueOnValidationError is set. See
+// validationError.
 type Writer struct {
 	writer    io.Writer
 	bufWriter *bufio.Writer
-	syncer    writeCloseSyncer
+	syncer    WriteCloseSyncer
 	meta      WriterMetadata
 	err       error
 	// cacheID and fileNum are used to remove blocks written to the sstable from
@@ -145,10 +210,77 @@ type Writer struct {
 	cache                   *cache.Cache
 	restartInterval         int
 	checksumType            ChecksumType
+	// The following fields are likewise copied from Options, and are described
+	// there.
+	continueOnValidationError     bool
+	maxValidationErrors           int
+	plainCompat                   bool
+	omitEmptyPointBlocks          bool
+	compressProperties            bool
+	recordPresentKeyKinds         bool
+	keyBounds                     UserKeyBounds
+	keyValidator                  func(userKey []byte) error
+	requirePreFragmentedRangeKeys bool
+	bufferRangeKeys               bool
+	maxBufferedRangeKeys          int
+	adaptiveRestartInterval       bool
+	fullKeyIndexSeparators        bool
+	indexPartitionDataSizes       bool
+	preFinishValidator            func(*WriterMetadata) error
+	rewriteUserProperty           func(name string, value []byte) ([]byte, error)
+	smallTableThreshold           int
+	asyncFinish                   bool
+	maxUserPropertiesBytes        int
+	keyRangeOverride              *KeyRange
+	expectedRangeDelBounds        *KeyRange
+	filterKeyTransform            *FilterKeyTransform
+	// now is nil if WriterOptions.Deterministic is set.
+	now func() time.Time
+	// writerDiagnostics holds the state of the options intended for testing
+	// and diagnosing the Writer.
+	writerDiagnostics
 	// disableKeyOrderChecks disables the checks that keys are added to an
 	// sstable in order. It is intended for internal use only in the construction
 	// of invalid sstables for testing. See tool/make_test_sstables.go.
 	disableKeyOrderChecks bool
+	// forcedFooterFormat, if not TableFormatUnspecified, is the table format
+	// recorded in the footer in place of tableFormat, without checking its
+	// compatibility with the features used by the table. It is only set
+	// through private.SSTableWriterForceFooterFormat, to construct mismatched
+	// tables for testing.
+	forcedFooterFormat TableFormat
+	// validationErrors accumulates up to maxValidationErrors of the
+	// validation errors returned without being latched since the last call to
+	// TakeValidationErrors.
+	validationErrors []error
+	// If requirePreFragmentedRangeKeys is set, the bounds of the last span
+	// passed to addRangeKeySpan are retained in lastRangeKeySpanStart and
+	// lastRangeKeySpanEnd.
+	lastRangeKeySpanStart []byte
+	lastRangeKeySpanEnd   []byte
+	// If bufferRangeKeys is set, the spans passed to addRangeKeySpan
+	// accumulate in bufferedRangeKeys until Close.
+	bufferedRangeKeys []keyspan.Span
+	// If adaptiveRestartInterval is set, blockSharedPrefixLen and
+	// blockUserKeyLen accumulate, over the keys of the current data block other
+	// than the first, the length of the prefix each key shares with the
+	// preceding key and the length of the key. See dataBlockRestartInterval.
+	blockSharedPrefixLen int
+	blockUserKeyLen      int
+	// compactFooter is set by Close if the table ends with a compact footer.
+	compactFooter bool
+	// durable is non-nil if Close started syncing and closing the file in the
+	// background, and is closed once they complete, after durableErr has been
+	// set to any error they encountered.
+	durable    chan struct{}
+	durableErr error
+	// rangeDelCoalescer is non-nil if WriterOptions.CoalesceRangeDels is set.
+	rangeDelCoalescer *rangeDelCoalescer
+	// customMetaindexEntries are the entries added by AddMetaindexEntry.
+	customMetaindexEntries []metaindexEntry
+	// ctx is non-nil if the Writer was created by NewWriterWithContext. See
+	// checkContext.
+	ctx context.Context
 	// With two level indexes, the index/filter of a SST file is partitioned into
 	// smaller blocks with an additional top-level index on them. When reading an
 	// index/filter, only the top-level index is loaded into memory. The two level
@@ -165,6 +297,11 @@ type Writer struct {
 	// smaller memory footprint, can be used to prevent the entire index block from
 	// being loaded into the block cache.
 	twoLevelIndex bool
+	// indexBlockFlushed is set by the Writer client goroutine once it has
+	// decided to flush an index block, which enables a two-level index. Unlike
+	// twoLevelIndex, which is set from the writeQueue, it may be read by the
+	// client goroutine while blocks are written in parallel.
+	indexBlockFlushed bool
 	// Internal flag to allow creation of range-del-v1 format blocks. Only used
 	// for testing. Note that v2 format blocks are backwards compatible with v1
 	// format blocks.
@@ -177,10 +314,70 @@ type Writer struct {
 	propCollectors      []TablePropertyCollector
 	blockPropCollectors []BlockPropertyCollector
 	blockPropsEncoder   blockPropertiesEncoder
+	// blockPropSizes is indexed by the shortID of each block property
+	// collector, and accumulates the size of the data block and index block
+	// properties it produced.
+	blockPropSizes []uint64
+	// totalRestartPoints accumulates the number of restart points of the data
+	// blocks finished so far, and is copied to
+	// WriterMetadata.TotalRestartPoints by Close.
+	totalRestartPoints uint64
+	// maxRestartSpan is the largest restart span of the data blocks finished so
+	// far, and is copied to WriterMetadata.MaxRestartSpan by Close.
+	maxRestartSpan int
+	// blockTombstones tracks the fraction of each data block's entries that
+	// are point tombstones.
+	blockTombstones blockTombstoneStats
+	// blockAlignment is WriterOptions.BlockAlignment, and alignmentPadding
+	// holds the zeros with which blocks are padded to be aligned.
+	blockAlignment   uint64
+	alignmentPadding []byte
+	// multipartPartSize is WriterOptions.MultipartPartSize.
+	multipartPartSize uint64
+	// suffixStats is non-nil if WriterOptions.SuffixStats is set.
+	suffixStats *suffixStats
+	// sizeDistribution is non-nil if WriterOptions.SizeDistribution is set.
+	sizeDistribution *sizeDistribution
+	// seqNums is non-nil if WriterOptions.SeqNumHistogram is set.
+	seqNums *seqNumHistogram
+	// blockHash is non-nil if WriterOptions.DataBlockHash is set, in which
+	// case the hash of each data block is added to blockHashes, keyed by the
+	// block's offset, as the block is written. Both are only used by the
+	// goroutine writing data blocks.
+	blockHash    hash.Hash
+	blockHashes  rawBlockWriter
+	blockHashBuf []byte
+	// firstBytes is set if WriterOptions.DataBlockFirstByteRanges is set, in
+	// which case the range of first bytes of each data block is added to
+	// firstByteRanges, keyed by the block's offset, as the block is written.
+	// firstByteRanges is only used by the goroutine writing data blocks.
+	firstBytes      bool
+	firstByteRanges rawBlockWriter
+	// pinNext is set by MarkNextBlockPinned, and cleared once the next point
+	// key is added, marking its data block as pinned. The offsets of pinned
+	// data blocks are added to pinnedBlocks as the blocks are written.
+	// pinnedBlocks is only used by the goroutine writing data blocks.
+	pinNext      bool
+	pinnedBlocks rawBlockWriter
+	// expiries holds the expiration times of the point keys added through
+	// AddWithExpiry, keyed by the encoded internal key. expiryKeyBuf is used
+	// to encode the keys.
+	expiries     rawBlockWriter
+	expiryKeyBuf []byte
 	// filter accumulates the filter block. If populated, the filter ingests
 	// either the output of w.split (i.e. a prefix extractor) if w.split is not
-	// nil, or the full keys otherwise.
+	// nil, or the full keys otherwise. If filterWholeKeys is set, the full keys
+	// are ingested in addition to the output of w.split.
 	filter          filterWriter
+	filterWholeKeys bool
+	// lastFilterPrefix holds the most recent prefix added to the filter, so
+	// that a prefix shared by consecutive keys is only added once.
+	lastFilterPrefix    []byte
+	lastFilterPrefixSet bool
+	// filterKeyBuf is the scratch buffer into which filterKeyTransform
+	// transforms keys.
+	filterKeyBuf []byte
+
 	indexPartitions []indexBlockAndBlockProperties
 
 	// indexBlockAlloc is used to bulk-allocate byte slices used to store index
@@ -219,17 +416,20 @@ type coordinationState struct {
 	sizeEstimate dataBlockEstimates
 }
 
-func (c *coordinationState) init(parallelismEnabled bool, writer *Writer) {
+func (c *coordinationState) init(parallelismEnabled bool, queueSize int, writer *Writer) {
 	c.parallelismEnabled = parallelismEnabled
 	c.sizeEstimate.useMutex = parallelismEnabled
 
 	// writeQueueSize determines the size of the write queue, or the number
 	// of items which can be added to the queue without blocking. By default, we
 	// use a writeQueue size of 0, since we won't be doing any block writes in
-	// parallel.
+	// parallel. With parallelism, the size defaults to GOMAXPROCS.
 	writeQueueSize := 0
 	if parallelismEnabled {
-		writeQueueSize = runtime.GOMAXPROCS(0)
+		writeQueueSize = queueSize
+		if writeQueueSize <= 0 {
+			writeQueueSize = runtime.GOMAXPROCS(0)
+		}
 	}
 	c.writeQueue = newWriteQueue(writeQueueSize, writer)
 }
@@ -271,12 +471,18 @@ func (s *sizeEstimate) init(emptySize uint64) {
 	s.emptySize = emptySize
 }
 
-func (s *sizeEstimate) size() uint64 {
-	ratio := float64(1)
-	if s.uncompressedSize > 0 {
-		ratio = float64(s.compressedSize) / float64(s.uncompressedSize)
+// compressionRatio returns the ratio of the compressed size to the
+// uncompressed size of the written entries, or 1 if no entries have been
+// written.
+func (s *sizeEstimate) compressionRatio() float64 {
+	if s.uncompressedSize == 0 {
+		return 1
 	}
-	estimatedInflightSize := uint64(float64(s.inflightSize) * ratio)
+	return float64(s.compressedSize) / float64(s.uncompressedSize)
+}
+
+func (s *sizeEstimate) size() uint64 {
+	estimatedInflightSize := uint64(float64(s.inflightSize) * s.compressionRatio())
 	total := s.totalSize + estimatedInflightSize
 	if total > s.maxEstimatedSize {
 		s.maxEstimatedSize = total
@@ -331,6 +537,11 @@ type indexBlockBuf struct {
 	// restartInterval matches indexBlockBuf.block.restartInterval. We store it twice, because the `block`
 	// must only be accessed from the writeQueue goroutine.
 	restartInterval int
+
+	// dataSize is the total size, including trailers, of the data blocks
+	// indexed by the block. Like block, it is only accessed from the
+	// writeQueue goroutine.
+	dataSize uint64
 }
 
 func (i *indexBlockBuf) clear() {
@@ -341,6 +552,7 @@ func (i *indexBlockBuf) clear() {
 	}
 	i.size.estimate.clear()
 	i.restartInterval = 0
+	i.dataSize = 0
 }
 
 var indexBlockBufPool = sync.Pool{
@@ -467,6 +679,41 @@ func (d *dataBlockEstimates) size() uint64 {
 	return d.estimate.size()
 }
 
+// compressionRatio is the ratio of the compressed size to the uncompressed
+// size of the data blocks which have been written to disk.
+func (d *dataBlockEstimates) compressionRatio() float64 {
+	if d.useMutex {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+	}
+
+	return d.estimate.compressionRatio()
+}
+
+// stats returns the estimated size of the data blocks, the size of the data
+// blocks which have been written to disk, the number of data blocks (both
+// written and inflight) and the compression ratio, as a consistent snapshot.
+func (d *dataBlockEstimates) stats() (size, written, blocks uint64, compressionRatio float64) {
+	if d.useMutex {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+	}
+
+	return d.estimate.size(), d.estimate.totalSize, d.estimate.numTotalEntries(),
+		d.estimate.compressionRatio()
+}
+
+// rawBlockWritten is called when a block other than a data block has been
+// written among the data blocks, taking the size of the table to newTotalSize.
+func (d *dataBlockEstimates) rawBlockWritten(newTotalSize uint64) {
+	if d.useMutex {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+	}
+
+	d.estimate.totalSize = newTotalSize
+}
+
 func (d *dataBlockEstimates) addInflightDataBlock(size int) {
 	if d.useMutex {
 		d.mu.Lock()
@@ -558,6 +805,32 @@ type dataBlockBuf struct {
 
 	// sepScratch is reusable scratch space for computing separator keys.
 	sepScratch []byte
+
+	// minFirstByte and maxFirstByte are the smallest and largest first byte of
+	// the non-empty user keys in the block, if hasFirstByte is set. They are
+	// only maintained if WriterOptions.DataBlockFirstByteRanges is set.
+	minFirstByte, maxFirstByte byte
+	hasFirstByte               bool
+
+	// pinned is set if the block has been marked as pinned through
+	// Writer.MarkNextBlockPinned.
+	pinned bool
+}
+
+// addFirstByte updates the range of first bytes of the block's user keys with
+// those of userKey.
+func (d *dataBlockBuf) addFirstByte(userKey []byte) {
+	if len(userKey) == 0 {
+		return
+	}
+	b := userKey[0]
+	if !d.hasFirstByte || b < d.minFirstByte {
+		d.minFirstByte = b
+	}
+	if !d.hasFirstByte || b > d.maxFirstByte {
+		d.maxFirstByte = b
+	}
+	d.hasFirstByte = true
 }
 
 func (d *dataBlockBuf) clear() {
@@ -568,6 +841,8 @@ func (d *dataBlockBuf) clear() {
 	d.compressed = nil
 	d.dataBlockProps = nil
 	d.sepScratch = d.sepScratch[:0]
+	d.hasFirstByte = false
+	d.pinned = false
 }
 
 var dataBlockBufPool = sync.Pool{
@@ -601,6 +876,9 @@ func (d *dataBlockBuf) shouldFlush(
 
 type indexBlockAndBlockProperties struct {
 	nEntries int
+	// dataSize is the total size, including trailers, of the data blocks
+	// indexed by this block.
+	dataSize uint64
 	// sep is the last key added to this block, for computing a separator later.
 	sep        InternalKey
 	properties []byte
@@ -659,6 +937,44 @@ func (w *Writer) Merge(key, value []byte) error {
 	return w.addPoint(base.MakeInternalKey(key, 0, InternalKeyKindMerge), value)
 }
 
+// AddMergeOperands adds a run of merge operands for the given key, with the
+// sequence numbers in seqNums and the corresponding values in values. The
+// sequence numbers must be strictly decreasing, and the first of the run must
+// sort after the previously added point key. It is equivalent to calling Add
+// for each operand in turn, but the ordering of the run is validated once.
+func (w *Writer) AddMergeOperands(key []byte, seqNums []uint64, values [][]byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(seqNums) != len(values) {
+		return w.validationError(errors.Errorf(
+			"pebble: mismatched merge operands: %d sequence numbers, %d values",
+			len(seqNums), len(values)))
+	}
+	if len(seqNums) == 0 {
+		return nil
+	}
+	for i := 1; i < len(seqNums); i++ {
+		if seqNums[i] >= seqNums[i-1] {
+			return w.validationError(errors.Errorf(
+				"pebble: merge operand sequence numbers must be strictly decreasing: %d, %d",
+				seqNums[i-1], seqNums[i]))
+		}
+	}
+	// Validating the first operand against the previously added key validates
+	// the entire run.
+	if err := w.addPoint(base.MakeInternalKey(key, seqNums[0], InternalKeyKindMerge), values[0]); err != nil {
+		return err
+	}
+	for i := 1; i < len(seqNums); i++ {
+		ikey := base.MakeInternalKey(key, seqNums[i], InternalKeyKindMerge)
+		if err := w.addValidatedPoint(ikey, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Add adds a key/value pair to the table being written. For a given Writer,
 // the keys passed to Add must be in increasing order. The exception to this
 // rule is range deletion tombstones. Range deletion tombstones need to be
@@ -676,14 +992,164 @@ func (w *Writer) Add(key InternalKey, value []byte) error {
 	case base.InternalKeyKindRangeKeyDelete,
 		base.InternalKeyKindRangeKeySet,
 		base.InternalKeyKindRangeKeyUnset:
-		w.err = errors.Errorf(
-			"pebble: range keys must be added via one of the RangeKey* functions")
-		return w.err
+		return w.validationError(errors.Errorf(
+			"pebble: range keys must be added via one of the RangeKey* functions"))
 	}
 	return w.addPoint(key, value)
 }
 
+// WriteAll adds each key/value pair of iter to the table, in iteration order,
+// as Add does, until iter is exhausted. The keys must therefore be in
+// increasing order, and iter must not contain range keys. WriteAll returns
+// the first error encountered, whether from iter or from Add. If
+// ContinueOnValidationError was set, keys that Add rejects are skipped and
+// may be retrieved through TakeValidationErrors. The caller remains
+// responsible for closing iter and the Writer.
+func (w *Writer) WriteAll(iter base.InternalIterator) error {
+	if w.err != nil {
+		return w.err
+	}
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		// A key rejected while ContinueOnValidationError is set is skipped.
+		if err := w.Add(*key, value); err != nil &&
+			(!w.continueOnValidationError || !errors.Is(err, ErrValidation)) {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// MarkNextBlockPinned marks the data block which the next point key added to
+// the table is written to as a pin hint: a hint to readers that the block is
+// hot, and should be kept in the block cache. The offsets of the marked
+// blocks are recorded in the table's pinned blocks meta block, and are
+// returned by Reader.PinnedBlockOffsets. Readers which do not know of the
+// hints ignore them. For example, to mark the block holding the first keys of
+// the table, MarkNextBlockPinned is called before the first key is added.
+func (w *Writer) MarkNextBlockPinned() {
+	w.pinNext = true
+}
+
+// AddWithExpiry adds a point key/value pair to the table, as Add does, and
+// records expiryUnix, the time in seconds since the Unix epoch at which the
+// key expires, in the table's expiries block. The expiration is not recorded
+// if expiryUnix is zero. The expiries block is read through Reader.Expiries,
+// and is ignored by readers which do not know of it, so callers must continue
+// to encode the expiration in the value if such readers need it.
+func (w *Writer) AddWithExpiry(key InternalKey, value []byte, expiryUnix uint64) error {
+	if w.err != nil {
+		return w.err
+	}
+	switch key.Kind() {
+	case InternalKeyKindRangeDelete,
+		base.InternalKeyKindRangeKeyDelete,
+		base.InternalKeyKindRangeKeySet,
+		base.InternalKeyKindRangeKeyUnset:
+		return w.validationError(errors.Errorf(
+			"pebble: expirations may only be added for point keys"))
+	}
+	if err := w.addPoint(key, value); err != nil {
+		return err
+	}
+	if expiryUnix != 0 {
+		w.addExpiry(key, expiryUnix)
+	}
+	return nil
+}
+
+// addExpiry records the expiration time of the point key which was just
+// added.
+func (w *Writer) addExpiry(key InternalKey, expiryUnix uint64) {
+	if w.expiries.restartInterval == 0 {
+		w.expiries.restartInterval = base.DefaultBlockRestartInterval
+	}
+	n := key.Size()
+	if cap(w.expiryKeyBuf) < n {
+		w.expiryKeyBuf = make([]byte, n, 2*n)
+	}
+	w.expiryKeyBuf = w.expiryKeyBuf[:n]
+	key.Encode(w.expiryKeyBuf)
+	var buf [binary.MaxVarintLen64]byte
+	w.expiries.add(InternalKey{UserKey: w.expiryKeyBuf}, buf[:binary.PutUvarint(buf[:], expiryUnix)])
+}
+
+// validationError is used to surface an error that results from a key being
+// rejected before any of the Writer's state has been mutated (e.g. a key added
+// out of order). By default the error is latched in w.err, and all subsequent
+// operations on the Writer will fail. If ContinueOnValidationError was set,
+// the error is returned without being latched, allowing the caller to skip
+// the offending key and continue writing, and, if fewer than
+// MaxValidationErrors errors are retained, is retained until the next call to
+// TakeValidationErrors. In either case the error is marked with ErrValidation.
+func (w *Writer) validationError(err error) error {
+	err = errors.Mark(err, ErrValidation)
+	if !w.continueOnValidationError {
+		w.err = err
+	} else if len(w.validationErrors) < w.maxValidationErrors {
+		w.validationErrors = append(w.validationErrors, err)
+	}
+	return err
+}
+
+// checkPlainCompatKey returns a validation error if a key of the named kind,
+// which the LevelDB table format does not support, is added to a table being
+// written with WriterOptions.PlainCompat.
+func (w *Writer) checkPlainCompatKey(kind string) error {
+	if !w.plainCompat {
+		return nil
+	}
+	return w.validationError(errors.Errorf("pebble: %s not supported with PlainCompat", errors.Safe(kind)))
+}
+
+// checkKeyBounds returns an error if the user key start, or the span of user
+// keys [start, end) if end is non-nil, does not lie within w.keyBounds.
+func (w *Writer) checkKeyBounds(start, end []byte) error {
+	lower, upper := w.keyBounds.Lower, w.keyBounds.Upper
+	if lower != nil && w.compare(start, lower) < 0 {
+		return errors.Errorf("pebble: key %s is below the lower bound %s",
+			w.formatKey(start), w.formatKey(lower))
+	}
+	if upper == nil {
+		return nil
+	}
+	if end == nil {
+		if w.compare(start, upper) >= 0 {
+			return errors.Errorf("pebble: key %s is not below the upper bound %s",
+				w.formatKey(start), w.formatKey(upper))
+		}
+	} else if w.compare(end, upper) > 0 {
+		return errors.Errorf("pebble: end key %s is above the upper bound %s",
+			w.formatKey(end), w.formatKey(upper))
+	}
+	return nil
+}
+
+// validateKeys returns an error if w.keyValidator rejects the user key start,
+// or end if it is non-nil.
+func (w *Writer) validateKeys(start, end []byte) error {
+	if w.keyValidator == nil {
+		return nil
+	}
+	for _, k := range [2][]byte{start, end} {
+		if k == nil {
+			continue
+		}
+		if err := w.keyValidator(k); err != nil {
+			return errors.Wrapf(err, "pebble: invalid key %s", w.formatKey(k))
+		}
+	}
+	return nil
+}
+
 func (w *Writer) addPoint(key InternalKey, value []byte) error {
+	if w.keyBounds.Lower != nil || w.keyBounds.Upper != nil {
+		if err := w.checkKeyBounds(key.UserKey, nil); err != nil {
+			return w.validationError(err)
+		}
+	}
+	if err := w.validateKeys(key.UserKey, nil); err != nil {
+		return w.validationError(err)
+	}
 	if !w.disableKeyOrderChecks && w.dataBlockBuf.dataBlock.nEntries >= 1 {
 		// curKey is guaranteed to be the last point key which was added to the Writer.
 		// Inlining base.DecodeInternalKey has a 2-3% improve in the BenchmarkWriter
@@ -709,13 +1175,18 @@ func (w *Writer) addPoint(key InternalKey, value []byte) error {
 			// versions show this to not be a performance win.
 			x := w.compare(largestPointKey.UserKey, key.UserKey)
 			if x > 0 || (x == 0 && largestPointKey.Trailer <= key.Trailer) {
-				w.err = errors.Errorf("pebble: keys must be added in strictly increasing order: %s, %s",
-					largestPointKey.Pretty(w.formatKey), key.Pretty(w.formatKey))
-				return w.err
+				return w.validationError(errors.Errorf(
+					"pebble: keys must be added in strictly increasing order: %s, %s",
+					largestPointKey.Pretty(w.formatKey), key.Pretty(w.formatKey)))
 			}
 		}
 	}
+	return w.addValidatedPoint(key, value)
+}
 
+// addValidatedPoint adds a point key that has already been validated by
+// addPoint's key bounds and ordering checks.
+func (w *Writer) addValidatedPoint(key InternalKey, value []byte) error {
 	if err := w.maybeFlush(key, value); err != nil {
 		return err
 	}
@@ -732,8 +1203,36 @@ func (w *Writer) addPoint(key InternalKey, value []byte) error {
 			return err
 		}
 	}
+	for i := range w.blockPropShadows {
+		if err := w.blockPropShadows[i].Add(key, value); err != nil {
+			w.err = err
+			return err
+		}
+	}
 
+	if w.suffixStats != nil {
+		w.suffixStats.addPoint(key)
+	}
+	if w.sizeDistribution != nil {
+		w.sizeDistribution.addPoint(len(key.UserKey), len(value))
+	}
+	if w.seqNums != nil {
+		w.seqNums.addPoint(key.SeqNum())
+	}
 	w.maybeAddToFilter(key.UserKey)
+	if w.firstBytes {
+		w.dataBlockBuf.addFirstByte(key.UserKey)
+	}
+	if w.pinNext {
+		w.dataBlockBuf.pinned = true
+		w.pinNext = false
+	}
+	if w.adaptiveRestartInterval && w.dataBlockBuf.dataBlock.nEntries > 0 {
+		prevKey := w.dataBlockBuf.dataBlock.curKey
+		prevKey = prevKey[:len(prevKey)-base.InternalTrailerLen]
+		w.blockSharedPrefixLen += base.SharedPrefixLen(prevKey, key.UserKey)
+		w.blockUserKeyLen += len(key.UserKey)
+	}
 	w.dataBlockBuf.dataBlock.add(key, value)
 
 	w.meta.updateSeqNum(key.SeqNum())
@@ -752,9 +1251,13 @@ func (w *Writer) addPoint(key InternalKey, value []byte) error {
 	}
 
 	w.props.NumEntries++
+	w.props.PresentKeyKinds |= 1 << key.Kind()
 	switch key.Kind() {
 	case InternalKeyKindDelete:
 		w.props.NumDeletions++
+		w.blockTombstones.tombstones++
+	case base.InternalKeyKindSingleDelete:
+		w.blockTombstones.tombstones++
 	case InternalKeyKindMerge:
 		w.props.NumMergeOperands++
 	}
@@ -763,6 +1266,135 @@ func (w *Writer) addPoint(key InternalKey, value []byte) error {
 	return nil
 }
 
+// blockTombstoneStats accumulates the fraction of each data block's entries
+// that are point tombstones.
+type blockTombstoneStats struct {
+	// tombstones is the number of point tombstones in the current data block.
+	tombstones  int
+	numBlocks   int
+	sumFraction float64
+	maxFraction float64
+}
+
+// finishBlock is called when the current data block, holding nEntries
+// entries, is finished.
+func (s *blockTombstoneStats) finishBlock(nEntries int) {
+	if nEntries == 0 {
+		return
+	}
+	f := float64(s.tombstones) / float64(nEntries)
+	s.numBlocks++
+	s.sumFraction += f
+	if f > s.maxFraction {
+		s.maxFraction = f
+	}
+	s.tombstones = 0
+}
+
+func (s *blockTombstoneStats) meanFraction() float64 {
+	if s.numBlocks == 0 {
+		return 0
+	}
+	return s.sumFraction / float64(s.numBlocks)
+}
+
+// updateMaxRestartSpan is called when the current data block is finished.
+func (w *Writer) updateMaxRestartSpan() {
+	if n := w.dataBlockBuf.dataBlock.maxRestartSpan(); n > w.maxRestartSpan {
+		w.maxRestartSpan = n
+	}
+}
+
+// writerDiagnostics holds the state of the WriterOptions which are intended
+// for testing and diagnosing the Writer rather than for production use. It is
+// embedded in Writer.
+type writerDiagnostics struct {
+	// See checkBlock.
+	selfCheckBlocks bool
+	// firstBlockEntryCount is reset to zero once the first data block has
+	// been flushed.
+	firstBlockEntryCount int
+	fixedBlockEntryCount int
+	// minDataBlocks is decremented each time a data block is flushed.
+	minDataBlocks             int
+	validateBoundsConsistency bool
+	// blockPropShadows holds a second instance of each of the
+	// blockPropCollectors if WriterOptions.VerifyCollectorDeterminism is set.
+	// Each shadow is passed the same calls as its collector, and the data block
+	// properties of the two are compared.
+	blockPropShadows   []BlockPropertyCollector
+	blockPropShadowBuf []byte
+	// flushTimes is non-nil if WriterOptions.RecordFlushTimes is set, and
+	// compressionTimes if WriterOptions.RecordCompressionTimes is set.
+	flushTimes       *flushTimingStats
+	compressionTimes *compressionTimingStats
+}
+
+// flushTimingStats records the time taken to flush the first data block and
+// the intervals between subsequent flushes.
+type flushTimingStats struct {
+	// created is the time at which the Writer was created, and last the time
+	// at which the last data block was flushed.
+	created time.Time
+	last    time.Time
+	flushes uint64
+	first   time.Duration
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+}
+
+// compressDataBlock compresses and checksums the finished current data block,
+// timing the compression if WriterOptions.RecordCompressionTimes is set.
+func (w *Writer) compressDataBlock() {
+	if w.compressionTimes == nil {
+		w.dataBlockBuf.compressAndChecksum(w.compression)
+		return
+	}
+	start := time.Now()
+	w.dataBlockBuf.compressAndChecksum(w.compression)
+	w.compressionTimes.record(time.Since(start))
+}
+
+// compressionTimingStats records the time taken to compress each data block.
+type compressionTimingStats struct {
+	blocks uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func (s *compressionTimingStats) record(d time.Duration) {
+	s.blocks++
+	s.sum += d
+	if d > s.max {
+		s.max = d
+	}
+}
+
+func (s *compressionTimingStats) mean() time.Duration {
+	if s.blocks == 0 {
+		return 0
+	}
+	return s.sum / time.Duration(s.blocks)
+}
+
+func (s *flushTimingStats) recordFlush(now time.Time) {
+	s.flushes++
+	if s.flushes == 1 {
+		s.first = now.Sub(s.created)
+	} else {
+		d := now.Sub(s.last)
+		s.sum += d
+		if s.flushes == 2 || d < s.min {
+			s.min = d
+		}
+		if d > s.max {
+			s.max = d
+		}
+	}
+	s.last = now
+}
+
 func (w *Writer) prettyTombstone(k InternalKey, value []byte) fmt.Formatter {
 	return keyspan.Span{
 		Start: k.UserKey,
@@ -772,42 +1404,48 @@ func (w *Writer) prettyTombstone(k InternalKey, value []byte) fmt.Formatter {
 }
 
 func (w *Writer) addTombstone(key InternalKey, value []byte) error {
-	if !w.disableKeyOrderChecks && !w.rangeDelV1Format && w.rangeDelBlock.nEntries > 0 {
+	if err := w.checkPlainCompatKey("range deletions"); err != nil {
+		return err
+	}
+	if err := w.checkKeyBounds(key.UserKey, value); err != nil {
+		return w.validationError(err)
+	}
+	if err := w.validateKeys(key.UserKey, value); err != nil {
+		return w.validationError(err)
+	}
+	if prevKey, prevValue, ok := w.lastTombstone(); ok && !w.disableKeyOrderChecks && !w.rangeDelV1Format {
 		// Check that tombstones are being added in fragmented order. If the two
 		// tombstones overlap, their start and end keys must be identical.
-		prevKey := base.DecodeInternalKey(w.rangeDelBlock.curKey)
 		switch c := w.compare(prevKey.UserKey, key.UserKey); {
 		case c > 0:
-			w.err = errors.Errorf("pebble: keys must be added in order: %s, %s",
-				prevKey.Pretty(w.formatKey), key.Pretty(w.formatKey))
-			return w.err
+			return w.validationError(errors.Errorf(
+				"pebble: keys must be added in order: %s, %s",
+				prevKey.Pretty(w.formatKey), key.Pretty(w.formatKey)))
 		case c == 0:
-			prevValue := w.rangeDelBlock.curValue
 			if w.compare(prevValue, value) != 0 {
-				w.err = errors.Errorf("pebble: overlapping tombstones must be fragmented: %s vs %s",
+				return w.validationError(errors.Errorf(
+					"pebble: overlapping tombstones must be fragmented: %s vs %s",
 					w.prettyTombstone(prevKey, prevValue),
-					w.prettyTombstone(key, value))
-				return w.err
+					w.prettyTombstone(key, value)))
 			}
 			if prevKey.SeqNum() <= key.SeqNum() {
-				w.err = errors.Errorf("pebble: keys must be added in strictly increasing order: %s, %s",
-					prevKey.Pretty(w.formatKey), key.Pretty(w.formatKey))
-				return w.err
+				return w.validationError(errors.Errorf(
+					"pebble: keys must be added in strictly increasing order: %s, %s",
+					prevKey.Pretty(w.formatKey), key.Pretty(w.formatKey)))
 			}
 		default:
-			prevValue := w.rangeDelBlock.curValue
 			if w.compare(prevValue, key.UserKey) > 0 {
-				w.err = errors.Errorf("pebble: overlapping tombstones must be fragmented: %s vs %s",
+				return w.validationError(errors.Errorf(
+					"pebble: overlapping tombstones must be fragmented: %s vs %s",
 					w.prettyTombstone(prevKey, prevValue),
-					w.prettyTombstone(key, value))
-				return w.err
+					w.prettyTombstone(key, value)))
 			}
 		}
 	}
 
 	if key.Trailer == InternalKeyRangeDeleteSentinel {
-		w.err = errors.Errorf("pebble: cannot add range delete sentinel: %s", key.Pretty(w.formatKey))
-		return w.err
+		return w.validationError(errors.Errorf(
+			"pebble: cannot add range delete sentinel: %s", key.Pretty(w.formatKey)))
 	}
 
 	for i := range w.propCollectors {
@@ -839,23 +1477,43 @@ func (w *Writer) addTombstone(key InternalKey, value []byte) error {
 			}
 		}
 
-	default:
+	case w.rangeDelCoalescer != nil:
+		// The tombstone is written by writeTombstone once it has been
+		// coalesced with any adjacent tombstones.
+		w.rangeDelCoalescer.add(key, value)
+		return nil
+	}
+	w.writeTombstone(key, value)
+	return nil
+}
+
+// lastTombstone returns the last range tombstone added, if any.
+func (w *Writer) lastTombstone() (key InternalKey, value []byte, ok bool) {
+	if w.rangeDelCoalescer != nil {
+		return w.rangeDelCoalescer.last()
+	}
+	if w.rangeDelBlock.nEntries == 0 {
+		return InternalKey{}, nil, false
+	}
+	return base.DecodeInternalKey(w.rangeDelBlock.curKey), w.rangeDelBlock.curValue, true
+}
+
+// writeTombstone adds a range tombstone to the range-del block.
+func (w *Writer) writeTombstone(key InternalKey, value []byte) {
+	if !w.rangeDelV1Format && w.props.NumRangeDeletions == 0 {
 		// Range tombstones are fragmented in the v2 range deletion block format,
 		// so the start key of the first range tombstone added will be the smallest
 		// range tombstone key. The largest range tombstone key will be determined
 		// in Writer.Close() as the end key of the last range tombstone added.
-		if w.props.NumRangeDeletions == 0 {
-			w.meta.SetSmallestRangeDelKey(key.Clone())
-		}
+		w.meta.SetSmallestRangeDelKey(key.Clone())
 	}
-
 	w.props.NumEntries++
 	w.props.NumDeletions++
 	w.props.NumRangeDeletions++
+	w.props.PresentKeyKinds |= 1 << InternalKeyKindRangeDelete
 	w.props.RawKeySize += uint64(key.Size())
 	w.props.RawValueSize += uint64(len(value))
 	w.rangeDelBlock.add(key, value)
-	return nil
 }
 
 // RangeKeySet sets a range between start (inclusive) and end (exclusive) with
@@ -922,19 +1580,89 @@ func (w *Writer) AddRangeKey(key InternalKey, value []byte) error {
 	if w.err != nil {
 		return w.err
 	}
+	if err := w.checkPlainCompatKey("range keys"); err != nil {
+		return err
+	}
+	// An invalid end key is reported by addRangeKey.
+	if end, _, ok := rangekey.DecodeEndKey(key.Kind(), value); ok {
+		if err := w.checkKeyBounds(key.UserKey, end); err != nil {
+			return w.validationError(err)
+		}
+		if err := w.validateKeys(key.UserKey, end); err != nil {
+			return w.validationError(err)
+		}
+	}
 	return w.addRangeKey(key, value)
 }
 
 func (w *Writer) addRangeKeySpan(span keyspan.Span) error {
+	if err := w.checkPlainCompatKey("range keys"); err != nil {
+		return err
+	}
+	if err := w.checkKeyBounds(span.Start, span.End); err != nil {
+		return w.validationError(err)
+	}
+	if err := w.validateKeys(span.Start, span.End); err != nil {
+		return w.validationError(err)
+	}
+	if w.bufferRangeKeys {
+		if w.maxBufferedRangeKeys > 0 && len(w.bufferedRangeKeys) >= w.maxBufferedRangeKeys {
+			w.err = errors.Errorf("pebble: more than %d range key spans buffered", w.maxBufferedRangeKeys)
+			return w.err
+		}
+		// The span's bounds and keys are allocated by tempRangeKeyCopy, and so
+		// remain valid for the lifetime of the Writer.
+		w.bufferedRangeKeys = append(w.bufferedRangeKeys, span)
+		return nil
+	}
+	return w.fragmentRangeKeySpan(span)
+}
+
+// fragmentRangeKeySpan adds a span, which must not start before any span
+// previously added, to the range key fragmenter.
+func (w *Writer) fragmentRangeKeySpan(span keyspan.Span) error {
 	if w.fragmenter.Start() != nil && w.compare(w.fragmenter.Start(), span.Start) > 0 {
-		return errors.Errorf("pebble: spans must be added in order: %s > %s",
-			w.formatKey(w.fragmenter.Start()), w.formatKey(span.Start))
+		return w.validationError(errors.Errorf("pebble: spans must be added in order: %s > %s",
+			w.formatKey(w.fragmenter.Start()), w.formatKey(span.Start)))
+	}
+	if w.requirePreFragmentedRangeKeys {
+		if w.lastRangeKeySpanEnd != nil && w.compare(span.Start, w.lastRangeKeySpanEnd) < 0 &&
+			(w.compare(span.Start, w.lastRangeKeySpanStart) != 0 ||
+				w.compare(span.End, w.lastRangeKeySpanEnd) != 0) {
+			return w.validationError(errors.Errorf(
+				"pebble: overlapping range keys must be fragmented: [%s, %s), [%s, %s)",
+				w.formatKey(w.lastRangeKeySpanStart), w.formatKey(w.lastRangeKeySpanEnd),
+				w.formatKey(span.Start), w.formatKey(span.End)))
+		}
+		// The span's bounds are allocated by tempRangeKeyCopy, and so remain
+		// valid for the lifetime of the Writer.
+		w.lastRangeKeySpanStart, w.lastRangeKeySpanEnd = span.Start, span.End
 	}
 	// Add this span to the fragmenter.
 	w.fragmenter.Add(span)
 	return w.err
 }
 
+// fragmentBufferedRangeKeys sorts the buffered range key spans by start key,
+// and adds them to the fragmenter. See WriterOptions.BufferAndSortRangeKeys.
+func (w *Writer) fragmentBufferedRangeKeys() error {
+	spans := w.bufferedRangeKeys
+	// The sort is stable so that spans with the same start key are fragmented
+	// in the order in which they were added.
+	sort.SliceStable(spans, func(i, j int) bool {
+		return w.compare(spans[i].Start, spans[j].Start) < 0
+	})
+	for i := range spans {
+		// A span rejected with ContinueOnValidationError set is skipped.
+		_ = w.fragmentRangeKeySpan(spans[i])
+		if w.err != nil {
+			return w.err
+		}
+	}
+	w.bufferedRangeKeys = nil
+	return nil
+}
+
 func (w *Writer) coalesceSpans(span keyspan.Span) {
 	// This method is the emit function of the Fragmenter, so span.Keys is only
 	// owned by this span and it's safe to mutate.
@@ -965,27 +1693,25 @@ func (w *Writer) addRangeKey(key InternalKey, value []byte) error {
 		curStartKey := key
 		curEndKey, _, ok := rangekey.DecodeEndKey(curStartKey.Kind(), value)
 		if !ok {
-			w.err = errors.Errorf("pebble: invalid end key for span: %s",
-				curStartKey.Pretty(w.formatKey))
-			return w.err
+			return w.validationError(errors.Errorf("pebble: invalid end key for span: %s",
+				curStartKey.Pretty(w.formatKey)))
 		}
 
 		// Start keys must be strictly increasing.
 		if base.InternalCompare(w.compare, prevStartKey, curStartKey) >= 0 {
-			w.err = errors.Errorf(
+			return w.validationError(errors.Errorf(
 				"pebble: range keys starts must be added in increasing order: %s, %s",
-				prevStartKey.Pretty(w.formatKey), key.Pretty(w.formatKey))
-			return w.err
+				prevStartKey.Pretty(w.formatKey), key.Pretty(w.formatKey)))
 		}
 
 		// Start keys are increasing. If the start user keys are equal, the
 		// end keys must be equal (i.e. aligned spans).
 		if w.compare(prevStartKey.UserKey, curStartKey.UserKey) == 0 {
 			if w.compare(prevEndKey, curEndKey) != 0 {
-				w.err = errors.Errorf("pebble: overlapping range keys must be fragmented: %s, %s",
+				return w.validationError(errors.Errorf(
+					"pebble: overlapping range keys must be fragmented: %s, %s",
 					prevStartKey.Pretty(w.formatKey),
-					curStartKey.Pretty(w.formatKey))
-				return w.err
+					curStartKey.Pretty(w.formatKey)))
 			}
 		} else if w.compare(prevEndKey, curStartKey.UserKey) > 0 {
 			// If the start user keys are NOT equal, the spans must be disjoint (i.e.
@@ -993,10 +1719,10 @@ func (w *Writer) addRangeKey(key InternalKey, value []byte) error {
 			// NOTE: the inequality excludes zero, as we allow the end key of the
 			// lower span be the same as the start key of the upper span, because
 			// the range end key is considered an exclusive bound.
-			w.err = errors.Errorf("pebble: overlapping range keys must be fragmented: %s, %s",
+			return w.validationError(errors.Errorf(
+				"pebble: overlapping range keys must be fragmented: %s, %s",
 				prevStartKey.Pretty(w.formatKey),
-				curStartKey.Pretty(w.formatKey))
-			return w.err
+				curStartKey.Pretty(w.formatKey)))
 		}
 	}
 
@@ -1019,6 +1745,7 @@ func (w *Writer) addRangeKey(key InternalKey, value []byte) error {
 	// Update block properties.
 	w.props.RawRangeKeyKeySize += uint64(key.Size())
 	w.props.RawRangeKeyValueSize += uint64(len(value))
+	w.props.PresentKeyKinds |= 1 << key.Kind()
 	switch key.Kind() {
 	case base.InternalKeyKindRangeKeyDelete:
 		w.props.NumRangeKeyDels++
@@ -1032,6 +1759,19 @@ func (w *Writer) addRangeKey(key InternalKey, value []byte) error {
 
 	for i := range w.blockPropCollectors {
 		if err := w.blockPropCollectors[i].Add(key, value); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	for i := range w.blockPropShadows {
+		if err := w.blockPropShadows[i].Add(key, value); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	if w.suffixStats != nil {
+		if err := w.suffixStats.addRangeKey(key, value); err != nil {
+			w.err = err
 			return err
 		}
 	}
@@ -1073,14 +1813,35 @@ func (w *Writer) tempRangeKeyCopy(k []byte) []byte {
 func (w *Writer) maybeAddToFilter(key []byte) {
 	if w.filter != nil {
 		if w.split != nil {
+			// Keys sharing a prefix are added consecutively, so each distinct
+			// prefix is added to the filter, and counted, once. The filter
+			// writer's own deduplication of consecutive identical keys is
+			// defeated by interleaving whole keys with the prefixes, and may
+			// not be performed by every FilterPolicy.
 			prefix := key[:w.split(key)]
-			w.filter.addKey(prefix)
+			if !w.lastFilterPrefixSet || !bytes.Equal(w.lastFilterPrefix, prefix) {
+				w.addFilterKey(prefix)
+				w.lastFilterPrefix = append(w.lastFilterPrefix[:0], prefix...)
+				w.lastFilterPrefixSet = true
+				w.props.NumFilterPrefixes++
+			}
+			if w.filterWholeKeys && len(prefix) < len(key) {
+				w.addFilterKey(key)
+			}
 		} else {
-			w.filter.addKey(key)
+			w.addFilterKey(key)
 		}
 	}
 }
 
+func (w *Writer) addFilterKey(key []byte) {
+	if w.filterKeyTransform != nil {
+		w.filterKeyBuf = w.filterKeyTransform.Transform(key, w.filterKeyBuf[:0])
+		key = w.filterKeyBuf
+	}
+	w.filter.addKey(key)
+}
+
 func (w *Writer) flush(key InternalKey) error {
 	estimatedUncompressedSize := w.dataBlockBuf.dataBlock.estimatedSize()
 	w.coordination.sizeEstimate.addInflightDataBlock(estimatedUncompressedSize)
@@ -1093,8 +1854,11 @@ func (w *Writer) flush(key InternalKey) error {
 		return err
 	}
 
+	w.totalRestartPoints += uint64(w.dataBlockBuf.dataBlock.numRestarts())
+	w.updateMaxRestartSpan()
+	w.blockTombstones.finishBlock(w.dataBlockBuf.dataBlock.nEntries)
 	w.dataBlockBuf.finish()
-	w.dataBlockBuf.compressAndChecksum(w.compression)
+	w.compressDataBlock()
 
 	// Determine if the index block should be flushed. Since we're accessing the
 	// dataBlockBuf.dataBlock.curKey here, we have to make sure that once we start
@@ -1118,6 +1882,7 @@ func (w *Writer) flush(key InternalKey) error {
 	var indexProps []byte
 	var flushableIndexBlock *indexBlockBuf
 	if shouldFlushIndexBlock {
+		w.indexBlockFlushed = true
 		flushableIndexBlock = w.indexBlock
 		w.indexBlock = newIndexBlockBuf(w.coordination.parallelismEnabled)
 		// Call BlockPropertyCollector.FinishIndexBlock, since we've decided to
@@ -1156,26 +1921,131 @@ func (w *Writer) flush(key InternalKey) error {
 	} else {
 		err = w.coordination.writeQueue.addSync(writeTask)
 	}
-	w.dataBlockBuf = newDataBlockBuf(w.restartInterval, w.checksumType)
+	w.dataBlockBuf = newDataBlockBuf(w.dataBlockRestartInterval(), w.checksumType)
 
 	return err
 }
 
+// addDataBlockHash records the hash of the uncompressed contents of the data
+// block written at bh, if WriterOptions.DataBlockHash is set.
+func (w *Writer) addDataBlockHash(bh BlockHandle, uncompressed []byte) {
+	if w.blockHash == nil {
+		return
+	}
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], bh.Offset)
+	w.blockHash.Reset()
+	_, _ = w.blockHash.Write(uncompressed)
+	w.blockHashBuf = w.blockHash.Sum(w.blockHashBuf[:0])
+	w.blockHashes.add(InternalKey{UserKey: key[:]}, w.blockHashBuf)
+}
+
+// addDataBlockFirstBytes records the range of first bytes of the user keys of
+// the data block written at bh from buf, if
+// WriterOptions.DataBlockFirstByteRanges is set.
+func (w *Writer) addDataBlockFirstBytes(bh BlockHandle, buf *dataBlockBuf) {
+	if !w.firstBytes || !buf.hasFirstByte {
+		return
+	}
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], bh.Offset)
+	w.firstByteRanges.add(InternalKey{UserKey: key[:]}, []byte{buf.minFirstByte, buf.maxFirstByte})
+}
+
+// addPinnedDataBlock records the offset of the data block written at bh from
+// buf if the block was marked as pinned.
+func (w *Writer) addPinnedDataBlock(bh BlockHandle, buf *dataBlockBuf) {
+	if !buf.pinned {
+		return
+	}
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], bh.Offset)
+	w.pinnedBlocks.add(InternalKey{UserKey: key[:]}, nil)
+}
+
+// dataBlockRestartInterval returns the restart interval to use for the next
+// data block. If adaptiveRestartInterval is set, the interval is chosen
+// according to the shared prefix lengths of the keys of the data block which
+// was just flushed, and the accumulated lengths are reset.
+func (w *Writer) dataBlockRestartInterval() int {
+	if !w.adaptiveRestartInterval {
+		return w.restartInterval
+	}
+	shared, total := w.blockSharedPrefixLen, w.blockUserKeyLen
+	w.blockSharedPrefixLen, w.blockUserKeyLen = 0, 0
+	switch {
+	case total == 0:
+		return w.restartInterval
+	case 4*shared >= 3*total:
+		return 2 * w.restartInterval
+	case 4*shared < total && w.restartInterval > 1:
+		return w.restartInterval / 2
+	}
+	return w.restartInterval
+}
+
 func (w *Writer) maybeFlush(key InternalKey, value []byte) error {
-	if !w.dataBlockBuf.shouldFlush(key, len(value), w.blockSize, w.blockSizeThreshold) {
+	if w.firstBlockEntryCount > 0 {
+		if w.dataBlockBuf.dataBlock.nEntries < w.firstBlockEntryCount {
+			return nil
+		}
+		w.firstBlockEntryCount = 0
+	} else if w.minDataBlocks > 1 {
+		// Flush every non-empty data block until all but the last of the
+		// minimum number of data blocks have been flushed.
+		if w.dataBlockBuf.dataBlock.nEntries == 0 {
+			return nil
+		}
+	} else if w.fixedBlockEntryCount > 0 {
+		if w.dataBlockBuf.dataBlock.nEntries < w.fixedBlockEntryCount {
+			return nil
+		}
+	} else if !w.dataBlockBuf.shouldFlush(key, len(value), w.blockSize, w.blockSizeThreshold) &&
+		!w.shouldFlushForPart(key, len(value)) {
 		return nil
 	}
 
+	if err := w.checkContext(); err != nil {
+		w.err = err
+		return err
+	}
+
 	err := w.flush(key)
 
 	if err != nil {
 		w.err = err
 		return err
 	}
+	if w.minDataBlocks > 0 {
+		w.minDataBlocks--
+	}
+	if w.flushTimes != nil {
+		w.flushTimes.recordFlush(time.Now())
+	}
 
 	return nil
 }
 
+// shouldFlushForPart returns true if the current data block should be flushed
+// before the given entry is added to it, so that the block ends just before,
+// rather than straddles, the next multipart part boundary. See
+// WriterOptions.MultipartPartSize.
+func (w *Writer) shouldFlushForPart(key InternalKey, valueLen int) bool {
+	if w.multipartPartSize == 0 || w.dataBlockBuf.dataBlock.nEntries == 0 {
+		return false
+	}
+	// The space left in the current part for the remainder of the block and
+	// its trailer.
+	start := w.coordination.sizeEstimate.size()
+	room := int(w.multipartPartSize-start%w.multipartPartSize) - blockTrailerLen
+	if room >= w.blockSize || w.dataBlockBuf.dataBlock.estimatedSize() >= room {
+		// The block will be flushed before reaching the boundary anyway, or
+		// already straddles it.
+		return false
+	}
+	return w.dataBlockBuf.shouldFlush(key, valueLen, room, 0)
+}
+
 // dataBlockBuf.dataBlockProps set by this method must be encoded before any future use of the
 // dataBlockBuf.blockPropsEncoder, since the properties slice will get reused by the
 // blockPropsEncoder.
@@ -1190,6 +2060,12 @@ func (w *Writer) finishDataBlockProps(buf *dataBlockBuf) error {
 		if scratch, err = w.blockPropCollectors[i].FinishDataBlock(scratch); err != nil {
 			return err
 		}
+		if w.blockPropShadows != nil {
+			if err := w.verifyDataBlockProp(i, scratch); err != nil {
+				return err
+			}
+		}
+		w.blockPropSizes[i] += uint64(len(scratch))
 		if len(scratch) > 0 {
 			buf.blockPropsEncoder.addProp(shortID(i), scratch)
 		}
@@ -1199,6 +2075,23 @@ func (w *Writer) finishDataBlockProps(buf *dataBlockBuf) error {
 	return nil
 }
 
+// verifyDataBlockProp finishes the data block of the shadow of the i-th block
+// property collector, and returns an error if its property differs from prop,
+// the property returned by the collector itself.
+func (w *Writer) verifyDataBlockProp(i int, prop []byte) error {
+	var err error
+	w.blockPropShadowBuf, err = w.blockPropShadows[i].FinishDataBlock(w.blockPropShadowBuf[:0])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(prop, w.blockPropShadowBuf) {
+		return errors.Errorf(
+			"pebble: block property collector %s is nondeterministic: data block property %x != %x",
+			errors.Safe(w.blockPropCollectors[i].Name()), prop, w.blockPropShadowBuf)
+	}
+	return nil
+}
+
 // The BlockHandleWithProperties returned by this method must be encoded before any future use of
 // the Writer.blockPropsEncoder, since the properties slice will get reused by the blockPropsEncoder.
 // maybeAddBlockPropertiesToBlockHandle should only be called if block is being written synchronously
@@ -1220,7 +2113,12 @@ func (w *Writer) indexEntrySep(prevKey, key InternalKey, dataBlockBuf *dataBlock
 	}
 
 	var sep InternalKey
-	if key.UserKey == nil && key.Trailer == 0 {
+	if w.fullKeyIndexSeparators {
+		sep = InternalKey{
+			UserKey: append(dataBlockBuf.sepScratch[:0], prevKey.UserKey...),
+			Trailer: prevKey.Trailer,
+		}
+	} else if key.UserKey == nil && key.Trailer == 0 {
 		sep = prevKey.Successor(w.compare, w.successor, dataBlockBuf.sepScratch[:0])
 	} else {
 		sep = prevKey.Separator(w.compare, w.separator, dataBlockBuf.sepScratch[:0], key)
@@ -1268,6 +2166,7 @@ func (w *Writer) addIndexEntry(
 	}
 
 	writeTo.add(sep, encoded, inflightSize)
+	writeTo.dataSize += bhp.Length + blockTrailerLen
 	return nil
 }
 
@@ -1275,6 +2174,9 @@ func (w *Writer) addPrevDataBlockToIndexBlockProps() {
 	for i := range w.blockPropCollectors {
 		w.blockPropCollectors[i].AddPrevDataBlockToIndexBlock()
 	}
+	for i := range w.blockPropShadows {
+		w.blockPropShadows[i].AddPrevDataBlockToIndexBlock()
+	}
 }
 
 // addIndexEntrySync adds an index entry for the specified key and block handle.
@@ -1375,6 +2277,14 @@ func (w *Writer) finishIndexBlockProps() ([]byte, error) {
 		if scratch, err = w.blockPropCollectors[i].FinishIndexBlock(scratch); err != nil {
 			return nil, err
 		}
+		if w.blockPropShadows != nil {
+			// The shadow's index block property is not compared, but the call
+			// keeps its state in step with the collector's.
+			if w.blockPropShadowBuf, err = w.blockPropShadows[i].FinishIndexBlock(w.blockPropShadowBuf[:0]); err != nil {
+				return nil, err
+			}
+		}
+		w.blockPropSizes[i] += uint64(len(scratch))
 		if len(scratch) > 0 {
 			w.blockPropsEncoder.addProp(shortID(i), scratch)
 		}
@@ -1393,7 +2303,7 @@ func (w *Writer) finishIndexBlockProps() ([]byte, error) {
 //    That is, it must be safe to reuse indexBuf after finishIndexBlock has been called.
 func (w *Writer) finishIndexBlock(indexBuf *indexBlockBuf, props []byte) error {
 	part := indexBlockAndBlockProperties{
-		nEntries: indexBuf.block.nEntries, properties: props,
+		nEntries: indexBuf.block.nEntries, dataSize: indexBuf.dataSize, properties: props,
 	}
 	w.indexSepAlloc, part.sep = cloneKeyWithBuf(
 		base.DecodeInternalKey(indexBuf.block.curKey), w.indexSepAlloc,
@@ -1434,6 +2344,9 @@ func (w *Writer) writeTwoLevelIndex() (BlockHandle, error) {
 			BlockHandle: bh,
 			Props:       b.properties,
 		}
+		if w.indexPartitionDataSizes {
+			bhp.Props = appendPartitionDataSize(bhp.Props, w.partitionDataSizeID(), b.dataSize)
+		}
 		encoded := encodeBlockHandleWithProperties(w.blockBuf.tmp[:], bhp)
 		w.topLevelIndexBlock.add(b.sep, encoded)
 	}
@@ -1448,6 +2361,13 @@ func (w *Writer) writeTwoLevelIndex() (BlockHandle, error) {
 	return w.writeBlock(w.topLevelIndexBlock.finish(), w.compression, &w.blockBuf)
 }
 
+// partitionDataSizeID returns the shortID under which the data size of each
+// index partition is recorded: the shortID following those of the block
+// property collectors. See WriterOptions.IndexPartitionDataSizes.
+func (w *Writer) partitionDataSizeID() shortID {
+	return shortID(len(w.blockPropCollectors))
+}
+
 func compressAndChecksum(b []byte, compression Compression, blockBuf *blockBuf) []byte {
 	// Compress the buffer, discarding the result if the improvement isn't at
 	// least 12.5%.
@@ -1470,6 +2390,15 @@ func compressAndChecksum(b []byte, compression Compression, blockBuf *blockBuf)
 }
 
 func (w *Writer) writeCompressedBlock(block []byte, blockTrailerBuf []byte) (BlockHandle, error) {
+	if w.blockAlignment > 0 {
+		if pad := (w.blockAlignment - w.meta.Size%w.blockAlignment) % w.blockAlignment; pad > 0 {
+			n, err := w.writer.Write(w.alignmentPadding[:pad])
+			if err != nil {
+				return BlockHandle{}, err
+			}
+			w.meta.Size += uint64(n)
+		}
+	}
 	bh := BlockHandle{Offset: w.meta.Size, Length: uint64(len(block))}
 
 	if w.cacheID != 0 && w.fileNum != 0 {
@@ -1499,30 +2428,89 @@ func (w *Writer) writeCompressedBlock(block []byte, blockTrailerBuf []byte) (Blo
 func (w *Writer) writeBlock(
 	b []byte, compression Compression, blockBuf *blockBuf,
 ) (BlockHandle, error) {
+	uncompressed := b
 	b = compressAndChecksum(b, compression, blockBuf)
-	return w.writeCompressedBlock(b, blockBuf.tmp[:])
+	bh, err := w.writeCompressedBlock(b, blockBuf.tmp[:])
+	if err == nil && w.selfCheckBlocks {
+		err = w.checkBlock(bh, uncompressed, b, blockBuf.tmp[:])
+	}
+	return bh, err
+}
+
+// checkBlock verifies that the block b, as written at bh along with its
+// trailer, has a valid checksum and decompresses to the uncompressed block it
+// was produced from. It is only called if WriterOptions.SelfCheckBlocks is
+// set, and guards against bugs in the Writer such as the reuse of a buffer
+// before the block it holds is written.
+func (w *Writer) checkBlock(bh BlockHandle, uncompressed, b, trailer []byte) error {
+	buf := make([]byte, len(b)+blockTrailerLen)
+	copy(buf, b)
+	copy(buf[len(b):], trailer[:blockTrailerLen])
+	if err := checkChecksum(w.checksumType, buf, bh, w.fileNum); err != nil {
+		return err
+	}
+	decoded := b
+	if typ := blockType(trailer[0]); typ != noCompressionBlockType {
+		decodedLen, prefixLen, err := decompressedLen(typ, b)
+		if err != nil {
+			return err
+		}
+		decoded, err = decompressInto(typ, b[prefixLen:], make([]byte, decodedLen))
+		if err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(decoded, uncompressed) {
+		return errors.AssertionFailedf(
+			"pebble/table: block at %d/%d does not decompress to the block that was written",
+			errors.Safe(bh.Offset), errors.Safe(bh.Length))
+	}
+	return nil
 }
 
 // assertFormatCompatibility ensures that the features present on the table are
 // compatible with the table format version.
 func (w *Writer) assertFormatCompatibility() error {
-	// PebbleDBv1: block properties.
-	if len(w.blockPropCollectors) > 0 && w.tableFormat < TableFormatPebblev1 {
-		return errors.Newf(
-			"table format version %s is less than the minimum required version %s for block properties",
-			w.tableFormat, TableFormatPebblev1,
-		)
+	features := w.featureFlags()
+	for _, feature := range tableFeatures {
+		if features&feature.flag != 0 && w.tableFormat < feature.minFormat {
+			return errors.Newf(
+				"table format version %s is less than the minimum required version %s for %s",
+				w.tableFormat, feature.minFormat, errors.Safe(feature.name),
+			)
+		}
 	}
+	return nil
+}
 
+// featureFlags returns the table format features used by the table.
+func (w *Writer) featureFlags() FeatureFlags {
+	var f FeatureFlags
+	if w.twoLevelIndex {
+		f |= FeatureTwoLevelIndex
+	}
+	// PebbleDBv1: block properties. The data sizes of index partitions are
+	// encoded as a block property.
+	if len(w.blockPropCollectors) > 0 || (w.indexPartitionDataSizes && w.twoLevelIndex) {
+		f |= FeatureBlockProperties
+	}
+	// PebbleDBv1: compressed properties block. RocksDB expects the properties
+	// block to be uncompressed.
+	if w.compressProperties {
+		f |= FeatureCompressedProperties
+	}
 	// PebbleDBv2: range keys.
-	if w.props.NumRangeKeys() > 0 && w.tableFormat < TableFormatPebblev2 {
-		return errors.Newf(
-			"table format version %s is less than the minimum required version %s for range keys",
-			w.tableFormat, TableFormatPebblev2,
-		)
+	if w.props.NumRangeKeys() > 0 {
+		f |= FeatureRangeKeys
 	}
-
-	return nil
+	// PebbleDBv3: compact footer and tables without point blocks.
+	if w.compactFooter {
+		f |= FeatureCompactFooter
+	}
+	if w.props.NoPointBlocks {
+		f |= FeatureNoPointBlocks
+	}
+	return f
 }
 
 // Close finishes writing the table and closes the underlying file that the
@@ -1532,8 +2520,8 @@ func (w *Writer) Close() (err error) {
 		if w.syncer == nil {
 			return
 		}
-		err1 := w.syncer.Close()
-		if err == nil {
+		if err1 := w.syncer.Close(); err == nil && err1 != nil {
+			w.err = err1
 			err = err1
 		}
 		w.syncer = nil
@@ -1545,6 +2533,9 @@ func (w *Writer) Close() (err error) {
 	if err = w.coordination.writeQueue.finish(); err != nil {
 		w.err = err
 	}
+	if w.err == nil {
+		w.err = w.checkContext()
+	}
 
 	if w.err != nil {
 		return w.err
@@ -1564,14 +2555,31 @@ func (w *Writer) Close() (err error) {
 		w.meta.SetLargestPointKey(base.DecodeInternalKey(w.dataBlockBuf.dataBlock.curKey).Clone())
 	}
 
+	// If there aren't any data blocks at all, the data block and index block
+	// are omitted if requested and the table format supports it.
+	noPointBlocks := w.omitEmptyPointBlocks && w.tableFormat >= TableFormatPebblev3 &&
+		w.dataBlockBuf.dataBlock.nEntries == 0 && w.indexBlock.block.nEntries == 0
+
 	// Finish the last data block, or force an empty data block if there
 	// aren't any data blocks at all.
-	if w.dataBlockBuf.dataBlock.nEntries > 0 || w.indexBlock.block.nEntries == 0 {
-		bh, err := w.writeBlock(w.dataBlockBuf.dataBlock.finish(), w.compression, &w.dataBlockBuf.blockBuf)
+	if !noPointBlocks && (w.dataBlockBuf.dataBlock.nEntries > 0 || w.indexBlock.block.nEntries == 0) {
+		w.totalRestartPoints += uint64(w.dataBlockBuf.dataBlock.numRestarts())
+		w.updateMaxRestartSpan()
+		w.blockTombstones.finishBlock(w.dataBlockBuf.dataBlock.nEntries)
+		w.dataBlockBuf.finish()
+		w.compressDataBlock()
+		uncompressed := w.dataBlockBuf.uncompressed
+		bh, err := w.writeCompressedBlock(w.dataBlockBuf.compressed, w.dataBlockBuf.tmp[:])
+		if err == nil && w.selfCheckBlocks {
+			err = w.checkBlock(bh, uncompressed, w.dataBlockBuf.compressed, w.dataBlockBuf.tmp[:])
+		}
 		if err != nil {
 			w.err = err
 			return w.err
 		}
+		w.addDataBlockHash(bh, uncompressed)
+		w.addDataBlockFirstBytes(bh, w.dataBlockBuf)
+		w.addPinnedDataBlock(bh, w.dataBlockBuf)
 		var bhp BlockHandleWithProperties
 		if bhp, err = w.maybeAddBlockPropertiesToBlockHandle(bh); err != nil {
 			w.err = err
@@ -1586,8 +2594,7 @@ func (w *Writer) Close() (err error) {
 	w.props.DataSize = w.meta.Size
 
 	// Write the filter block.
-	var metaindex rawBlockWriter
-	metaindex.restartInterval = 1
+	var metaindex metaindexBuilder
 	if w.filter != nil {
 		b, err := w.filter.finish()
 		if err != nil {
@@ -1603,10 +2610,23 @@ func (w *Writer) Close() (err error) {
 		metaindex.add(InternalKey{UserKey: []byte(w.filter.metaName())}, w.blockBuf.tmp[:n])
 		w.props.FilterPolicyName = w.filter.policyName()
 		w.props.FilterSize = bh.Length
+		w.meta.FilterFPR = w.filter.estimatedFPR(b)
 	}
 
+	// A table with a single data block below the small table threshold ends
+	// with a compact footer holding its index block inline.
+	w.compactFooter = w.smallTableThreshold > 0 && !noPointBlocks &&
+		!w.twoLevelIndex && w.indexBlock.block.nEntries == 1 &&
+		w.props.DataSize < uint64(w.smallTableThreshold) &&
+		w.tableFormat >= TableFormatPebblev3 &&
+		w.forcedFooterFormat == TableFormatUnspecified
+
 	var indexBH BlockHandle
-	if w.twoLevelIndex {
+	var inlineIndex []byte
+	if noPointBlocks {
+		w.props.IndexType = binarySearchIndex
+		w.props.NoPointBlocks = true
+	} else if w.twoLevelIndex {
 		w.props.IndexType = twoLevelIndex
 		// Write the two level index block.
 		indexBH, err = w.writeTwoLevelIndex()
@@ -1622,17 +2642,27 @@ func (w *Writer) Close() (err error) {
 		w.props.IndexSize = uint64(w.indexBlock.estimatedSize()) + blockTrailerLen
 		w.props.NumDataBlocks = uint64(w.indexBlock.block.nEntries)
 
-		// Write the single level index block.
-		indexBH, err = w.writeBlock(w.indexBlock.finish(), w.compression, &w.blockBuf)
-		if err != nil {
-			w.err = err
-			return w.err
+		if w.compactFooter {
+			// The index block is written as part of the footer, without a
+			// trailer.
+			w.props.IndexSize -= blockTrailerLen
+			inlineIndex = w.indexBlock.finish()
+		} else {
+			// Write the single level index block.
+			indexBH, err = w.writeBlock(w.indexBlock.finish(), w.compression, &w.blockBuf)
+			if err != nil {
+				w.err = err
+				return w.err
+			}
 		}
 	}
 
 	// Write the range-del block. The block handle must added to the meta index block
 	// after the properties block has been written. This is because the entries in the
 	// metaindex block must be sorted by key.
+	if w.rangeDelCoalescer != nil {
+		w.rangeDelCoalescer.finish()
+	}
 	var rangeDelBH BlockHandle
 	if w.props.NumRangeDeletions > 0 {
 		if !w.rangeDelV1Format {
@@ -1656,8 +2686,13 @@ func (w *Writer) Close() (err error) {
 		}
 	}
 
-	// Write the range-key block, flushing any remaining spans from the
-	// fragmenter first.
+	// Write the range-key block, flushing any buffered spans to the fragmenter,
+	// and any remaining spans from the fragmenter, first.
+	if w.bufferRangeKeys {
+		if err := w.fragmentBufferedRangeKeys(); err != nil {
+			return err
+		}
+	}
 	w.fragmenter.Finish()
 
 	var rangeKeyBH BlockHandle
@@ -1681,6 +2716,77 @@ func (w *Writer) Close() (err error) {
 		}
 	}
 
+	if w.validateBoundsConsistency {
+		if err := w.checkBoundsConsistency(); err != nil {
+			w.err = err
+			return w.err
+		}
+	}
+	if w.expectedRangeDelBounds != nil && w.meta.HasRangeDelKeys {
+		if err := w.checkExpectedRangeDelBounds(); err != nil {
+			w.err = err
+			return w.err
+		}
+	}
+	if w.keyRangeOverride != nil {
+		if err := w.applyKeyRangeOverride(); err != nil {
+			w.err = err
+			return w.err
+		}
+	}
+
+	// Write the block hashes, and add their handle to the metaindex block. The
+	// block hashes name sorts after the filter name and before the other block
+	// names.
+	if w.blockHash != nil {
+		bh, err := w.writeBlock(w.blockHashes.finish(), NoCompression, &w.blockBuf)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.blockBuf.tmp[:], bh)
+		metaindex.add(InternalKey{UserKey: []byte(metaBlockHashesName)}, w.blockBuf.tmp[:n])
+	}
+
+	// Write the expiries, and add their handle to the metaindex block. The
+	// expiries name sorts after the block hashes name and before the range key
+	// block name.
+	if w.expiries.nEntries > 0 {
+		bh, err := w.writeBlock(w.expiries.finish(), NoCompression, &w.blockBuf)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.blockBuf.tmp[:], bh)
+		metaindex.add(InternalKey{UserKey: []byte(metaExpiriesName)}, w.blockBuf.tmp[:n])
+	}
+
+	// Write the first byte ranges, and add their handle to the metaindex block.
+	// The first bytes name sorts after the expiries name and before the range
+	// key block name.
+	if w.firstByteRanges.nEntries > 0 {
+		bh, err := w.writeBlock(w.firstByteRanges.finish(), NoCompression, &w.blockBuf)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.blockBuf.tmp[:], bh)
+		metaindex.add(InternalKey{UserKey: []byte(metaFirstBytesName)}, w.blockBuf.tmp[:n])
+	}
+
+	// Write the offsets of the pinned data blocks, and add their handle to the
+	// metaindex block. The pinned blocks name sorts after the first bytes name
+	// and before the range key block name.
+	if w.pinnedBlocks.nEntries > 0 {
+		bh, err := w.writeBlock(w.pinnedBlocks.finish(), NoCompression, &w.blockBuf)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.blockBuf.tmp[:], bh)
+		metaindex.add(InternalKey{UserKey: []byte(metaPinnedName)}, w.blockBuf.tmp[:n])
+	}
+
 	// Add the range key block handle to the metaindex block. Note that we add the
 	// block handle to the metaindex block before the other meta blocks as the
 	// metaindex block entries must be sorted, and the range key block name sorts
@@ -1691,12 +2797,34 @@ func (w *Writer) Close() (err error) {
 	}
 
 	{
-		userProps := make(map[string]string)
+		// The user properties of a PropertiesTemplate, if any, are overridden
+		// by those the collectors produce.
+		userProps := make(map[string]string, len(w.props.UserProperties))
+		for k, v := range w.props.UserProperties {
+			userProps[k] = v
+		}
+		// When the size of the user properties is limited, the collector
+		// which produced the largest output is tracked to be named in the
+		// error.
+		var largestCollector string
+		var largestCollectorSize int
+		trackCollector := func(name string, size int) {
+			if size > largestCollectorSize {
+				largestCollector, largestCollectorSize = name, size
+			}
+		}
 		for i := range w.propCollectors {
+			var before int
+			if w.maxUserPropertiesBytes > 0 {
+				before = userPropertiesSize(userProps)
+			}
 			if err := w.propCollectors[i].Finish(userProps); err != nil {
 				w.err = err
 				return err
 			}
+			if w.maxUserPropertiesBytes > 0 {
+				trackCollector(w.propCollectors[i].Name(), userPropertiesSize(userProps)-before)
+			}
 		}
 		for i := range w.blockPropCollectors {
 			scratch := w.blockPropsEncoder.getScratchForProp()
@@ -1708,6 +2836,14 @@ func (w *Writer) Close() (err error) {
 				w.err = err
 				return err
 			}
+			if w.rewriteUserProperty != nil {
+				value, err := w.rewriteUserProperty(w.blockPropCollectors[i].Name(), buf[1:])
+				if err != nil {
+					w.err = err
+					return err
+				}
+				buf = append(buf[:1:1], value...)
+			}
 			var prop string
 			if len(buf) > 0 {
 				prop = string(buf)
@@ -1716,6 +2852,32 @@ func (w *Writer) Close() (err error) {
 			// empty string, since the presence in the map is what indicates
 			// that the block property collector was used when writing.
 			userProps[w.blockPropCollectors[i].Name()] = prop
+			trackCollector(w.blockPropCollectors[i].Name(), len(w.blockPropCollectors[i].Name())+len(prop))
+		}
+		if w.suffixStats != nil {
+			w.suffixStats.finish(userProps)
+		}
+		if w.sizeDistribution != nil {
+			w.sizeDistribution.finish(userProps)
+		}
+		if w.seqNums != nil {
+			w.seqNums.finish(userProps)
+		}
+		if w.indexPartitionDataSizes && w.twoLevelIndex {
+			userProps[IndexPartitionDataSizePropertyName] = string([]byte{byte(w.partitionDataSizeID())})
+		}
+		if w.maxUserPropertiesBytes > 0 {
+			if size := userPropertiesSize(userProps); size > w.maxUserPropertiesBytes {
+				if largestCollector == "" {
+					w.err = errors.Errorf("pebble: user properties of %d bytes exceed MaxUserPropertiesBytes of %d",
+						size, w.maxUserPropertiesBytes)
+				} else {
+					w.err = errors.Errorf("pebble: user properties of %d bytes exceed MaxUserPropertiesBytes of %d; "+
+						"collector %s produced %d bytes",
+						size, w.maxUserPropertiesBytes, errors.Safe(largestCollector), largestCollectorSize)
+				}
+				return w.err
+			}
 		}
 		if len(userProps) > 0 {
 			w.props.UserProperties = userProps
@@ -1728,8 +2890,26 @@ func (w *Writer) Close() (err error) {
 		// reduces table size without a significant impact on performance.
 		raw.restartInterval = propertiesBlockRestartInterval
 		w.props.CompressionOptions = rocksDBCompressionOptions
+		if w.now != nil {
+			w.props.CreationTime = uint64(w.now().Unix())
+		}
+		if w.tableFormat < TableFormatPebblev1 {
+			// Tables in the RocksDB formats are written with the same
+			// properties as RocksDB writes.
+			w.props.NumFilterPrefixes = 0
+			w.props.PresentKeyKinds = 0
+		}
+		if !w.recordPresentKeyKinds {
+			w.props.PresentKeyKinds = 0
+		}
 		w.props.save(&raw)
-		bh, err := w.writeBlock(raw.finish(), NoCompression, &w.blockBuf)
+		// The properties block is not compressed by default, as it is usually
+		// small. Readers determine whether it is compressed from its trailer.
+		compression := NoCompression
+		if w.compressProperties {
+			compression = w.compression
+		}
+		bh, err := w.writeBlock(raw.finish(), compression, &w.blockBuf)
 		if err != nil {
 			w.err = err
 			return w.err
@@ -1756,26 +2936,65 @@ func (w *Writer) Close() (err error) {
 	// policy is nil. NoCompression is specified because a) RocksDB never
 	// compresses the meta-index block and b) RocksDB has some code paths which
 	// expect the meta-index block to not be compressed.
-	metaindexBH, err := w.writeBlock(metaindex.blockWriter.finish(), NoCompression, &w.blockBuf)
-	if err != nil {
-		w.err = err
-		return w.err
+	footer := footer{
+		format:   w.tableFormat,
+		checksum: w.blockBuf.checksummer.checksumType,
+	}
+	var footerBuf []byte
+	if w.compactFooter {
+		// The metaindex and index blocks are written inline in the compact
+		// footer.
+		footer.inlineMetaindex = metaindex.finish(w.customMetaindexEntries)
+		footer.inlineIndex = inlineIndex
+		indexBH.Offset = w.meta.Size + uint64(len(footer.inlineMetaindex))
+		footerBuf = footer.encodeCompact(nil, &w.blockBuf.checksummer)
+	} else {
+		footer.metaindexBH, err = w.writeBlock(metaindex.finish(w.customMetaindexEntries), NoCompression, &w.blockBuf)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		footer.indexBH = indexBH
+		if w.forcedFooterFormat != TableFormatUnspecified {
+			footer.format = w.forcedFooterFormat
+		}
+		footerBuf = footer.encode(w.blockBuf.tmp[:])
 	}
 
-	// Write the table footer.
-	footer := footer{
-		format:      w.tableFormat,
-		checksum:    w.blockBuf.checksummer.checksumType,
-		metaindexBH: metaindexBH,
-		indexBH:     indexBH,
+	// The footer is written once the table has been validated, so that a
+	// rejected table is never left complete on disk, but its length is
+	// already known and is included in the metadata.
+	w.meta.Size += uint64(len(footerBuf))
+	w.meta.Properties = w.props
+	w.meta.TotalRestartPoints = w.totalRestartPoints
+	w.meta.MaxRestartSpan = uint64(w.maxRestartSpan)
+	w.meta.MaxBlockTombstoneFraction = w.blockTombstones.maxFraction
+	w.meta.MeanBlockTombstoneFraction = w.blockTombstones.meanFraction()
+	if w.compressionTimes != nil {
+		w.meta.MaxBlockCompressionTime = w.compressionTimes.max
+		w.meta.MeanBlockCompressionTime = w.compressionTimes.mean()
+	}
+	w.meta.IndexOffset = indexBH.Offset
+	w.meta.FeatureFlags = w.featureFlags()
+	if len(w.blockPropCollectors) > 0 {
+		w.meta.BlockPropertySizes = make(map[string]uint64, len(w.blockPropCollectors))
+		for i := range w.blockPropCollectors {
+			w.meta.BlockPropertySizes[w.blockPropCollectors[i].Name()] += w.blockPropSizes[i]
+		}
 	}
-	var n int
-	if n, err = w.writer.Write(footer.encode(w.blockBuf.tmp[:])); err != nil {
+
+	if w.preFinishValidator != nil {
+		if err := w.preFinishValidator(&w.meta); err != nil {
+			w.err = err
+			return w.err
+		}
+	}
+
+	// Write the table footer.
+	if _, err = w.writer.Write(footerBuf); err != nil {
 		w.err = err
 		return w.err
 	}
-	w.meta.Size += uint64(n)
-	w.meta.Properties = w.props
 
 	// Flush the buffer.
 	if w.bufWriter != nil {
@@ -1787,12 +3006,28 @@ func (w *Writer) Close() (err error) {
 
 	// Check that the features present in the table are compatible with the format
 	// configured for the table.
-	if err = w.assertFormatCompatibility(); err != nil {
-		w.err = err
-		return w.err
+	if w.forcedFooterFormat == TableFormatUnspecified {
+		if err = w.assertFormatCompatibility(); err != nil {
+			w.err = err
+			return w.err
+		}
 	}
 
-	if err := w.syncer.Sync(); err != nil {
+	if w.asyncFinish {
+		// Hand the file off to a goroutine that syncs and closes it. Clearing
+		// w.syncer prevents the deferred close above from closing the file.
+		syncer := w.syncer
+		w.syncer = nil
+		w.durable = make(chan struct{})
+		go func() {
+			err := syncer.Sync()
+			if err1 := syncer.Close(); err == nil {
+				err = err1
+			}
+			w.durableErr = err
+			close(w.durable)
+		}()
+	} else if err := w.syncer.Sync(); err != nil {
 		w.err = err
 		return err
 	}
@@ -1812,6 +3047,115 @@ func (w *Writer) Close() (err error) {
 	return nil
 }
 
+// userPropertiesSize returns the total length of the names and values of the
+// user properties. See WriterOptions.MaxUserPropertiesBytes.
+func userPropertiesSize(userProps map[string]string) int {
+	var n int
+	for k, v := range userProps {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// checkBoundsConsistency returns an error if the table contains both point
+// keys and range keys, and the range keys extend beyond the bounds of the
+// point keys. See WriterOptions.ValidateBoundsConsistency.
+func (w *Writer) checkBoundsConsistency() error {
+	m := &w.meta
+	if !m.HasPointKeys || !m.HasRangeKeys {
+		return nil
+	}
+	if w.compare(m.SmallestRangeKey.UserKey, m.SmallestPoint.UserKey) < 0 {
+		return errors.Errorf("pebble: range key start %s is less than smallest point key %s",
+			w.formatKey(m.SmallestRangeKey.UserKey), w.formatKey(m.SmallestPoint.UserKey))
+	}
+	if w.compare(m.LargestRangeKey.UserKey, m.LargestPoint.UserKey) > 0 {
+		return errors.Errorf("pebble: range key end %s is greater than largest point key %s",
+			w.formatKey(m.LargestRangeKey.UserKey), w.formatKey(m.LargestPoint.UserKey))
+	}
+	return nil
+}
+
+// checkExpectedRangeDelBounds checks that the table's smallest and largest
+// range deletion keys fall within WriterOptions.ExpectedRangeDelBounds.
+func (w *Writer) checkExpectedRangeDelBounds() error {
+	b, m := w.expectedRangeDelBounds, &w.meta
+	if base.InternalCompare(w.compare, b.Smallest, m.SmallestRangeDel) > 0 {
+		return errors.Errorf("pebble: smallest range deletion key %s is less than expected smallest %s",
+			m.SmallestRangeDel.Pretty(w.formatKey), b.Smallest.Pretty(w.formatKey))
+	}
+	if base.InternalCompare(w.compare, b.Largest, m.LargestRangeDel) < 0 {
+		return errors.Errorf("pebble: largest range deletion key %s is greater than expected largest %s",
+			m.LargestRangeDel.Pretty(w.formatKey), b.Largest.Pretty(w.formatKey))
+	}
+	return nil
+}
+
+// applyKeyRangeOverride sets the smallest and largest point keys of the
+// table's metadata to those of the key range override, after checking that
+// the override contains all of the table's keys. See
+// WriterOptions.KeyRangeOverride.
+func (w *Writer) applyKeyRangeOverride() error {
+	o := w.keyRangeOverride
+	if base.InternalCompare(w.compare, o.Smallest, o.Largest) > 0 {
+		return errors.Errorf("pebble: key range override smallest %s is greater than largest %s",
+			o.Smallest.Pretty(w.formatKey), o.Largest.Pretty(w.formatKey))
+	}
+	m := &w.meta
+	check := func(has bool, smallest, largest InternalKey) error {
+		if !has {
+			return nil
+		}
+		if base.InternalCompare(w.compare, o.Smallest, smallest) > 0 {
+			return errors.Errorf("pebble: key range override smallest %s is greater than smallest key %s",
+				o.Smallest.Pretty(w.formatKey), smallest.Pretty(w.formatKey))
+		}
+		if base.InternalCompare(w.compare, o.Largest, largest) < 0 {
+			return errors.Errorf("pebble: key range override largest %s is less than largest key %s",
+				o.Largest.Pretty(w.formatKey), largest.Pretty(w.formatKey))
+		}
+		return nil
+	}
+	if err := check(m.HasPointKeys, m.SmallestPoint, m.LargestPoint); err != nil {
+		return err
+	}
+	if err := check(m.HasRangeDelKeys, m.SmallestRangeDel, m.LargestRangeDel); err != nil {
+		return err
+	}
+	if err := check(m.HasRangeKeys, m.SmallestRangeKey, m.LargestRangeKey); err != nil {
+		return err
+	}
+	m.SmallestPoint = o.Smallest.Clone()
+	m.LargestPoint = o.Largest.Clone()
+	return nil
+}
+
+// Sync blocks until every data block which has been finished so far has been
+// written to the underlying file, and then syncs the file. Keys which have been
+// added to the current, unfinished data block are not written. Sync may be
+// called repeatedly, and returns any error encountered while writing blocks,
+// in which case the Writer is no longer usable.
+func (w *Writer) Sync() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.coordination.writeQueue.drain(); err != nil {
+		w.err = err
+		return err
+	}
+	if w.bufWriter != nil {
+		if err := w.bufWriter.Flush(); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	if err := w.syncer.Sync(); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
 // EstimatedSize returns the estimated size of the sstable being written if a
 // call to Finish() was made without adding additional keys.
 func (w *Writer) EstimatedSize() uint64 {
@@ -1828,6 +3172,302 @@ func (w *Writer) EstimatedSize() uint64 {
 		w.indexBlock.estimatedSize()
 }
 
+// EstimateIndexSize estimates the size of the index of a table holding
+// numEntries point keys, whose user keys are avgKeyLen bytes long on average,
+// written with data blocks of blockSize bytes. It is a pure function intended
+// for comparing block sizes, not a prediction of the size of a specific table.
+//
+// The estimate follows the Writer's layout: one index entry per data block,
+// with the index block's restart interval of one, and data blocks with
+// base.DefaultBlockRestartInterval. Keys are assumed to be uniformly
+// distributed, so that the separators between data blocks are shortened to
+// one byte more than the prefix shared by adjacent keys. Values and prefix
+// compression within data blocks are not accounted for, so tables whose
+// values are large relative to their keys have fewer data blocks, and smaller
+// indexes, than estimated. The index is assumed to be single-level.
+func EstimateIndexSize(numEntries, avgKeyLen, blockSize int) uint64 {
+	if blockSize <= 0 {
+		blockSize = base.DefaultBlockSize
+	}
+	if numEntries < 0 {
+		numEntries = 0
+	}
+	// Each data block entry holds the shared, unshared and value length
+	// varints, the key and its trailer, and every restart interval entries a
+	// restart point.
+	entrySize := float64(3+avgKeyLen+base.InternalTrailerLen) + 4.0/base.DefaultBlockRestartInterval
+	dataBlocks := int(math.Ceil(float64(numEntries) * entrySize / float64(blockSize)))
+	if dataBlocks < 1 {
+		// The Writer writes an empty data block for a table without point keys.
+		dataBlocks = 1
+	}
+
+	// Adjacent keys drawn uniformly from the key space share about
+	// log256(numEntries) bytes.
+	sepLen := 1
+	for n := numEntries; n >= 256; n >>= 8 {
+		sepLen++
+	}
+	if sepLen > avgKeyLen {
+		sepLen = avgKeyLen
+	}
+	var buf [binary.MaxVarintLen64]byte
+	handleLen := binary.PutUvarint(buf[:], uint64(dataBlocks)*uint64(blockSize)) +
+		binary.PutUvarint(buf[:], uint64(blockSize))
+	// Each index entry holds the length varints, the separator and its
+	// trailer, the block handle and a restart point.
+	indexEntrySize := 3 + sepLen + base.InternalTrailerLen + handleLen + 4
+	return uint64(dataBlocks*indexEntrySize + emptyBlockSize + blockTrailerLen)
+}
+
+// CompressionRatio returns the ratio of the compressed size to the
+// uncompressed size of the data blocks written so far. It returns 1 if no data
+// block has been written yet. Note that data blocks which aren't compressed
+// (e.g. because compression didn't reduce their size sufficiently) contribute
+// a ratio of 1.
+func (w *Writer) CompressionRatio() float64 {
+	return w.coordination.sizeEstimate.compressionRatio()
+}
+
+// KeyRange returns the smallest and largest point keys added to the Writer so
+// far, or ok=false if no point keys have been added. The returned keys are
+// copies, and may be retained by the caller. After Close, KeyRange returns the
+// table's smallest and largest point keys, as recorded in its metadata.
+func (w *Writer) KeyRange() (smallest, largest InternalKey, ok bool) {
+	if !w.meta.HasPointKeys {
+		return InternalKey{}, InternalKey{}, false
+	}
+	if w.dataBlockBuf == nil {
+		// The Writer is closed, and its data block buffer has been released.
+		return w.meta.SmallestPoint.Clone(), w.meta.LargestPoint.Clone(), true
+	}
+	// The current data block always holds the most recently added key, since
+	// a data block is only flushed when a key is added, and the key is then
+	// added to the new data block. See the comment in Close.
+	largest = base.DecodeInternalKey(w.dataBlockBuf.dataBlock.curKey).Clone()
+	return w.meta.SmallestPoint.Clone(), largest, true
+}
+
+// TotalEntries returns the number of point keys, range deletions and range
+// keys added to the Writer so far. Range keys are counted as they are
+// encoded: once per fragment and kind, with the suffixes of a fragment's
+// RangeKeySets (or RangeKeyUnsets) coalesced into one entry. Range keys added
+// through RangeKeySet, RangeKeyUnset and RangeKeyDelete are counted once they
+// have been fragmented, which may lag behind the calls that added them.
+func (w *Writer) TotalEntries() uint64 {
+	return w.props.NumEntries + w.props.NumRangeKeys()
+}
+
+// FilterPolicyName returns the name of the filter policy with which the
+// table's filter is built, which is recorded as Properties.FilterPolicyName
+// when the Writer is closed. It returns the empty string if the table has no
+// filter. Unlike the property, it is available as soon as the Writer is
+// created.
+func (w *Writer) FilterPolicyName() string {
+	if w.filter == nil {
+		return ""
+	}
+	return w.filter.policyName()
+}
+
+// WriterStats is a snapshot of the progress of a Writer. See Writer.Stats.
+type WriterStats struct {
+	// EstimatedSize is the estimated size of the table, as returned by
+	// EstimatedSize.
+	EstimatedSize uint64
+	// Entries is the number of entries added, as returned by TotalEntries.
+	Entries uint64
+	// BytesWritten is the number of bytes of data blocks written to the file.
+	// Once the Writer is closed, it is the size of the table.
+	BytesWritten uint64
+	// DataBlocks is the number of data blocks flushed, including those which
+	// are still being compressed or written when writing in parallel. Once the
+	// Writer is closed, it includes the final data block.
+	DataBlocks uint64
+	// CompressionRatio is the compression ratio of the data blocks written, as
+	// returned by CompressionRatio.
+	CompressionRatio float64
+	// TwoLevelIndex is true if the index has been partitioned into a two-level
+	// index.
+	TwoLevelIndex bool
+}
+
+// Stats returns a snapshot of the Writer's progress. The sizes, data block
+// count and compression ratio of the data blocks are read together, and so
+// are consistent with one another even while blocks are written in
+// parallel.
+func (w *Writer) Stats() WriterStats {
+	dataSize, written, blocks, ratio := w.coordination.sizeEstimate.stats()
+	if w.syncer == nil {
+		// The Writer is closed, and its block buffers have been released.
+		return WriterStats{
+			EstimatedSize:    w.meta.Size,
+			Entries:          w.TotalEntries(),
+			BytesWritten:     w.meta.Size,
+			DataBlocks:       w.props.NumDataBlocks,
+			CompressionRatio: ratio,
+			TwoLevelIndex:    w.indexBlockFlushed,
+		}
+	}
+	return WriterStats{
+		EstimatedSize: dataSize + uint64(w.dataBlockBuf.dataBlock.estimatedSize()) +
+			w.indexBlock.estimatedSize(),
+		Entries:          w.TotalEntries(),
+		BytesWritten:     written,
+		DataBlocks:       blocks,
+		CompressionRatio: ratio,
+		TwoLevelIndex:    w.indexBlockFlushed,
+	}
+}
+
+// WriterMetrics describes the timing of a Writer's data block flushes. See
+// WriterOptions.RecordFlushTimes.
+type WriterMetrics struct {
+	// DataBlockFlushes is the number of data blocks flushed as keys were
+	// added. The final data block, which is flushed by Close, is not included.
+	DataBlockFlushes uint64
+	// TimeToFirstFlush is the time between the creation of the Writer and the
+	// flush of the first data block, or zero if no block has been flushed.
+	TimeToFirstFlush time.Duration
+	// MinFlushInterval, MaxFlushInterval and MeanFlushInterval describe the
+	// intervals between consecutive data block flushes. They are zero if fewer
+	// than two blocks have been flushed.
+	MinFlushInterval  time.Duration
+	MaxFlushInterval  time.Duration
+	MeanFlushInterval time.Duration
+}
+
+// Metrics returns the timing of the Writer's data block flushes. It returns
+// the zero value unless WriterOptions.RecordFlushTimes is set.
+func (w *Writer) Metrics() WriterMetrics {
+	s := w.flushTimes
+	if s == nil {
+		return WriterMetrics{}
+	}
+	m := WriterMetrics{
+		DataBlockFlushes: s.flushes,
+		TimeToFirstFlush: s.first,
+		MinFlushInterval: s.min,
+		MaxFlushInterval: s.max,
+	}
+	if s.flushes > 1 {
+		m.MeanFlushInterval = s.sum / time.Duration(s.flushes-1)
+	}
+	return m
+}
+
+// Err returns the error latched by the Writer, if any, without performing
+// another operation. Errors encountered while writing data blocks in parallel
+// are latched by the next call to Sync or Close.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+// TakeValidationErrors returns the validation errors returned by the Writer
+// since the previous call, and clears them, allowing a caller that writes many
+// keys to collect every key rejected in a pass. Errors are only accumulated if
+// WriterOptions.ContinueOnValidationError is set, and only up to
+// WriterOptions.MaxValidationErrors of them; otherwise the first validation
+// error is latched and returned by Err. Fatal errors, such as those
+// encountered writing blocks, are latched and never returned here.
+func (w *Writer) TakeValidationErrors() []error {
+	errs := w.validationErrors
+	w.validationErrors = nil
+	return errs
+}
+
+// AddRawBlock writes a block holding contents to the table, compressed with
+// the given compression and followed by the usual block trailer, and returns
+// its handle. The block is written between the data blocks added before and
+// after it, and so is counted in Properties.DataSize, but is not referenced
+// by the table unless the caller does so, for example with
+// AddMetaindexEntry. Any data blocks which are still being written in
+// parallel are written first.
+func (w *Writer) AddRawBlock(contents []byte, compression Compression) (BlockHandle, error) {
+	if w.err != nil {
+		return BlockHandle{}, w.err
+	}
+	// The writeQueue, which writes data blocks and updates w.meta.Size when
+	// writing in parallel, is idle once drained.
+	if err := w.coordination.writeQueue.drain(); err != nil {
+		w.err = err
+		return BlockHandle{}, err
+	}
+	bh, err := w.writeBlock(contents, compression, &w.blockBuf)
+	if err != nil {
+		w.err = err
+		return BlockHandle{}, err
+	}
+	w.coordination.sizeEstimate.rawBlockWritten(w.meta.Size)
+	return bh, nil
+}
+
+// AddMetaindexEntry adds an entry mapping name to the block handle bh, such
+// as one returned by AddRawBlock, to the table's metaindex block when the
+// table is finished. Entries may be added in any order, but names must be
+// unique, and names beginning with "fullfilter.", "pebble." or "rocksdb.",
+// which are reserved for the table's own meta blocks, are rejected.
+func (w *Writer) AddMetaindexEntry(name string, bh BlockHandle) error {
+	if w.err != nil {
+		return w.err
+	}
+	for _, prefix := range reservedMetaindexPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return errors.Errorf("pebble: metaindex entry name %q is reserved", name)
+		}
+	}
+	for i := range w.customMetaindexEntries {
+		if w.customMetaindexEntries[i].name == name {
+			return errors.Errorf("pebble: duplicate metaindex entry %q", name)
+		}
+	}
+	var tmp [blockHandleMaxLenWithoutProperties]byte
+	n := encodeBlockHandle(tmp[:], bh)
+	w.customMetaindexEntries = append(w.customMetaindexEntries, metaindexEntry{
+		name:  name,
+		value: append([]byte(nil), tmp[:n]...),
+	})
+	return nil
+}
+
+// SetFileNum sets the file number which, along with the cache ID, identifies
+// the blocks of the table in the block cache, from which each block is removed
+// as it is written. It replaces any file number set when the Writer was
+// created, and returns an error if any block has already been written.
+func (w *Writer) SetFileNum(fileNum base.FileNum) error {
+	if w.err != nil {
+		return w.err
+	}
+	// Blocks other than those added by AddRawBlock are only written once the
+	// first data block is flushed. In particular, if no data block has been
+	// flushed then the writeQueue, which reads fileNum and updates w.meta.Size
+	// when writing blocks in parallel, is idle.
+	if _, _, blocks, _ := w.coordination.sizeEstimate.stats(); blocks > 0 || w.meta.Size > 0 {
+		return errors.New("pebble: cannot set file number after a block has been written")
+	}
+	w.fileNum = fileNum
+	return nil
+}
+
+// AwaitDurable blocks until the table finished by Close has been synced and
+// its file closed, and returns any error encountered doing so. Unless
+// WriterOptions.AsyncFinish is set, Close syncs and closes the file itself,
+// and AwaitDurable returns immediately. If Close failed, AwaitDurable returns
+// the error returned by Close. Only valid to call after Close.
+func (w *Writer) AwaitDurable() error {
+	if w.syncer != nil {
+		return errors.New("pebble: writer is not closed")
+	}
+	if w.durable == nil {
+		if w.err == errWriterClosed {
+			return nil
+		}
+		return w.err
+	}
+	<-w.durable
+	return w.durableErr
+}
+
 // Metadata returns the metadata for the finished sstable. Only valid to call
 // after the sstable has been finished.
 func (w *Writer) Metadata() (*WriterMetadata, error) {
@@ -1884,30 +3524,103 @@ func (i internalTableOpt) writerApply(w *Writer) {
 	w.props.ExternalFormatVersion = 0
 }
 
+// checkContext returns a wrapped ctx.Err() if the Writer was created by
+// NewWriterWithContext and its context has been cancelled.
+func (w *Writer) checkContext() error {
+	if w.ctx == nil {
+		return nil
+	}
+	if err := w.ctx.Err(); err != nil {
+		return errors.Wrap(err, "pebble: sstable writer")
+	}
+	return nil
+}
+
+// NewWriterWithContext is like NewWriter, but the returned Writer checks ctx
+// for cancellation each time a data block is flushed and when the Writer is
+// closed. Once ctx is cancelled, the context's error is latched (see Writer),
+// and Close closes the file without finishing the table.
+func NewWriterWithContext(
+	ctx context.Context, f WriteCloseSyncer, o WriterOptions, extraOpts ...WriterOption,
+) *Writer {
+	w := NewWriter(f, o, extraOpts...)
+	w.ctx = ctx
+	return w
+}
+
+// checkPlainCompat returns an error if the options, to which defaults have
+// been applied, require a feature that is not supported with PlainCompat.
+func (o WriterOptions) checkPlainCompat() error {
+	var feature string
+	switch {
+	case o.TableFormat != TableFormatLevelDB:
+		feature = fmt.Sprintf("table format %s", o.TableFormat)
+	case o.Checksum != ChecksumTypeCRC32c:
+		feature = "checksums other than CRC32c"
+	case len(o.BlockPropertyCollectors) > 0:
+		feature = "block property collectors"
+	case o.CompressProperties:
+		feature = "compressed properties"
+	case o.OmitEmptyPointBlocks:
+		feature = "omitted point blocks"
+	default:
+		return nil
+	}
+	return errors.Errorf("pebble: %s not supported with PlainCompat", errors.Safe(feature))
+}
+
 // NewWriter returns a new table writer for the file. Closing the writer will
 // close the file.
-func NewWriter(f writeCloseSyncer, o WriterOptions, extraOpts ...WriterOption) *Writer {
+func NewWriter(f WriteCloseSyncer, o WriterOptions, extraOpts ...WriterOption) *Writer {
 	o = o.ensureDefaults()
 	w := &Writer{
 		syncer: f,
 		meta: WriterMetadata{
 			SmallestSeqNum: math.MaxUint64,
 		},
-		blockSize:               o.BlockSize,
-		blockSizeThreshold:      (o.BlockSize*o.BlockSizeThreshold + 99) / 100,
-		indexBlockSize:          o.IndexBlockSize,
-		indexBlockSizeThreshold: (o.IndexBlockSize*o.BlockSizeThreshold + 99) / 100,
-		compare:                 o.Comparer.Compare,
-		split:                   o.Comparer.Split,
-		formatKey:               o.Comparer.FormatKey,
-		compression:             o.Compression,
-		separator:               o.Comparer.Separator,
-		successor:               o.Comparer.Successor,
-		tableFormat:             o.TableFormat,
-		cache:                   o.Cache,
-		restartInterval:         o.BlockRestartInterval,
-		checksumType:            o.Checksum,
-		indexBlock:              newIndexBlockBuf(o.Parallelism),
+		blockSize:                     o.BlockSize,
+		blockSizeThreshold:            (o.BlockSize*o.BlockSizeThreshold + 99) / 100,
+		indexBlockSize:                o.IndexBlockSize,
+		indexBlockSizeThreshold:       (o.IndexBlockSize*o.BlockSizeThreshold + 99) / 100,
+		compare:                       o.Comparer.Compare,
+		split:                         o.Comparer.Split,
+		formatKey:                     o.Comparer.FormatKey,
+		compression:                   o.Compression,
+		separator:                     o.Comparer.Separator,
+		successor:                     o.Comparer.Successor,
+		tableFormat:                   o.TableFormat,
+		cache:                         o.Cache,
+		restartInterval:               o.BlockRestartInterval,
+		checksumType:                  o.Checksum,
+		continueOnValidationError:     o.ContinueOnValidationError,
+		maxValidationErrors:           o.MaxValidationErrors,
+		omitEmptyPointBlocks:          o.OmitEmptyPointBlocks,
+		compressProperties:            o.CompressProperties,
+		recordPresentKeyKinds:         o.RecordPresentKeyKinds,
+		keyBounds:                     o.KeyBounds,
+		keyValidator:                  o.KeyValidator,
+		requirePreFragmentedRangeKeys: o.RequirePreFragmentedRangeKeys,
+		bufferRangeKeys:               o.BufferAndSortRangeKeys,
+		maxBufferedRangeKeys:          o.MaxBufferedRangeKeys,
+		adaptiveRestartInterval:       o.AdaptiveRestartInterval,
+		fullKeyIndexSeparators:        o.FullKeyIndexSeparators,
+		indexPartitionDataSizes:       o.IndexPartitionDataSizes,
+		preFinishValidator:            o.PreFinishValidator,
+		rewriteUserProperty:           o.RewriteUserProperty,
+		smallTableThreshold:           o.SmallTableThreshold,
+		asyncFinish:                   o.AsyncFinish,
+		maxUserPropertiesBytes:        o.MaxUserPropertiesBytes,
+		keyRangeOverride:              o.KeyRangeOverride,
+		expectedRangeDelBounds:        o.ExpectedRangeDelBounds,
+		now:                           o.Now,
+		writerDiagnostics: writerDiagnostics{
+			selfCheckBlocks:           o.SelfCheckBlocks,
+			firstBlockEntryCount:      o.FirstBlockEntryCount,
+			fixedBlockEntryCount:      o.FixedBlockEntryCount,
+			minDataBlocks:             o.MinDataBlocks,
+			validateBoundsConsistency: o.ValidateBoundsConsistency,
+		},
+		indexBlock: newIndexBlockBuf(o.Parallelism),
 		rangeDelBlock: blockWriter{
 			restartInterval: 1,
 		},
@@ -1923,18 +3636,36 @@ func NewWriter(f writeCloseSyncer, o WriterOptions, extraOpts ...WriterOption) *
 		},
 	}
 
+	if o.DisablePrefixCompression {
+		w.restartInterval = 1
+		w.adaptiveRestartInterval = false
+	}
 	w.dataBlockBuf = newDataBlockBuf(w.restartInterval, w.checksumType)
 
 	w.blockBuf = blockBuf{
 		checksummer: checksummer{checksumType: o.Checksum},
 	}
 
-	w.coordination.init(o.Parallelism, w)
+	w.coordination.init(o.Parallelism, o.WriteQueueSize, w)
 
 	if f == nil {
 		w.err = errors.New("pebble: nil file")
 		return w
 	}
+	if o.WriteQueueSize < 0 {
+		w.err = errors.Errorf("pebble: invalid WriteQueueSize %d", o.WriteQueueSize)
+		return w
+	}
+	if o.PlainCompat {
+		if err := o.checkPlainCompat(); err != nil {
+			w.err = err
+			return w
+		}
+		w.plainCompat = true
+		// LevelDB does not understand two-level indexes.
+		w.indexBlockSize = math.MaxInt32
+		w.indexBlockSizeThreshold = math.MaxInt32
+	}
 
 	// Note that WriterOptions are applied in two places; the ones with a
 	// preApply() method are applied here, and the rest are applied after
@@ -1954,21 +3685,44 @@ func NewWriter(f writeCloseSyncer, o WriterOptions, extraOpts ...WriterOption) *
 			if w.split != nil {
 				w.props.PrefixExtractorName = o.Comparer.Name
 				w.props.PrefixFiltering = true
+				if o.FilterWholeKeys {
+					w.filterWholeKeys = true
+					w.props.WholeKeyFiltering = true
+				}
 			} else {
 				w.props.WholeKeyFiltering = true
 			}
 		default:
 			panic(fmt.Sprintf("unknown filter type: %v", o.FilterType))
 		}
+		if o.FilterKeyTransform != nil {
+			w.filterKeyTransform = o.FilterKeyTransform
+			w.props.FilterKeyTransformName = o.FilterKeyTransform.Name
+		}
 	}
 
 	w.props.ColumnFamilyID = math.MaxInt32
 	w.props.ComparerName = o.Comparer.Name
+	w.props.ComparerVersion = o.ComparerVersion
 	w.props.CompressionName = o.Compression.String()
 	w.props.MergerName = o.MergerName
+	w.props.MergerVersion = o.MergerVersion
 	w.props.PropertyCollectorNames = "[]"
 	w.props.ExternalFormatVersion = rocksDBExternalFormatVersion
 
+	if o.EnableMVCCTimestampProperties {
+		if o.DecodeMVCCTimestamp == nil || o.Comparer.Split == nil {
+			w.err = errors.New(
+				"pebble: EnableMVCCTimestampProperties requires DecodeMVCCTimestamp and Comparer.Split")
+			return w
+		}
+		split, decode := o.Comparer.Split, o.DecodeMVCCTimestamp
+		n := len(o.BlockPropertyCollectors)
+		o.BlockPropertyCollectors = append(o.BlockPropertyCollectors[:n:n], func() BlockPropertyCollector {
+			return NewMVCCTimestampCollector(split, decode)
+		})
+	}
+
 	if len(o.TablePropertyCollectors) > 0 || len(o.BlockPropertyCollectors) > 0 {
 		var buf bytes.Buffer
 		buf.WriteString("[")
@@ -1992,8 +3746,15 @@ func NewWriter(f writeCloseSyncer, o WriterOptions, extraOpts ...WriterOption) *
 			// The shortID assigned to a collector is the same as its index in
 			// this slice.
 			w.blockPropCollectors = make([]BlockPropertyCollector, len(o.BlockPropertyCollectors))
+			w.blockPropSizes = make([]uint64, len(o.BlockPropertyCollectors))
+			if o.VerifyCollectorDeterminism {
+				w.blockPropShadows = make([]BlockPropertyCollector, len(o.BlockPropertyCollectors))
+			}
 			for i := range o.BlockPropertyCollectors {
 				w.blockPropCollectors[i] = o.BlockPropertyCollectors[i]()
+				if w.blockPropShadows != nil {
+					w.blockPropShadows[i] = o.BlockPropertyCollectors[i]()
+				}
 				if i > 0 || len(o.TablePropertyCollectors) > 0 {
 					buf.WriteString(",")
 				}
@@ -2004,6 +3765,18 @@ func NewWriter(f writeCloseSyncer, o WriterOptions, extraOpts ...WriterOption) *
 		w.props.PropertyCollectorNames = buf.String()
 	}
 
+	if o.PropertiesTemplate != nil {
+		if err := w.props.applyTemplate(o.PropertiesTemplate, w.FilterPolicyName()); err != nil {
+			w.err = err
+			return w
+		}
+	}
+
+	if err := w.initOptionalState(o); err != nil {
+		w.err = err
+		return w
+	}
+
 	// Apply the remaining WriterOptions that do not have a preApply() method.
 	for _, opt := range extraOpts {
 		if _, ok := opt.(preApply); !ok {
@@ -2025,10 +3798,59 @@ func NewWriter(f writeCloseSyncer, o WriterOptions, extraOpts ...WriterOption) *
 	return w
 }
 
+// initOptionalState initializes the state of the Writer used by the optional
+// features enabled in o. It is called by NewWriter once the table's
+// properties have been initialized.
+func (w *Writer) initOptionalState(o WriterOptions) error {
+	if o.CoalesceRangeDels {
+		w.rangeDelCoalescer = &rangeDelCoalescer{cmp: w.compare, emit: w.writeTombstone}
+	}
+	if o.BlockAlignment > 0 {
+		w.blockAlignment = uint64(o.BlockAlignment)
+		w.alignmentPadding = make([]byte, o.BlockAlignment-1)
+	}
+	if o.MultipartPartSize > 0 {
+		w.multipartPartSize = uint64(o.MultipartPartSize)
+	}
+	if o.RecordFlushTimes {
+		w.flushTimes = &flushTimingStats{created: time.Now()}
+	}
+	if o.RecordCompressionTimes {
+		w.compressionTimes = &compressionTimingStats{}
+	}
+	if o.SuffixStats != nil {
+		w.suffixStats = newSuffixStats(w.split, o.SuffixStats)
+	}
+	if o.SizeDistribution {
+		w.sizeDistribution = newSizeDistribution()
+	}
+	if len(o.SeqNumHistogram) > 0 {
+		var err error
+		if w.seqNums, err = newSeqNumHistogram(o.SeqNumHistogram); err != nil {
+			return err
+		}
+	}
+	if o.DataBlockHash != nil {
+		w.blockHash = o.DataBlockHash.New()
+		w.blockHashes.restartInterval = base.DefaultBlockRestartInterval
+		w.props.DataBlockHashName = o.DataBlockHash.Name
+	}
+	if o.DataBlockFirstByteRanges {
+		w.firstBytes = true
+		w.firstByteRanges.restartInterval = base.DefaultBlockRestartInterval
+	}
+	w.pinnedBlocks.restartInterval = base.DefaultBlockRestartInterval
+	return nil
+}
+
 func init() {
 	private.SSTableWriterDisableKeyOrderChecks = func(i interface{}) {
 		w := i.(*Writer)
 		w.disableKeyOrderChecks = true
 	}
+	private.SSTableWriterForceFooterFormat = func(i interface{}, tableFormat uint32) {
+		w := i.(*Writer)
+		w.forcedFooterFormat = TableFormat(tableFormat)
+	}
 	private.SSTableInternalTableOpt = internalTableOpt{}
 }
@@ -6,13 +6,20 @@ package sstable
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"math/rand"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/bloom"
@@ -20,6 +27,7 @@ import (
 	"github.com/cockroachdb/pebble/internal/cache"
 	"github.com/cockroachdb/pebble/internal/datadriven"
 	"github.com/cockroachdb/pebble/internal/humanize"
+	"github.com/cockroachdb/pebble/internal/private"
 	"github.com/cockroachdb/pebble/internal/testkeys"
 	"github.com/cockroachdb/pebble/vfs"
 	"github.com/stretchr/testify/require"
@@ -295,6 +303,2161 @@ func TestParallelWriterErrorProp(t *testing.T) {
 	require.Equal(t, err.Error(), "write queue write error")
 }
 
+func TestWriterContinueOnValidationError(t *testing.T) {
+	// By default, a validation error is latched and poisons the Writer.
+	w := NewWriter(&memFile{}, WriterOptions{})
+	require.NoError(t, w.Set([]byte("b"), nil))
+	require.True(t, errors.Is(w.Set([]byte("a"), nil), ErrValidation))
+	require.True(t, errors.Is(w.Set([]byte("c"), nil), ErrValidation))
+	require.Error(t, w.Close())
+	require.Empty(t, w.TakeValidationErrors())
+
+	// Only up to MaxValidationErrors errors are retained.
+	w = NewWriter(&memFile{}, WriterOptions{
+		ContinueOnValidationError: true,
+		MaxValidationErrors:       1,
+	})
+	require.NoError(t, w.Set([]byte("b"), nil))
+	require.True(t, errors.Is(w.Set([]byte("a"), nil), ErrValidation))
+	require.True(t, errors.Is(w.Set([]byte("a"), nil), ErrValidation))
+	require.Len(t, w.TakeValidationErrors(), 1)
+	require.NoError(t, w.Close())
+
+	f := &memFile{}
+	w = NewWriter(f, WriterOptions{
+		BlockSize:                 1,
+		TableFormat:               TableFormatPebblev2,
+		ContinueOnValidationError: true,
+		MaxValidationErrors:       10,
+	})
+	require.NoError(t, w.Set([]byte("a"), []byte("1")))
+	require.NoError(t, w.Set([]byte("c"), []byte("3")))
+	// Out of order point key.
+	require.Error(t, w.Set([]byte("b"), []byte("2")))
+	// Range keys may not be added through Add.
+	require.Error(t, w.Add(base.MakeInternalKey([]byte("d"), 0, base.InternalKeyKindRangeKeySet), nil))
+	require.NoError(t, w.DeleteRange([]byte("e"), []byte("g")))
+	errs := w.TakeValidationErrors()
+	require.Len(t, errs, 2)
+	require.Contains(t, errs[0].Error(), "keys must be added in strictly increasing order")
+	for _, err := range errs {
+		require.True(t, errors.Is(err, ErrValidation))
+	}
+	require.Empty(t, w.TakeValidationErrors())
+	// Out of order range deletion.
+	require.Error(t, w.DeleteRange([]byte("d"), []byte("f")))
+	require.NoError(t, w.Set([]byte("d"), []byte("4")))
+	require.NoError(t, w.Close())
+	require.Len(t, w.TakeValidationErrors(), 1)
+
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+	it, err := r.NewIter(nil, nil)
+	require.NoError(t, err)
+	var got []string
+	for k, v := it.First(); k != nil; k, v = it.Next() {
+		got = append(got, fmt.Sprintf("%s:%s", k.UserKey, v))
+	}
+	require.NoError(t, it.Close())
+	require.Equal(t, []string{"a:1", "c:3", "d:4"}, got)
+	require.Equal(t, uint64(1), r.Properties.NumRangeDeletions)
+}
+
+func TestWriterErrLatching(t *testing.T) {
+	rangeKey := func(start, end string) (InternalKey, []byte) {
+		return base.MakeInternalKey([]byte(start), 0, base.InternalKeyKindRangeKeyDelete), []byte(end)
+	}
+	testCases := []struct {
+		name string
+		fn   func(w *Writer) error
+	}{
+		{"point", func(w *Writer) error {
+			_ = w.Set([]byte("b"), nil)
+			return w.Set([]byte("a"), nil)
+		}},
+		{"range-del", func(w *Writer) error {
+			_ = w.DeleteRange([]byte("b"), []byte("c"))
+			return w.DeleteRange([]byte("a"), []byte("c"))
+		}},
+		{"range-key-span", func(w *Writer) error {
+			_ = w.RangeKeyDelete([]byte("b"), []byte("c"))
+			return w.RangeKeyDelete([]byte("a"), []byte("c"))
+		}},
+		{"range-key", func(w *Writer) error {
+			_ = w.AddRangeKey(rangeKey("b", "c"))
+			return w.AddRangeKey(rangeKey("a", "c"))
+		}},
+		{"range-key-overlap", func(w *Writer) error {
+			_ = w.AddRangeKey(rangeKey("a", "c"))
+			return w.AddRangeKey(rangeKey("b", "d"))
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, continueOnValidationError := range []bool{false, true} {
+				w := NewWriter(&memFile{}, WriterOptions{
+					TableFormat:               TableFormatPebblev2,
+					ContinueOnValidationError: continueOnValidationError,
+				})
+				require.NoError(t, w.Err())
+				err := tc.fn(w)
+				require.Error(t, err)
+				if continueOnValidationError {
+					require.NoError(t, w.Err())
+					require.NoError(t, w.Close())
+				} else {
+					require.Equal(t, err, w.Err())
+					require.Equal(t, err, w.Close())
+				}
+			}
+		})
+	}
+
+	// A block property collector failing to add a range key leaves the
+	// Writer's state partially updated, so the error is latched even with
+	// ContinueOnValidationError.
+	collectorErr := errors.New("range key collector failed")
+	for _, continueOnValidationError := range []bool{false, true} {
+		w := NewWriter(&memFile{}, WriterOptions{
+			BlockPropertyCollectors: []func() BlockPropertyCollector{
+				func() BlockPropertyCollector {
+					return &testBlockPropCollector{errSite: errSiteAdd, err: collectorErr}
+				},
+			},
+			TableFormat:               TableFormatPebblev2,
+			ContinueOnValidationError: continueOnValidationError,
+		})
+		require.Equal(t, collectorErr, w.AddRangeKey(rangeKey("a", "c")))
+		require.Equal(t, collectorErr, w.Err())
+		require.Equal(t, collectorErr, w.AddRangeKey(rangeKey("d", "e")))
+		require.Equal(t, collectorErr, w.Close())
+	}
+}
+
+func TestWriterWithContext(t *testing.T) {
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			f := &memFile{}
+			w := NewWriterWithContext(ctx, f, WriterOptions{
+				BlockSize:   1,
+				Parallelism: parallelism,
+			})
+			require.NoError(t, w.Set([]byte("a"), []byte("a")))
+			require.NoError(t, w.Set([]byte("b"), []byte("b")))
+
+			// Once the context is cancelled, the next data block flush fails and
+			// the error is latched.
+			cancel()
+			err := w.Set([]byte("c"), []byte("c"))
+			require.True(t, errors.Is(err, context.Canceled))
+			require.Equal(t, err, w.Err())
+			require.Equal(t, err, w.Close())
+
+			// The table was not finished.
+			_, err = NewMemReader(f.Data(), ReaderOptions{})
+			require.Error(t, err)
+		})
+	}
+
+	// A context cancelled before any data block is flushed is noticed by Close.
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewWriterWithContext(ctx, &memFile{}, WriterOptions{})
+	require.NoError(t, w.Set([]byte("a"), []byte("a")))
+	cancel()
+	require.True(t, errors.Is(w.Close(), context.Canceled))
+}
+
+func TestWriterCompressionRatio(t *testing.T) {
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			w := NewWriter(&discardFile{}, WriterOptions{
+				BlockSize:   512,
+				Compression: SnappyCompression,
+				Parallelism: parallelism,
+			})
+			require.Equal(t, 1.0, w.CompressionRatio())
+			value := bytes.Repeat([]byte("a"), 100)
+			for i := 0; i < 1000; i++ {
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), value))
+				// Exercise concurrent access to the estimate while the write
+				// queue may be writing blocks.
+				ratio := w.CompressionRatio()
+				require.True(t, ratio > 0 && ratio <= 1)
+			}
+			require.NoError(t, w.Close())
+			require.Less(t, w.CompressionRatio(), 0.5)
+		})
+	}
+}
+
+func TestWriterMetrics(t *testing.T) {
+	write := func(opts WriterOptions) WriterMetrics {
+		// Each key added after the first flushes the preceding data block.
+		opts.FixedBlockEntryCount = 1
+		w := NewWriter(&memFile{}, opts)
+		for i := 0; i < 5; i++ {
+			time.Sleep(time.Millisecond)
+			require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), nil))
+		}
+		m := w.Metrics()
+		require.NoError(t, w.Close())
+		require.Equal(t, m, w.Metrics())
+		return m
+	}
+
+	require.Equal(t, WriterMetrics{}, write(WriterOptions{}))
+
+	m := write(WriterOptions{RecordFlushTimes: true})
+	require.EqualValues(t, 4, m.DataBlockFlushes)
+	require.GreaterOrEqual(t, m.TimeToFirstFlush, 2*time.Millisecond)
+	require.GreaterOrEqual(t, m.MinFlushInterval, time.Millisecond)
+	require.LessOrEqual(t, m.MinFlushInterval, m.MeanFlushInterval)
+	require.LessOrEqual(t, m.MeanFlushInterval, m.MaxFlushInterval)
+}
+
+func TestWriterRecordCompressionTimes(t *testing.T) {
+	write := func(opts WriterOptions) *WriterMetadata {
+		opts.Compression = ZstdCompression
+		w := NewWriter(&memFile{}, opts)
+		for i := 0; i < 10000; i++ {
+			require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte(fmt.Sprintf("value-%d", i))))
+		}
+		require.NoError(t, w.Close())
+		meta, err := w.Metadata()
+		require.NoError(t, err)
+		return meta
+	}
+
+	meta := write(WriterOptions{})
+	require.Zero(t, meta.MaxBlockCompressionTime)
+	require.Zero(t, meta.MeanBlockCompressionTime)
+
+	meta = write(WriterOptions{RecordCompressionTimes: true})
+	require.Greater(t, meta.MeanBlockCompressionTime, time.Duration(0))
+	require.LessOrEqual(t, meta.MeanBlockCompressionTime, meta.MaxBlockCompressionTime)
+	t.Logf("%d data blocks: mean compression time %s, max %s", meta.Properties.NumDataBlocks,
+		meta.MeanBlockCompressionTime, meta.MaxBlockCompressionTime)
+}
+
+func TestWriterBlockAlignment(t *testing.T) {
+	const alignment = 4096
+	write := func(blockAlignment int) (*Reader, *Layout, int64) {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			BlockAlignment: blockAlignment,
+			// Uncompressed data blocks, with their trailers, nearly fill the
+			// alignment.
+			BlockSize:    alignment - 128,
+			Compression:  NoCompression,
+			FilterPolicy: bloom.FilterPolicy(10),
+			TableFormat:  TableFormatPebblev2,
+		})
+		for i := 0; i < 10000; i++ {
+			require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte(fmt.Sprintf("value-%d", i))))
+		}
+		require.NoError(t, w.DeleteRange([]byte("a"), []byte("b")))
+		require.NoError(t, w.RangeKeySet([]byte("c"), []byte("d"), nil, []byte("v")))
+		require.NoError(t, w.Close())
+		meta, err := w.Metadata()
+		require.NoError(t, err)
+		require.EqualValues(t, f.Len(), meta.Size)
+
+		r, err := NewMemReader(f.Data(), ReaderOptions{Filters: map[string]FilterPolicy{
+			bloom.FilterPolicy(10).Name(): bloom.FilterPolicy(10),
+		}})
+		require.NoError(t, err)
+		l, err := r.Layout()
+		require.NoError(t, err)
+		return r, l, int64(meta.Size)
+	}
+	handles := func(l *Layout) []BlockHandle {
+		bhs := append([]BlockHandle(nil), l.Index...)
+		for _, bh := range l.Data {
+			bhs = append(bhs, bh.BlockHandle)
+		}
+		return append(bhs, l.TopIndex, l.Filter, l.RangeDel, l.RangeKey, l.Properties, l.MetaIndex)
+	}
+
+	r, _, size := write(0)
+	require.NoError(t, r.Close())
+
+	r, l, alignedSize := write(alignment)
+	defer r.Close()
+	bhs := handles(l)
+	for _, bh := range bhs {
+		require.Zero(t, bh.Offset%alignment, "block at %d", bh.Offset)
+	}
+	require.NoError(t, r.ValidateBlockChecksums())
+	iter, err := r.NewIter(nil, nil)
+	require.NoError(t, err)
+	n := 0
+	for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+		n++
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, 10000, n)
+
+	// The padding before each block is less than the alignment. As the data
+	// blocks nearly fill the alignment, little padding separates them, and
+	// most of the overhead is due to the padding before the smaller blocks.
+	overhead := alignedSize - size
+	require.Greater(t, overhead, int64(0))
+	require.Less(t, overhead, int64(len(bhs)*alignment))
+	var dataPadding uint64
+	for i := 1; i < len(l.Data); i++ {
+		prev := l.Data[i-1]
+		dataPadding += l.Data[i].Offset - (prev.Offset + prev.Length + blockTrailerLen)
+	}
+	require.Less(t, dataPadding, uint64(len(l.Data)*256))
+	t.Logf("%d blocks: %d bytes unaligned, %d bytes aligned (%.0f%% overhead, %d bytes between data blocks)",
+		len(bhs), size, alignedSize, 100*float64(overhead)/float64(size), dataPadding)
+}
+
+func TestWriterMultipartPartSize(t *testing.T) {
+	const partSize = 16 << 10
+	// write returns, for each part boundary, its distance from the start of
+	// the data block which straddles it, or zero if it falls between blocks.
+	write := func(opts WriterOptions) []uint64 {
+		opts.BlockSize = 4096
+		opts.Compression = NoCompression
+		f := &memFile{}
+		w := NewWriter(f, opts)
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 20000; i++ {
+			key := []byte(fmt.Sprintf("%08d", i))
+			require.NoError(t, w.Set(key, bytes.Repeat([]byte("v"), rng.Intn(100))))
+		}
+		require.NoError(t, w.Close())
+
+		r, err := NewMemReader(f.Data(), ReaderOptions{})
+		require.NoError(t, err)
+		defer r.Close()
+		require.EqualValues(t, 20000, r.Properties.NumEntries)
+		l, err := r.Layout()
+		require.NoError(t, err)
+		var straddles []uint64
+		for _, bh := range l.Data {
+			end := bh.Offset + bh.Length + blockTrailerLen
+			if boundary := end / partSize * partSize; boundary > bh.Offset && boundary < end {
+				straddles = append(straddles, boundary-bh.Offset)
+			}
+		}
+		return straddles
+	}
+
+	straddles := write(WriterOptions{})
+	require.NotEmpty(t, straddles)
+	var maxStraddle uint64
+	for _, s := range straddles {
+		if s > maxStraddle {
+			maxStraddle = s
+		}
+	}
+	require.Greater(t, maxStraddle, uint64(1024))
+
+	// With the option, each boundary falls within the first entry of a block.
+	for _, s := range write(WriterOptions{MultipartPartSize: partSize}) {
+		require.Less(t, s, uint64(128))
+	}
+}
+
+func TestWriterStats(t *testing.T) {
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			f := &memFile{}
+			w := NewWriter(f, WriterOptions{
+				BlockSize:      512,
+				IndexBlockSize: 256,
+				Compression:    SnappyCompression,
+				Parallelism:    parallelism,
+				TableFormat:    TableFormatPebblev1,
+			})
+			stats := w.Stats()
+			require.Zero(t, stats.Entries)
+			require.Zero(t, stats.DataBlocks)
+			require.False(t, stats.TwoLevelIndex)
+
+			value := bytes.Repeat([]byte("a"), 100)
+			var prev WriterStats
+			for i := 0; i < 1000; i++ {
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), value))
+				stats := w.Stats()
+				require.EqualValues(t, i+1, stats.Entries)
+				if !parallelism {
+					require.Equal(t, w.EstimatedSize(), stats.EstimatedSize)
+				}
+				require.GreaterOrEqual(t, stats.DataBlocks, prev.DataBlocks)
+				require.True(t, stats.CompressionRatio > 0 && stats.CompressionRatio <= 1)
+				prev = stats
+			}
+			require.True(t, prev.TwoLevelIndex)
+			require.NoError(t, w.Close())
+
+			stats = w.Stats()
+			meta, err := w.Metadata()
+			require.NoError(t, err)
+			require.EqualValues(t, 1000, stats.Entries)
+			require.Equal(t, meta.Size, stats.BytesWritten)
+			require.Equal(t, uint64(len(f.Data())), stats.BytesWritten)
+			require.Equal(t, meta.Properties.NumDataBlocks, stats.DataBlocks)
+			require.Greater(t, stats.DataBlocks, prev.DataBlocks)
+			require.True(t, stats.TwoLevelIndex)
+			require.Less(t, stats.CompressionRatio, 0.5)
+		})
+	}
+}
+
+func TestWriterDeterministic(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	keys := make([][]byte, 2000)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%08d", i))
+		values[i] = make([]byte, rng.Intn(200))
+		for j := range values[i] {
+			values[i][j] = byte('a' + rng.Intn(4))
+		}
+	}
+	build := func(compression Compression, blockSize int) []byte {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			BlockSize:     blockSize,
+			Compression:   compression,
+			FilterPolicy:  bloom.FilterPolicy(10),
+			Parallelism:   true,
+			Deterministic: true,
+		})
+		require.False(t, w.coordination.parallelismEnabled)
+		for i := range keys {
+			require.NoError(t, w.Set(keys[i], values[i]))
+		}
+		require.NoError(t, w.DeleteRange([]byte("a"), []byte("b")))
+		require.NoError(t, w.Close())
+		return f.Data()
+	}
+	for _, compression := range []Compression{NoCompression, SnappyCompression, ZstdCompression} {
+		t.Run(compression.String(), func(t *testing.T) {
+			first := build(compression, 512)
+			// Dirty the pooled buffers with differently sized blocks.
+			_ = build(compression, 64<<10)
+			second := build(compression, 512)
+			require.Equal(t, first, second)
+
+			r, err := NewMemReader(second, ReaderOptions{})
+			require.NoError(t, err)
+			require.NoError(t, r.ValidateBlockChecksums())
+			require.NoError(t, r.Close())
+		})
+	}
+}
+
+func TestWriterCreationTime(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name string
+		opts WriterOptions
+		want uint64
+	}{
+		{"unset", WriterOptions{}, 0},
+		{"now", WriterOptions{Now: func() time.Time { return now }}, uint64(now.Unix())},
+		{"deterministic", WriterOptions{
+			Now:           func() time.Time { return now },
+			Deterministic: true,
+		}, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &memFile{}
+			w := NewWriter(f, tc.opts)
+			require.NoError(t, w.Set([]byte("a"), []byte("a")))
+			require.NoError(t, w.Close())
+
+			r, err := NewMemReader(f.Data(), ReaderOptions{})
+			require.NoError(t, err)
+			require.Equal(t, tc.want, r.Properties.CreationTime)
+			require.NoError(t, r.Close())
+		})
+	}
+}
+
+// bloatedPropertyCollector is a TablePropertyCollector which produces a
+// property of a fixed size.
+type bloatedPropertyCollector struct {
+	size int
+}
+
+func (c *bloatedPropertyCollector) Add(key InternalKey, value []byte) error {
+	return nil
+}
+
+func (c *bloatedPropertyCollector) Finish(userProps map[string]string) error {
+	userProps["test.bloated"] = strings.Repeat("x", c.size)
+	return nil
+}
+
+func (c *bloatedPropertyCollector) Name() string {
+	return "bloated"
+}
+
+func TestWriterMaxUserPropertiesBytes(t *testing.T) {
+	write := func(opts WriterOptions) error {
+		opts.TablePropertyCollectors = []func() TablePropertyCollector{
+			func() TablePropertyCollector { return &keyCountPropertyCollector{} },
+			func() TablePropertyCollector { return &bloatedPropertyCollector{size: 1000} },
+		}
+		w := NewWriter(&memFile{}, opts)
+		require.NoError(t, w.Set([]byte("a"), nil))
+		return w.Close()
+	}
+	// The properties are "test.key-count" = "1" and "test.bloated", of 1012
+	// bytes.
+	require.NoError(t, write(WriterOptions{}))
+	require.NoError(t, write(WriterOptions{MaxUserPropertiesBytes: 1027}))
+	require.EqualError(t, write(WriterOptions{MaxUserPropertiesBytes: 1026}),
+		"pebble: user properties of 1027 bytes exceed MaxUserPropertiesBytes of 1026; "+
+			"collector bloated produced 1012 bytes")
+
+	// Properties from a template are included, but are not attributed to a
+	// collector.
+	w := NewWriter(&memFile{}, WriterOptions{
+		MaxUserPropertiesBytes: 100,
+		PropertiesTemplate: &Properties{
+			UserProperties: map[string]string{"test.template": strings.Repeat("x", 100)},
+		},
+	})
+	require.EqualError(t, w.Close(), "pebble: user properties of 113 bytes exceed MaxUserPropertiesBytes of 100")
+}
+
+func TestWriterRewriteUserProperty(t *testing.T) {
+	write := func(rewrite func(string, []byte) ([]byte, error)) (map[string]string, error) {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			Comparer:                      testkeys.Comparer,
+			DecodeMVCCTimestamp:           decodeTestkeysTimestamp,
+			EnableMVCCTimestampProperties: true,
+			RewriteUserProperty:           rewrite,
+			TableFormat:                   TableFormatPebblev2,
+		})
+		require.NoError(t, w.Set([]byte("a@5"), []byte("value")))
+		require.NoError(t, w.Set([]byte("b@7"), []byte("value")))
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		r, err := NewMemReader(f.Data(), ReaderOptions{Comparer: testkeys.Comparer})
+		require.NoError(t, err)
+		defer r.Close()
+		return r.Properties.UserProperties, nil
+	}
+
+	props, err := write(nil)
+	require.NoError(t, err)
+	require.Equal(t, "\x00"+string(interval{lower: 5, upper: 8}.encode(nil)),
+		props[MVCCTimestampPropertyName])
+
+	// The rewriter sees the collector's encoding, without the short ID, and
+	// its result is stored under the same short ID.
+	props, err = write(func(name string, value []byte) ([]byte, error) {
+		require.Equal(t, MVCCTimestampPropertyName, name)
+		var i interval
+		require.NoError(t, i.decode(value))
+		require.Equal(t, interval{lower: 5, upper: 8}, i)
+		return interval{lower: 0, upper: 100}.encode(nil), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "\x00"+string(interval{lower: 0, upper: 100}.encode(nil)),
+		props[MVCCTimestampPropertyName])
+
+	_, err = write(func(string, []byte) ([]byte, error) {
+		return nil, errors.New("unknown encoding")
+	})
+	require.EqualError(t, err, "unknown encoding")
+}
+
+func TestWriterPropertiesTemplate(t *testing.T) {
+	opts := WriterOptions{
+		Compression:  SnappyCompression,
+		FilterPolicy: bloom.FilterPolicy(10),
+		TablePropertyCollectors: []func() TablePropertyCollector{
+			func() TablePropertyCollector { return &keyCountPropertyCollector{} },
+		},
+	}
+	write := func(opts WriterOptions, keys ...string) (*Properties, error) {
+		f := &memFile{}
+		w := NewWriter(f, opts)
+		for _, k := range keys {
+			if err := w.Set([]byte(k), []byte(k)); err != nil {
+				return nil, err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		r, err := NewMemReader(f.Data(), ReaderOptions{})
+		require.NoError(t, err)
+		defer r.Close()
+		props := r.Properties
+		return &props, nil
+	}
+
+	template, err := write(opts, "a")
+	require.NoError(t, err)
+	template.ColumnFamilyName = "default"
+	template.UserProperties["test.key-count"] = "100"
+	template.UserProperties["app.table-set"] = "1"
+
+	opts.PropertiesTemplate = template
+	props, err := write(opts, "a", "b", "c")
+	require.NoError(t, err)
+	require.Equal(t, "default", props.ColumnFamilyName)
+	require.Equal(t, template.ComparerName, props.ComparerName)
+	require.Equal(t, template.FilterPolicyName, props.FilterPolicyName)
+	require.Equal(t, template.PropertyCollectorNames, props.PropertyCollectorNames)
+	require.EqualValues(t, 3, props.NumEntries)
+	// The collector's property overrides the template's.
+	require.Equal(t, map[string]string{
+		"test.key-count": "3",
+		"app.table-set":  "1",
+	}, props.UserProperties)
+
+	// Names which don't match the template are rejected.
+	mismatched := opts
+	mismatched.Compression = NoCompression
+	_, err = write(mismatched, "a")
+	require.EqualError(t, err,
+		`pebble: compression "NoCompression" does not match properties template "Snappy"`)
+	mismatched = opts
+	mismatched.FilterPolicy = nil
+	_, err = write(mismatched, "a")
+	require.EqualError(t, err,
+		`pebble: filter policy "" does not match properties template "rocksdb.BuiltinBloomFilter"`)
+}
+
+func TestWriterFilterPolicyName(t *testing.T) {
+	w := NewWriter(&discardFile{}, WriterOptions{})
+	require.Equal(t, "", w.FilterPolicyName())
+	require.NoError(t, w.Close())
+
+	f := &memFile{}
+	w = NewWriter(f, WriterOptions{FilterPolicy: bloom.FilterPolicy(10)})
+	require.Equal(t, "rocksdb.BuiltinBloomFilter", w.FilterPolicyName())
+	require.NoError(t, w.Set([]byte("a"), []byte("a")))
+	require.NoError(t, w.Close())
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	require.Equal(t, w.FilterPolicyName(), r.Properties.FilterPolicyName)
+	require.NoError(t, r.Close())
+}
+
+func TestWriterWriteQueueSize(t *testing.T) {
+	testCases := []struct {
+		opts WriterOptions
+		want int
+	}{
+		{WriterOptions{}, 0},
+		{WriterOptions{WriteQueueSize: 3}, 0},
+		{WriterOptions{Parallelism: true}, runtime.GOMAXPROCS(0)},
+		{WriterOptions{Parallelism: true, WriteQueueSize: 1}, 1},
+		{WriterOptions{Parallelism: true, WriteQueueSize: 64}, 64},
+	}
+	for _, tc := range testCases {
+		tc.opts.BlockSize = 32
+		f := &memFile{}
+		w := NewWriter(f, tc.opts)
+		require.Equal(t, tc.want, cap(w.coordination.writeQueue.tasks))
+		for i := 0; i < 100; i++ {
+			require.NoError(t, w.Set([]byte(fmt.Sprintf("%04d", i)), nil))
+		}
+		require.NoError(t, w.Close())
+		r, err := NewMemReader(f.Data(), ReaderOptions{})
+		require.NoError(t, err)
+		require.EqualValues(t, 100, r.Properties.NumEntries)
+		require.NoError(t, r.Close())
+	}
+
+	w := NewWriter(&discardFile{}, WriterOptions{Parallelism: true, WriteQueueSize: -1})
+	require.EqualError(t, w.Close(), "pebble: invalid WriteQueueSize -1")
+}
+
+func TestWriterValidateBoundsConsistency(t *testing.T) {
+	testCases := []struct {
+		points        []string
+		start, end    string
+		expectedError string
+	}{
+		{[]string{"b", "d"}, "b", "d", ""},
+		{[]string{"b", "d"}, "c", "d", ""},
+		{nil, "a", "z", ""},
+		{[]string{"b", "d"}, "a", "c",
+			"pebble: range key start a is less than smallest point key b"},
+		{[]string{"b", "d"}, "c", "e",
+			"pebble: range key end e is greater than largest point key d"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v/%s-%s", tc.points, tc.start, tc.end), func(t *testing.T) {
+			for _, validate := range []bool{false, true} {
+				w := NewWriter(&discardFile{}, WriterOptions{
+					TableFormat:               TableFormatPebblev2,
+					ValidateBoundsConsistency: validate,
+				})
+				for _, k := range tc.points {
+					require.NoError(t, w.Set([]byte(k), nil))
+				}
+				require.NoError(t, w.RangeKeySet([]byte(tc.start), []byte(tc.end), nil, nil))
+				err := w.Close()
+				if !validate || tc.expectedError == "" {
+					require.NoError(t, err)
+				} else {
+					require.EqualError(t, err, tc.expectedError)
+				}
+			}
+		})
+	}
+}
+
+type syncCountingFile struct {
+	memFile
+	syncs     int
+	syncedLen int
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.syncs++
+	f.syncedLen = f.Len()
+	return nil
+}
+
+// blockingSyncFile is a memFile whose Sync blocks until release is closed,
+// and then returns syncErr.
+type blockingSyncFile struct {
+	memFile
+	release chan struct{}
+	syncErr error
+	closed  bool
+}
+
+func (f *blockingSyncFile) Sync() error {
+	<-f.release
+	return f.syncErr
+}
+
+func (f *blockingSyncFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestWriterAsyncFinish(t *testing.T) {
+	write := func(f *blockingSyncFile) *Writer {
+		w := NewWriter(f, WriterOptions{AsyncFinish: true})
+		require.NoError(t, w.Set([]byte("a"), []byte("value")))
+		require.EqualError(t, w.AwaitDurable(), "pebble: writer is not closed")
+		// Close returns while the sync is blocked.
+		require.NoError(t, w.Close())
+		meta, err := w.Metadata()
+		require.NoError(t, err)
+		require.Equal(t, uint64(f.Len()), meta.Size)
+		return w
+	}
+
+	f := &blockingSyncFile{release: make(chan struct{})}
+	w := write(f)
+	done := make(chan error, 1)
+	go func() { done <- w.AwaitDurable() }()
+	select {
+	case <-done:
+		t.Fatal("AwaitDurable returned before the sync completed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(f.release)
+	require.NoError(t, <-done)
+	require.True(t, f.closed)
+	// The finished table is readable.
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	// A sync error is returned by AwaitDurable, and the file is still closed.
+	f = &blockingSyncFile{release: make(chan struct{}), syncErr: errors.New("sync failed")}
+	close(f.release)
+	w = write(f)
+	require.EqualError(t, w.AwaitDurable(), "sync failed")
+	require.True(t, f.closed)
+
+	// Without AsyncFinish, Close syncs and AwaitDurable returns immediately.
+	w = NewWriter(&memFile{}, WriterOptions{})
+	require.NoError(t, w.Close())
+	require.NoError(t, w.AwaitDurable())
+
+	// If Close fails, AwaitDurable returns the error returned by Close, both
+	// when the sync fails and when an earlier error was latched.
+	f = &blockingSyncFile{release: make(chan struct{}), syncErr: errors.New("sync failed")}
+	close(f.release)
+	w = NewWriter(f, WriterOptions{})
+	require.EqualError(t, w.Close(), "sync failed")
+	require.EqualError(t, w.AwaitDurable(), "sync failed")
+	require.True(t, f.closed)
+
+	f = &blockingSyncFile{release: make(chan struct{})}
+	close(f.release)
+	w = NewWriter(f, WriterOptions{AsyncFinish: true, KeyBounds: UserKeyBounds{Upper: []byte("b")}})
+	require.Error(t, w.Set([]byte("c"), []byte("value")))
+	err = w.Close()
+	require.Error(t, err)
+	require.Equal(t, err, w.AwaitDurable())
+	require.True(t, f.closed)
+}
+
+func TestWriterPreFinishValidator(t *testing.T) {
+	errTooFewKeys := errors.New("too few keys")
+	for _, numKeys := range []int{1, 10} {
+		t.Run(fmt.Sprintf("keys=%d", numKeys), func(t *testing.T) {
+			// The file has a Flush method, so the Writer does not buffer the
+			// blocks it writes.
+			f := &syncCountingFile{}
+			var validated *WriterMetadata
+			w := NewWriter(f, WriterOptions{
+				PreFinishValidator: func(meta *WriterMetadata) error {
+					validated = meta
+					// Everything but the footer has been written.
+					require.Less(t, uint64(f.Len()), meta.Size)
+					if meta.Properties.NumEntries < 5 {
+						return errTooFewKeys
+					}
+					return nil
+				},
+			})
+			require.Nil(t, w.bufWriter)
+			for i := 0; i < numKeys; i++ {
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("value")))
+			}
+			err := w.Close()
+			require.NotNil(t, validated)
+			require.Equal(t, "00000000", string(validated.SmallestPoint.UserKey))
+			require.Equal(t, fmt.Sprintf("%08d", numKeys-1), string(validated.LargestPoint.UserKey))
+			if numKeys < 5 {
+				// The rejected table has no footer, and is not synced.
+				require.ErrorIs(t, err, errTooFewKeys)
+				require.Less(t, uint64(f.Len()), validated.Size)
+				_, err = NewMemReader(f.Data(), ReaderOptions{})
+				require.Error(t, err)
+				require.Zero(t, f.syncs)
+				return
+			}
+			require.NoError(t, err)
+			require.EqualValues(t, f.Len(), validated.Size)
+			require.Equal(t, 1, f.syncs)
+			meta, err := w.Metadata()
+			require.NoError(t, err)
+			require.Equal(t, meta, validated)
+		})
+	}
+}
+
+func TestWriterKeyRangeOverride(t *testing.T) {
+	key := func(k string, seqNum uint64) InternalKey {
+		return base.MakeInternalKey([]byte(k), seqNum, InternalKeyKindSet)
+	}
+	write := func(override KeyRange) (WriterMetadata, error) {
+		w := NewWriter(&memFile{}, WriterOptions{KeyRangeOverride: &override})
+		require.NoError(t, w.Set([]byte("c"), []byte("value")))
+		require.NoError(t, w.DeleteRange([]byte("d"), []byte("f")))
+		if err := w.Close(); err != nil {
+			return WriterMetadata{}, err
+		}
+		meta, err := w.Metadata()
+		require.NoError(t, err)
+		return *meta, nil
+	}
+
+	meta, err := write(KeyRange{Smallest: key("a", 1), Largest: key("z", 1)})
+	require.NoError(t, err)
+	require.Equal(t, key("a", 1), meta.SmallestPoint)
+	require.Equal(t, key("z", 1), meta.LargestPoint)
+	require.True(t, meta.HasPointKeys)
+
+	// The override may coincide with the physical keys: the exclusive end of
+	// the range deletion sorts before any key with the same user key.
+	_, err = write(KeyRange{Smallest: key("c", 0), Largest: key("f", 100)})
+	require.NoError(t, err)
+
+	// The override may not be narrower than the physical keys.
+	_, err = write(KeyRange{Smallest: key("d", 1), Largest: key("z", 1)})
+	require.EqualError(t, err, "pebble: key range override smallest d#1,SET is greater than smallest key c#0,SET")
+	_, err = write(KeyRange{Smallest: key("a", 1), Largest: key("e", 1)})
+	require.EqualError(t, err, "pebble: key range override largest e#1,SET is less than largest key f#72057594037927935,RANGEDEL")
+	_, err = write(KeyRange{Smallest: key("z", 1), Largest: key("a", 1)})
+	require.EqualError(t, err, "pebble: key range override smallest z#1,SET is greater than largest a#1,SET")
+}
+
+func TestWriterExpectedRangeDelBounds(t *testing.T) {
+	key := func(k string, seqNum uint64, kind InternalKeyKind) InternalKey {
+		return base.MakeInternalKey([]byte(k), seqNum, kind)
+	}
+	write := func(bounds KeyRange, dels ...[2]string) error {
+		w := NewWriter(&memFile{}, WriterOptions{ExpectedRangeDelBounds: &bounds})
+		require.NoError(t, w.Set([]byte("a"), []byte("value")))
+		for _, d := range dels {
+			require.NoError(t, w.DeleteRange([]byte(d[0]), []byte(d[1])))
+		}
+		return w.Close()
+	}
+	bounds := KeyRange{
+		Smallest: key("c", base.InternalKeySeqNumMax, InternalKeyKindRangeDelete),
+		Largest:  base.MakeRangeDeleteSentinelKey([]byte("g")),
+	}
+
+	// Tombstones within the bounds, including ones coinciding with them.
+	require.NoError(t, write(bounds, [2]string{"c", "e"}, [2]string{"e", "g"}))
+	require.NoError(t, write(bounds, [2]string{"d", "f"}))
+	// A table without tombstones is not checked.
+	require.NoError(t, write(bounds))
+
+	// Tombstones escaping the bounds.
+	require.EqualError(t, write(bounds, [2]string{"b", "e"}),
+		"pebble: smallest range deletion key b#0,RANGEDEL is less than expected smallest c#72057594037927935,RANGEDEL")
+	require.EqualError(t, write(bounds, [2]string{"c", "h"}),
+		"pebble: largest range deletion key h#72057594037927935,RANGEDEL is greater than expected largest g#72057594037927935,RANGEDEL")
+}
+
+func TestWriterSync(t *testing.T) {
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			f := &syncCountingFile{}
+			w := NewWriter(f, WriterOptions{BlockSize: 64, Parallelism: parallelism})
+			for i := 0; i < 100; i++ {
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("value")))
+			}
+			require.NoError(t, w.Sync())
+			require.Equal(t, 1, f.syncs)
+			// Every finished data block has been written and synced.
+			require.Equal(t, w.coordination.sizeEstimate.size(), uint64(f.syncedLen))
+			// Sync is idempotent.
+			require.NoError(t, w.Sync())
+			require.Equal(t, 2, f.syncs)
+			require.Equal(t, w.coordination.sizeEstimate.size(), uint64(f.syncedLen))
+			require.NoError(t, w.Close())
+		})
+	}
+
+	// An error encountered by the write queue is surfaced by Sync.
+	w := NewWriter(&memFile{}, WriterOptions{BlockSize: 1, Parallelism: true})
+	w.coordination.writeQueue.err = errors.New("write queue write error")
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.NoError(t, w.Set([]byte("b"), nil))
+	require.EqualError(t, w.Sync(), "write queue write error")
+	require.Error(t, w.Set([]byte("c"), nil))
+}
+
+func TestWriterRestartPoints(t *testing.T) {
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			w := NewWriter(&memFile{}, WriterOptions{
+				BlockRestartInterval: 4,
+				FixedBlockEntryCount: 16,
+				Parallelism:          parallelism,
+			})
+			for i := 0; i < 100; i++ {
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("value")))
+			}
+			require.NoError(t, w.Close())
+			meta, err := w.Metadata()
+			require.NoError(t, err)
+			// Six blocks of 16 entries hold 4 restart points each, and the final
+			// block of 4 entries holds 1.
+			require.EqualValues(t, 7, meta.Properties.NumDataBlocks)
+			require.EqualValues(t, 25, meta.TotalRestartPoints)
+			require.InDelta(t, 25.0/7, meta.MeanRestartPointsPerDataBlock(), 1e-9)
+			require.EqualValues(t, 4, meta.MaxRestartSpan)
+		})
+	}
+
+	// A table without point keys holds a single empty data block with one
+	// restart point.
+	w := NewWriter(&memFile{}, WriterOptions{})
+	require.NoError(t, w.Close())
+	meta, err := w.Metadata()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, meta.TotalRestartPoints)
+	require.EqualValues(t, 1, meta.MeanRestartPointsPerDataBlock())
+	require.EqualValues(t, 0, meta.MaxRestartSpan)
+
+	// Blocks shorter than the restart interval span fewer entries.
+	w = NewWriter(&memFile{}, WriterOptions{BlockRestartInterval: 16, FixedBlockEntryCount: 3})
+	for i := 0; i < 10; i++ {
+		require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("value")))
+	}
+	require.NoError(t, w.Close())
+	meta, err = w.Metadata()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, meta.MaxRestartSpan)
+}
+
+func TestWriterDataBlockHash(t *testing.T) {
+	blockHash := &BlockHash{Name: "sha256", New: sha256.New}
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			f := &memFile{}
+			w := NewWriter(f, WriterOptions{
+				BlockSize:     256,
+				Compression:   SnappyCompression,
+				DataBlockHash: blockHash,
+				FilterPolicy:  bloom.FilterPolicy(10),
+				Parallelism:   parallelism,
+				TableFormat:   TableFormatPebblev2,
+			})
+			for i := 0; i < 1000; i++ {
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("value")))
+			}
+			require.NoError(t, w.RangeKeySet([]byte("a"), []byte("b"), nil, []byte("v")))
+			require.NoError(t, w.Close())
+
+			r, err := NewMemReader(f.Data(), ReaderOptions{})
+			require.NoError(t, err)
+			defer r.Close()
+			require.Equal(t, "sha256", r.Properties.DataBlockHashName)
+			hashes, err := r.DataBlockHashes()
+			require.NoError(t, err)
+			l, err := r.Layout()
+			require.NoError(t, err)
+			require.Len(t, hashes, len(l.Data))
+			for i := range l.Data {
+				h, err := r.readBlock(l.Data[i].BlockHandle, nil /* transform */, nil /* readaheadState */, nil /* stats */)
+				require.NoError(t, err)
+				sum := sha256.Sum256(h.Get())
+				h.Release()
+				require.Equal(t, sum[:], hashes[l.Data[i].Offset])
+			}
+
+			// The table is otherwise unaffected.
+			iter, err := r.NewIter(nil, nil)
+			require.NoError(t, err)
+			var n int
+			for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+				n++
+			}
+			require.NoError(t, iter.Close())
+			require.Equal(t, 1000, n)
+			rangeKeyIter, err := r.NewRawRangeKeyIter()
+			require.NoError(t, err)
+			require.NotNil(t, rangeKeyIter.First())
+			require.NoError(t, rangeKeyIter.Close())
+		})
+	}
+
+	// Tables written without a hash record none.
+	f := &memFile{}
+	w := NewWriter(f, WriterOptions{})
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.NoError(t, w.Close())
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	hashes, err := r.DataBlockHashes()
+	require.NoError(t, err)
+	require.Nil(t, hashes)
+	require.NoError(t, r.Close())
+}
+
+func TestWriterFullKeyIndexSeparators(t *testing.T) {
+	const numKeys = 1000
+	write := func(full bool) (*WriterMetadata, []byte) {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			BlockSize:              512,
+			Compression:            NoCompression,
+			FullKeyIndexSeparators: full,
+			IndexBlockSize:         math.MaxInt32,
+		})
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("%08d-a-long-suffix-distinct-from-the-next-key", i))
+			require.NoError(t, w.Set(key, []byte("value")))
+		}
+		require.NoError(t, w.Close())
+		meta, err := w.Metadata()
+		require.NoError(t, err)
+		return meta, f.Data()
+	}
+
+	shortened, _ := write(false)
+	meta, data := write(true)
+	require.Equal(t, shortened.Properties.NumDataBlocks, meta.Properties.NumDataBlocks)
+	// The shortened separators elide the long key suffixes, so the full keys
+	// substantially enlarge the index.
+	sizeCost := float64(meta.Properties.IndexSize) / float64(shortened.Properties.IndexSize)
+	t.Logf("index size: %d bytes with shortened separators, %d bytes with full keys (%.2fx)",
+		shortened.Properties.IndexSize, meta.Properties.IndexSize, sizeCost)
+	require.Greater(t, sizeCost, 1.5)
+
+	// Each separator is the last key of its data block.
+	r, err := NewMemReader(data, ReaderOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+	indexH, err := r.readIndex(nil /* stats */)
+	require.NoError(t, err)
+	defer indexH.Release()
+	indexIter, err := newBlockIter(r.Compare, indexH.Get())
+	require.NoError(t, err)
+	var blocks int
+	for sep, value := indexIter.First(); sep != nil; sep, value = indexIter.Next() {
+		bhp, err := decodeBlockHandleWithProperties(value)
+		require.NoError(t, err)
+		h, err := r.readBlock(bhp.BlockHandle, nil /* transform */, nil /* readaheadState */, nil /* stats */)
+		require.NoError(t, err)
+		dataIter, err := newBlockIter(r.Compare, h.Get())
+		require.NoError(t, err)
+		last, _ := dataIter.Last()
+		require.Equal(t, last.String(), sep.String())
+		require.NoError(t, dataIter.Close())
+		h.Release()
+		blocks++
+	}
+	require.NoError(t, indexIter.Close())
+	require.EqualValues(t, meta.Properties.NumDataBlocks, blocks)
+
+	// The table reads back as usual.
+	iter, err := r.NewIter(nil, nil)
+	require.NoError(t, err)
+	var n int
+	for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+		n++
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, numKeys, n)
+}
+
+func TestWriterDataBlockFirstByteRanges(t *testing.T) {
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			f := &memFile{}
+			w := NewWriter(f, WriterOptions{
+				BlockSize:                256,
+				DataBlockFirstByteRanges: true,
+				Parallelism:              parallelism,
+				TableFormat:              TableFormatPebblev2,
+			})
+			require.NoError(t, w.Set(nil, []byte("empty")))
+			for c := byte('a'); c <= 'z'; c++ {
+				for i := 0; i < 20; i++ {
+					require.NoError(t, w.Set([]byte(fmt.Sprintf("%c%08d", c, i)), []byte("value")))
+				}
+			}
+			require.NoError(t, w.Close())
+
+			r, err := NewMemReader(f.Data(), ReaderOptions{})
+			require.NoError(t, err)
+			defer r.Close()
+			ranges, err := r.DataBlockFirstByteRanges()
+			require.NoError(t, err)
+			l, err := r.Layout()
+			require.NoError(t, err)
+			require.Len(t, ranges, len(l.Data))
+			for i := range l.Data {
+				h, err := r.readBlock(l.Data[i].BlockHandle, nil /* transform */, nil /* readaheadState */, nil /* stats */)
+				require.NoError(t, err)
+				iter, err := newBlockIter(r.Compare, h.Get())
+				require.NoError(t, err)
+				first, _ := iter.First()
+				if len(first.UserKey) == 0 {
+					first, _ = iter.Next()
+				}
+				minFirstByte := first.UserKey[0]
+				last, _ := iter.Last()
+				require.Equal(t, [2]byte{minFirstByte, last.UserKey[0]}, ranges[l.Data[i].Offset])
+				require.NoError(t, iter.Close())
+				h.Release()
+			}
+		})
+	}
+
+	// Tables written without the option record none.
+	f := &memFile{}
+	w := NewWriter(f, WriterOptions{})
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.NoError(t, w.Close())
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	ranges, err := r.DataBlockFirstByteRanges()
+	require.NoError(t, err)
+	require.Nil(t, ranges)
+	require.NoError(t, r.Close())
+}
+
+func TestWriterMarkNextBlockPinned(t *testing.T) {
+	// The keys before which MarkNextBlockPinned is called. Keys 70 and 71 are
+	// expected to share a block.
+	pinnedKeys := map[int]bool{0: true, 50: true, 70: true, 71: true, 99: true}
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			f := &memFile{}
+			w := NewWriter(f, WriterOptions{BlockSize: 64, Parallelism: parallelism})
+			for i := 0; i < 100; i++ {
+				if pinnedKeys[i] {
+					w.MarkNextBlockPinned()
+				}
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("value")))
+			}
+			require.NoError(t, w.Close())
+
+			r, err := NewMemReader(f.Data(), ReaderOptions{})
+			require.NoError(t, err)
+			defer r.Close()
+			l, err := r.Layout()
+			require.NoError(t, err)
+			require.Greater(t, len(l.Data), 10)
+
+			// Find the offsets of the blocks holding the pinned keys.
+			var expected []uint64
+			for _, bh := range l.Data {
+				h, err := r.readBlock(bh.BlockHandle, nil /* transform */, nil /* readaheadState */, nil /* stats */)
+				require.NoError(t, err)
+				iter, err := newBlockIter(r.Compare, h.Get())
+				require.NoError(t, err)
+				for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+					i, err := strconv.Atoi(string(k.UserKey))
+					require.NoError(t, err)
+					if pinnedKeys[i] {
+						expected = append(expected, bh.Offset)
+						break
+					}
+				}
+				require.NoError(t, iter.Close())
+				h.Release()
+			}
+			require.Len(t, expected, 4)
+
+			offsets, err := r.PinnedBlockOffsets()
+			require.NoError(t, err)
+			require.Equal(t, expected, offsets)
+		})
+	}
+
+	// Tables without pinned blocks record none.
+	f := &memFile{}
+	w := NewWriter(f, WriterOptions{})
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.NoError(t, w.Close())
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	offsets, err := r.PinnedBlockOffsets()
+	require.NoError(t, err)
+	require.Nil(t, offsets)
+	require.NoError(t, r.Close())
+}
+
+func TestWriterDisablePrefixCompression(t *testing.T) {
+	const numKeys = 1000
+	write := func(disable bool) (*WriterMetadata, []byte) {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			AdaptiveRestartInterval:  true,
+			Compression:              NoCompression,
+			DisablePrefixCompression: disable,
+		})
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("a-long-prefix-shared-by-every-key-%08d", i))
+			require.NoError(t, w.Set(key, []byte("value")))
+		}
+		require.NoError(t, w.Close())
+		meta, err := w.Metadata()
+		require.NoError(t, err)
+		return meta, f.Data()
+	}
+
+	compressed, _ := write(false)
+	meta, data := write(true)
+	require.EqualValues(t, numKeys, meta.TotalRestartPoints)
+	// The key prefixes are no longer elided, so the data blocks are
+	// substantially larger.
+	sizeCost := float64(meta.Properties.DataSize) / float64(compressed.Properties.DataSize)
+	t.Logf("data size: %d bytes with prefix compression, %d bytes without (%.2fx)",
+		compressed.Properties.DataSize, meta.Properties.DataSize, sizeCost)
+	require.Greater(t, sizeCost, 1.5)
+
+	// Every entry of every data block stores its full key.
+	r, err := NewMemReader(data, ReaderOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+	l, err := r.Layout()
+	require.NoError(t, err)
+	var entries int
+	for i := range l.Data {
+		h, err := r.readBlock(l.Data[i].BlockHandle, nil /* transform */, nil /* readaheadState */, nil /* stats */)
+		require.NoError(t, err)
+		b := h.Get()
+		numRestarts := int(binary.LittleEndian.Uint32(b[len(b)-4:]))
+		b = b[:len(b)-4*(numRestarts+1)]
+		for len(b) > 0 {
+			shared, n1 := binary.Uvarint(b)
+			unshared, n2 := binary.Uvarint(b[n1:])
+			valueLen, n3 := binary.Uvarint(b[n1+n2:])
+			require.Zero(t, shared)
+			b = b[n1+n2+n3+int(unshared)+int(valueLen):]
+			entries++
+		}
+		h.Release()
+	}
+	require.Equal(t, numKeys, entries)
+}
+
+func TestWriterAdaptiveRestartInterval(t *testing.T) {
+	const numKeys = 256
+	const blockEntries = 64
+	sharedKeys := make([][]byte, numKeys)
+	randomKeys := make([][]byte, numKeys)
+	rng := rand.New(rand.NewSource(1))
+	for i := range sharedKeys {
+		sharedKeys[i] = []byte(fmt.Sprintf("a-long-prefix-shared-by-every-key-%08d", i))
+		randomKeys[i] = make([]byte, 32)
+		rng.Read(randomKeys[i])
+	}
+	sort.Slice(randomKeys, func(i, j int) bool {
+		return bytes.Compare(randomKeys[i], randomKeys[j]) < 0
+	})
+
+	testCases := []struct {
+		name     string
+		keys     [][]byte
+		adaptive bool
+		// restarts is the expected number of restart points. Each of the four
+		// blocks holds 64 keys, and so 4 restart points at an interval of 16.
+		restarts uint64
+		// maxSpan is the largest restart interval used.
+		maxSpan uint64
+	}{
+		{"shared", sharedKeys, false, 4 * 4, 16},
+		// Blocks after the first use an interval of 32.
+		{"shared-adaptive", sharedKeys, true, 4 + 3*2, 32},
+		{"random", randomKeys, false, 4 * 4, 16},
+		// Blocks after the first use an interval of 8.
+		{"random-adaptive", randomKeys, true, 4 + 3*8, 16},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &memFile{}
+			w := NewWriter(f, WriterOptions{
+				BlockRestartInterval:    16,
+				FixedBlockEntryCount:    blockEntries,
+				AdaptiveRestartInterval: tc.adaptive,
+			})
+			for _, k := range tc.keys {
+				require.NoError(t, w.Set(k, nil))
+			}
+			require.NoError(t, w.Close())
+			meta, err := w.Metadata()
+			require.NoError(t, err)
+			require.EqualValues(t, numKeys/blockEntries, meta.Properties.NumDataBlocks)
+			require.Equal(t, tc.restarts, meta.TotalRestartPoints)
+			require.Equal(t, tc.maxSpan, meta.MaxRestartSpan)
+
+			// Every key can be found.
+			r, err := NewMemReader(f.Data(), ReaderOptions{})
+			require.NoError(t, err)
+			defer r.Close()
+			iter, err := r.NewIter(nil, nil)
+			require.NoError(t, err)
+			defer iter.Close()
+			for _, k := range tc.keys {
+				ikey, _ := iter.SeekGE(k, base.SeekGEFlagsNone)
+				require.NotNil(t, ikey)
+				require.Equal(t, k, ikey.UserKey)
+			}
+		})
+	}
+}
+
+func TestWriterIndexOffset(t *testing.T) {
+	for _, indexBlockSize := range []int{1 << 20, 1} {
+		t.Run(fmt.Sprintf("indexBlockSize=%d", indexBlockSize), func(t *testing.T) {
+			f := &memFile{}
+			w := NewWriter(f, WriterOptions{
+				BlockSize:      64,
+				IndexBlockSize: indexBlockSize,
+				TableFormat:    TableFormatPebblev1,
+			})
+			for i := 0; i < 100; i++ {
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("value")))
+			}
+			require.NoError(t, w.Close())
+			meta, err := w.Metadata()
+			require.NoError(t, err)
+
+			r, err := NewMemReader(f.Data(), ReaderOptions{})
+			require.NoError(t, err)
+			defer r.Close()
+			l, err := r.Layout()
+			require.NoError(t, err)
+			if indexBlockSize == 1 {
+				require.Equal(t, l.TopIndex.Offset, meta.IndexOffset)
+			} else {
+				require.Equal(t, l.Index[0].Offset, meta.IndexOffset)
+			}
+			require.Equal(t, r.Properties.DataSize, meta.Properties.DataSize)
+			require.LessOrEqual(t, meta.Properties.DataSize, meta.IndexOffset)
+		})
+	}
+}
+
+func TestWriterBlockTombstoneFraction(t *testing.T) {
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			w := NewWriter(&memFile{}, WriterOptions{
+				FixedBlockEntryCount: 4,
+				Parallelism:          parallelism,
+			})
+			// Blocks of 4 entries, with tombstone fractions 1, 0.5, 0 and, for
+			// the final block of 2 entries, 0.5.
+			kinds := []InternalKeyKind{
+				InternalKeyKindDelete, InternalKeyKindDelete,
+				base.InternalKeyKindSingleDelete, InternalKeyKindDelete,
+				InternalKeyKindSet, InternalKeyKindDelete,
+				InternalKeyKindMerge, base.InternalKeyKindSingleDelete,
+				InternalKeyKindSet, InternalKeyKindSet,
+				InternalKeyKindMerge, InternalKeyKindSet,
+				InternalKeyKindDelete, InternalKeyKindSet,
+			}
+			for i, kind := range kinds {
+				key := base.MakeInternalKey([]byte(fmt.Sprintf("%08d", i)), 0, kind)
+				require.NoError(t, w.Add(key, nil))
+			}
+			require.NoError(t, w.Close())
+			meta, err := w.Metadata()
+			require.NoError(t, err)
+			require.EqualValues(t, 4, meta.Properties.NumDataBlocks)
+			require.Equal(t, 1.0, meta.MaxBlockTombstoneFraction)
+			require.Equal(t, 0.5, meta.MeanBlockTombstoneFraction)
+		})
+	}
+
+	w := NewWriter(&memFile{}, WriterOptions{})
+	require.NoError(t, w.Close())
+	meta, err := w.Metadata()
+	require.NoError(t, err)
+	require.Equal(t, 0.0, meta.MaxBlockTombstoneFraction)
+	require.Equal(t, 0.0, meta.MeanBlockTombstoneFraction)
+}
+
+func TestWriterBlockPropertySizes(t *testing.T) {
+	w := NewWriter(&memFile{}, WriterOptions{
+		BlockSize:   64,
+		TableFormat: TableFormatPebblev1,
+		BlockPropertyCollectors: []func() BlockPropertyCollector{
+			func() BlockPropertyCollector {
+				return NewBlockIntervalCollector(
+					"interval", &valueCharBlockIntervalCollector{charIdx: 0}, nil)
+			},
+			func() BlockPropertyCollector { return &testBlockPropCollector{} },
+		},
+	})
+	for i := 0; i < 100; i++ {
+		require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte(fmt.Sprint(i%10))))
+	}
+	require.NoError(t, w.Close())
+	meta, err := w.Metadata()
+	require.NoError(t, err)
+	require.Len(t, meta.BlockPropertySizes, 2)
+	require.Greater(t, meta.BlockPropertySizes["interval"], uint64(0))
+	require.Equal(t, uint64(0), meta.BlockPropertySizes["testBlockPropCollector"])
+
+	// Without block property collectors, no sizes are reported.
+	w = NewWriter(&memFile{}, WriterOptions{})
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.NoError(t, w.Close())
+	meta, err = w.Metadata()
+	require.NoError(t, err)
+	require.Nil(t, meta.BlockPropertySizes)
+}
+
+func TestWriterSelfCheckBlocks(t *testing.T) {
+	for _, compression := range []Compression{NoCompression, SnappyCompression, ZstdCompression} {
+		for _, parallelism := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/parallelism=%t", compression, parallelism), func(t *testing.T) {
+				w := NewWriter(&memFile{}, WriterOptions{
+					BlockSize:       128,
+					Compression:     compression,
+					Checksum:        ChecksumTypeXXHash64,
+					Parallelism:     parallelism,
+					SelfCheckBlocks: true,
+				})
+				for i := 0; i < 1000; i++ {
+					require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), bytes.Repeat([]byte("v"), i%20)))
+				}
+				require.NoError(t, w.Close())
+			})
+		}
+	}
+
+	// A block that doesn't round-trip is reported.
+	w := NewWriter(&memFile{}, WriterOptions{SelfCheckBlocks: true})
+	buf := blockBuf{checksummer: checksummer{checksumType: ChecksumTypeCRC32c}}
+	block := bytes.Repeat([]byte("hello world"), 10)
+	b := compressAndChecksum(block, SnappyCompression, &buf)
+	require.Less(t, len(b), len(block))
+	bh := BlockHandle{Length: uint64(len(b))}
+	require.NoError(t, w.checkBlock(bh, block, b, buf.tmp[:]))
+	require.Error(t, w.checkBlock(bh, block[1:], b, buf.tmp[:]))
+	buf.tmp[1]++
+	require.Error(t, w.checkBlock(bh, block, b, buf.tmp[:]))
+	require.NoError(t, w.Close())
+}
+
+func TestWriterOmitEmptyPointBlocks(t *testing.T) {
+	build := func(omit, points bool) []byte {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			Comparer:             testkeys.Comparer,
+			TableFormat:          TableFormatPebblev3,
+			OmitEmptyPointBlocks: omit,
+		})
+		if points {
+			require.NoError(t, w.Set([]byte("a"), []byte("b")))
+		}
+		require.NoError(t, w.RangeKeySet([]byte("a"), []byte("c"), testkeys.Suffix(1), nil))
+		require.NoError(t, w.Close())
+		return f.Data()
+	}
+	open := func(data []byte) *Reader {
+		r, err := NewMemReader(data, ReaderOptions{Comparer: testkeys.Comparer})
+		require.NoError(t, err)
+		return r
+	}
+
+	data := build(true /* omit */, false /* points */)
+	require.Less(t, len(data), len(build(false /* omit */, false /* points */)))
+	r := open(data)
+	defer r.Close()
+	require.True(t, r.Properties.NoPointBlocks)
+
+	iter, err := r.NewIter(nil, nil)
+	require.NoError(t, err)
+	k, _ := iter.First()
+	require.Nil(t, k)
+	k, _ = iter.SeekGE([]byte("a"), base.SeekGEFlagsNone)
+	require.Nil(t, k)
+	require.NoError(t, iter.Close())
+
+	rangeKeyIter, err := r.NewRawRangeKeyIter()
+	require.NoError(t, err)
+	require.NotNil(t, rangeKeyIter.First())
+	require.NoError(t, rangeKeyIter.Close())
+
+	l, err := r.Layout()
+	require.NoError(t, err)
+	require.Empty(t, l.Data)
+	require.Empty(t, l.Index)
+	require.NoError(t, r.ValidateBlockChecksums())
+	size, err := r.EstimateDiskUsage([]byte("a"), []byte("z"))
+	require.NoError(t, err)
+	require.Zero(t, size)
+
+	// The option has no effect on a table with point keys.
+	r2 := open(build(true /* omit */, true /* points */))
+	defer r2.Close()
+	require.False(t, r2.Properties.NoPointBlocks)
+	iter, err = r2.NewIter(nil, nil)
+	require.NoError(t, err)
+	k, _ = iter.First()
+	require.Equal(t, "a", string(k.UserKey))
+	require.NoError(t, iter.Close())
+
+	// A table of range deletions alone, as produced by mass deletions, is
+	// written as just the range deletion, properties and metaindex blocks.
+	buildRangeDels := func(format TableFormat, omit bool) []byte {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			Comparer:             testkeys.Comparer,
+			TableFormat:          format,
+			OmitEmptyPointBlocks: omit,
+		})
+		for i := 0; i < 10; i++ {
+			require.NoError(t, w.DeleteRange([]byte(fmt.Sprintf("%02d", 2*i)), []byte(fmt.Sprintf("%02d", 2*i+1))))
+		}
+		require.NoError(t, w.Close())
+		return f.Data()
+	}
+	data = buildRangeDels(TableFormatPebblev3, true /* omit */)
+	require.Less(t, len(data), len(buildRangeDels(TableFormatPebblev3, false /* omit */)))
+	r3 := open(data)
+	defer r3.Close()
+	require.True(t, r3.Properties.NoPointBlocks)
+	require.EqualValues(t, 10, r3.Properties.NumRangeDeletions)
+	l, err = r3.Layout()
+	require.NoError(t, err)
+	require.Empty(t, l.Data)
+	require.Empty(t, l.Index)
+	require.NotZero(t, l.RangeDel.Length)
+	iter, err = r3.NewIter(nil, nil)
+	require.NoError(t, err)
+	k, _ = iter.First()
+	require.Nil(t, k)
+	require.NoError(t, iter.Close())
+	rangeDelIter, err := r3.NewRawRangeDelIter()
+	require.NoError(t, err)
+	n := 0
+	for s := rangeDelIter.First(); s != nil; s = rangeDelIter.Next() {
+		n++
+	}
+	require.Equal(t, 10, n)
+	require.NoError(t, rangeDelIter.Close())
+
+	// The option is ignored by table formats which predate Pebblev3, which
+	// readers of those formats could not otherwise read.
+	data = buildRangeDels(TableFormatRocksDBv2, true /* omit */)
+	require.Equal(t, buildRangeDels(TableFormatRocksDBv2, false /* omit */), data)
+	r4 := open(data)
+	defer r4.Close()
+	require.False(t, r4.Properties.NoPointBlocks)
+	l, err = r4.Layout()
+	require.NoError(t, err)
+	require.Len(t, l.Data, 1)
+	require.Len(t, l.Index, 1)
+}
+
+func TestWriterKeyRange(t *testing.T) {
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			w := NewWriter(&memFile{}, WriterOptions{BlockSize: 64, Parallelism: parallelism})
+			_, _, ok := w.KeyRange()
+			require.False(t, ok)
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("%08d", i))
+				require.NoError(t, w.Set(key, []byte("value")))
+				smallest, largest, ok := w.KeyRange()
+				require.True(t, ok)
+				require.Equal(t, "00000000", string(smallest.UserKey))
+				require.Equal(t, string(key), string(largest.UserKey))
+				require.Equal(t, InternalKeyKindSet, largest.Kind())
+			}
+			require.NoError(t, w.Close())
+			// After Close, the range is that of the finished table.
+			smallest, largest, ok := w.KeyRange()
+			require.True(t, ok)
+			require.Equal(t, "00000000", string(smallest.UserKey))
+			require.Equal(t, "00000099", string(largest.UserKey))
+		})
+	}
+}
+
+func TestWriterRequirePreFragmentedRangeKeys(t *testing.T) {
+	f := &memFile{}
+	w := NewWriter(f, WriterOptions{
+		Comparer:                      testkeys.Comparer,
+		TableFormat:                   TableFormatPebblev2,
+		ContinueOnValidationError:     true,
+		RequirePreFragmentedRangeKeys: true,
+	})
+	require.NoError(t, w.RangeKeySet([]byte("a"), []byte("c"), []byte("@1"), nil))
+	// Spans with identical bounds are permitted, and are coalesced.
+	require.NoError(t, w.RangeKeySet([]byte("a"), []byte("c"), []byte("@2"), nil))
+	require.EqualError(t, w.RangeKeyUnset([]byte("b"), []byte("d"), []byte("@3")),
+		"pebble: overlapping range keys must be fragmented: [a, c), [b, d)")
+	require.EqualError(t, w.RangeKeyDelete([]byte("a"), []byte("b")),
+		"pebble: overlapping range keys must be fragmented: [a, c), [a, b)")
+	// Abutting spans do not overlap.
+	require.NoError(t, w.RangeKeyDelete([]byte("c"), []byte("d")))
+	require.NoError(t, w.Close())
+
+	r, err := NewMemReader(f.Data(), ReaderOptions{Comparer: testkeys.Comparer})
+	require.NoError(t, err)
+	defer r.Close()
+	iter, err := r.NewRawRangeKeyIter()
+	require.NoError(t, err)
+	defer iter.Close()
+	var spans []string
+	for s := iter.First(); s != nil; s = iter.Next() {
+		spans = append(spans, s.String())
+	}
+	require.Equal(t, []string{
+		"a-c:{(#0,RANGEKEYSET,@2) (#0,RANGEKEYSET,@1)}",
+		"c-d:{(#0,RANGEKEYDEL)}",
+	}, spans)
+
+	// By default, overlapping spans are fragmented.
+	w = NewWriter(&memFile{}, WriterOptions{
+		Comparer:    testkeys.Comparer,
+		TableFormat: TableFormatPebblev2,
+	})
+	require.NoError(t, w.RangeKeySet([]byte("a"), []byte("c"), []byte("@1"), nil))
+	require.NoError(t, w.RangeKeyUnset([]byte("b"), []byte("d"), []byte("@3")))
+	require.NoError(t, w.Close())
+}
+
+func TestWriterBufferAndSortRangeKeys(t *testing.T) {
+	opts := WriterOptions{
+		Comparer:               testkeys.Comparer,
+		TableFormat:            TableFormatPebblev2,
+		BufferAndSortRangeKeys: true,
+	}
+	f := &memFile{}
+	w := NewWriter(f, opts)
+	require.NoError(t, w.RangeKeyDelete([]byte("e"), []byte("f")))
+	require.NoError(t, w.RangeKeySet([]byte("b"), []byte("d"), []byte("@1"), []byte("v")))
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.NoError(t, w.RangeKeyUnset([]byte("a"), []byte("c"), []byte("@2")))
+	require.NoError(t, w.Set([]byte("z"), nil))
+	require.NoError(t, w.Close())
+
+	r, err := NewMemReader(f.Data(), ReaderOptions{Comparer: testkeys.Comparer})
+	require.NoError(t, err)
+	defer r.Close()
+	iter, err := r.NewRawRangeKeyIter()
+	require.NoError(t, err)
+	defer iter.Close()
+	var spans []string
+	for s := iter.First(); s != nil; s = iter.Next() {
+		spans = append(spans, s.String())
+	}
+	require.Equal(t, []string{
+		"a-b:{(#0,RANGEKEYUNSET,@2)}",
+		"b-c:{(#0,RANGEKEYSET,@1,v) (#0,RANGEKEYUNSET,@2)}",
+		"c-d:{(#0,RANGEKEYSET,@1,v)}",
+		"e-f:{(#0,RANGEKEYDEL)}",
+	}, spans)
+
+	// Spans beyond the limit are rejected.
+	opts.MaxBufferedRangeKeys = 2
+	w = NewWriter(&memFile{}, opts)
+	require.NoError(t, w.RangeKeyDelete([]byte("c"), []byte("d")))
+	require.NoError(t, w.RangeKeyDelete([]byte("a"), []byte("b")))
+	require.EqualError(t, w.RangeKeyDelete([]byte("e"), []byte("f")),
+		"pebble: more than 2 range key spans buffered")
+	require.Error(t, w.Close())
+
+	// Overlapping spans which are required to be fragmented are reported by
+	// Close.
+	opts.MaxBufferedRangeKeys = 0
+	opts.RequirePreFragmentedRangeKeys = true
+	w = NewWriter(&memFile{}, opts)
+	require.NoError(t, w.RangeKeyDelete([]byte("b"), []byte("d")))
+	require.NoError(t, w.RangeKeyDelete([]byte("a"), []byte("c")))
+	require.EqualError(t, w.Close(),
+		"pebble: overlapping range keys must be fragmented: [a, c), [b, d)")
+}
+
+func TestWriterFilterKeyTransform(t *testing.T) {
+	// The transform keeps the first two bytes of each key prefix.
+	transform := &FilterKeyTransform{
+		Name: "first-two-bytes",
+		Transform: func(key, dst []byte) []byte {
+			if len(key) > 2 {
+				key = key[:2]
+			}
+			return append(dst, key...)
+		},
+	}
+	fp := bloom.FilterPolicy(10)
+	f := &memFile{}
+	w := NewWriter(f, WriterOptions{
+		Comparer:           testkeys.Comparer,
+		FilterPolicy:       fp,
+		FilterKeyTransform: transform,
+	})
+	for _, k := range []string{"apple@1", "apricot@2", "banana@1"} {
+		require.NoError(t, w.Set([]byte(k), nil))
+	}
+	require.NoError(t, w.Close())
+
+	open := func(transform *FilterKeyTransform) *Reader {
+		r, err := NewMemReader(f.Data(), ReaderOptions{
+			Comparer:           testkeys.Comparer,
+			Filters:            map[string]FilterPolicy{fp.Name(): fp},
+			FilterKeyTransform: transform,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "first-two-bytes", r.Properties.FilterKeyTransformName)
+		return r
+	}
+	mayContain := func(r *Reader, prefix string) bool {
+		ok, err := r.FilterMayContain([]byte(prefix), false /* exact */)
+		require.NoError(t, err)
+		return ok
+	}
+
+	r := open(transform)
+	require.NotNil(t, r.tableFilter)
+	// Any prefix sharing the first two bytes of a written prefix matches.
+	require.True(t, mayContain(r, "apple"))
+	require.True(t, mayContain(r, "apex"))
+	require.True(t, mayContain(r, "bad"))
+	require.False(t, mayContain(r, "cherry"))
+	iter, err := r.NewIter(nil, nil)
+	require.NoError(t, err)
+	k, _ := iter.SeekPrefixGE([]byte("cherry"), []byte("cherry@1"), base.SeekGEFlagsNone)
+	require.Nil(t, k)
+	k, _ = iter.SeekPrefixGE([]byte("banana"), []byte("banana@1"), base.SeekGEFlagsNone)
+	require.NotNil(t, k)
+	require.Equal(t, "banana@1", string(k.UserKey))
+	require.NoError(t, iter.Close())
+	require.NoError(t, r.Close())
+
+	// Without the same transform, the filter is not used.
+	for _, other := range []*FilterKeyTransform{nil, {Name: "other", Transform: transform.Transform}} {
+		r := open(other)
+		require.Nil(t, r.tableFilter)
+		require.True(t, mayContain(r, "cherry"))
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestWriterFilterDistinctPrefixes(t *testing.T) {
+	const prefixes, versions = 1000, 50
+	fp := bloom.FilterPolicy(10)
+	write := func(filterWholeKeys bool) *Reader {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			Comparer:        testkeys.Comparer,
+			FilterPolicy:    fp,
+			FilterWholeKeys: filterWholeKeys,
+			TableFormat:     TableFormatPebblev2,
+		})
+		for i := 0; i < prefixes; i++ {
+			for j := versions; j > 0; j-- {
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("dir%04d/@%d", i, j)), nil))
+			}
+		}
+		require.NoError(t, w.Close())
+		r, err := NewMemReader(f.Data(), ReaderOptions{
+			Comparer: testkeys.Comparer,
+			Filters:  map[string]FilterPolicy{fp.Name(): fp},
+		})
+		require.NoError(t, err)
+		return r
+	}
+
+	r := write(false /* filterWholeKeys */)
+	defer r.Close()
+	require.EqualValues(t, prefixes, r.Properties.NumFilterPrefixes)
+	// The filter holds one entry per distinct prefix, at 10 bits each.
+	require.Less(t, r.Properties.FilterSize, uint64(prefixes*10/8+128))
+	mayContain := func(prefix string) bool {
+		ok, err := r.FilterMayContain([]byte(prefix), false /* exact */)
+		require.NoError(t, err)
+		return ok
+	}
+	for i := 0; i < prefixes; i++ {
+		require.True(t, mayContain(fmt.Sprintf("dir%04d/", i)))
+	}
+	// The false positive rate of prefix-existence queries is about 1% with 10
+	// bits per distinct prefix.
+	const absent = 10000
+	falsePositives := 0
+	for i := 0; i < absent; i++ {
+		if mayContain(fmt.Sprintf("missing%04d/", i)) {
+			falsePositives++
+		}
+	}
+	require.Less(t, float64(falsePositives)/absent, 0.02)
+
+	// The distinct prefixes are also counted when whole keys are added.
+	rw := write(true /* filterWholeKeys */)
+	defer rw.Close()
+	require.EqualValues(t, prefixes, rw.Properties.NumFilterPrefixes)
+	require.Greater(t, rw.Properties.FilterSize, uint64(prefixes*versions*10/8))
+}
+
+func TestWriterAddMergeOperands(t *testing.T) {
+	f := &memFile{}
+	w := NewWriter(f, WriterOptions{
+		BlockSize:                 1,
+		ContinueOnValidationError: true,
+		FilterPolicy:              bloom.FilterPolicy(10),
+	})
+	require.NoError(t, w.AddMergeOperands([]byte("a"), nil, nil))
+	require.NoError(t, w.Set([]byte("a"), []byte("set")))
+	require.EqualError(t,
+		w.AddMergeOperands([]byte("b"), []uint64{3, 2}, [][]byte{[]byte("x")}),
+		"pebble: mismatched merge operands: 2 sequence numbers, 1 values")
+	require.EqualError(t,
+		w.AddMergeOperands([]byte("b"), []uint64{3, 3}, [][]byte{[]byte("x"), []byte("y")}),
+		"pebble: merge operand sequence numbers must be strictly decreasing: 3, 3")
+	require.Error(t, w.AddMergeOperands([]byte("a"), []uint64{3}, [][]byte{[]byte("x")}))
+	require.NoError(t, w.AddMergeOperands([]byte("b"), []uint64{5, 3, 1},
+		[][]byte{[]byte("v5"), []byte("v3"), []byte("v1")}))
+	require.NoError(t, w.Close())
+
+	fp := bloom.FilterPolicy(10)
+	r, err := NewMemReader(f.Data(), ReaderOptions{
+		Filters: map[string]FilterPolicy{fp.Name(): fp},
+	})
+	require.NoError(t, err)
+	defer r.Close()
+	require.EqualValues(t, 3, r.Properties.NumMergeOperands)
+	require.NotNil(t, r.tableFilter)
+	mayContain, err := r.FilterMayContain([]byte("b"), true /* exact */)
+	require.NoError(t, err)
+	require.True(t, mayContain)
+
+	iter, err := r.NewIter(nil, nil)
+	require.NoError(t, err)
+	var got []string
+	for k, v := iter.First(); k != nil; k, v = iter.Next() {
+		got = append(got, fmt.Sprintf("%s:%s", k.String(), v))
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, []string{
+		"a#0,1:set",
+		"b#5,2:v5",
+		"b#3,2:v3",
+		"b#1,2:v1",
+	}, got)
+}
+
+func TestWriterTotalEntries(t *testing.T) {
+	w := NewWriter(&memFile{}, WriterOptions{
+		Comparer:    testkeys.Comparer,
+		TableFormat: TableFormatPebblev2,
+	})
+	require.EqualValues(t, 0, w.TotalEntries())
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.NoError(t, w.Delete([]byte("b")))
+	require.EqualValues(t, 2, w.TotalEntries())
+	require.NoError(t, w.DeleteRange([]byte("c"), []byte("d")))
+	require.EqualValues(t, 3, w.TotalEntries())
+	require.NoError(t, w.AddRangeKey(
+		base.MakeInternalKey([]byte("e"), 0, base.InternalKeyKindRangeKeyDelete), []byte("f")))
+	require.EqualValues(t, 4, w.TotalEntries())
+
+	// Range keys added through RangeKeySet are counted once fragmented.
+	w = NewWriter(&memFile{}, WriterOptions{
+		Comparer:    testkeys.Comparer,
+		TableFormat: TableFormatPebblev2,
+	})
+	require.NoError(t, w.RangeKeySet([]byte("a"), []byte("c"), []byte("@1"), nil))
+	require.NoError(t, w.RangeKeySet([]byte("b"), []byte("d"), []byte("@2"), nil))
+	require.NoError(t, w.Close())
+	// The spans are fragmented into [a,b), [b,c) and [c,d), and the two
+	// suffixes within [b,c) are coalesced into a single RangeKeySet.
+	require.EqualValues(t, 3, w.TotalEntries())
+}
+
+func TestWriterKeyBounds(t *testing.T) {
+	w := NewWriter(&memFile{}, WriterOptions{
+		Comparer:                  testkeys.Comparer,
+		TableFormat:               TableFormatPebblev2,
+		ContinueOnValidationError: true,
+		KeyBounds:                 UserKeyBounds{Lower: []byte("b"), Upper: []byte("d")},
+	})
+	require.EqualError(t, w.Set([]byte("a"), nil), "pebble: key a is below the lower bound b")
+	require.NoError(t, w.Set([]byte("b"), nil))
+	require.NoError(t, w.Set([]byte("c@5"), nil))
+	require.EqualError(t, w.Set([]byte("d"), nil), "pebble: key d is not below the upper bound d")
+	require.NoError(t, w.DeleteRange([]byte("b"), []byte("d")))
+	require.EqualError(t, w.DeleteRange([]byte("c"), []byte("e")),
+		"pebble: end key e is above the upper bound d")
+	require.NoError(t, w.RangeKeySet([]byte("b"), []byte("d"), nil, nil))
+	require.EqualError(t, w.RangeKeyDelete([]byte("a"), []byte("c")),
+		"pebble: key a is below the lower bound b")
+	require.Error(t, w.AddRangeKey(
+		base.MakeInternalKey([]byte("c"), 0, base.InternalKeyKindRangeKeyDelete), []byte("e")))
+	require.NoError(t, w.Close())
+	meta, err := w.Metadata()
+	require.NoError(t, err)
+	require.Equal(t, "b", string(meta.SmallestPoint.UserKey))
+	require.Equal(t, "c@5", string(meta.LargestPoint.UserKey))
+
+	// By default, a key outside the bounds is fatal to the Writer.
+	w = NewWriter(&memFile{}, WriterOptions{KeyBounds: UserKeyBounds{Upper: []byte("b")}})
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.Error(t, w.Set([]byte("b"), nil))
+	require.Error(t, w.Close())
+}
+
+func TestWriterKeyValidator(t *testing.T) {
+	errNotUTF8 := errors.New("not valid UTF-8")
+	validUTF8 := func(userKey []byte) error {
+		if !utf8.Valid(userKey) {
+			return errNotUTF8
+		}
+		return nil
+	}
+	w := NewWriter(&memFile{}, WriterOptions{
+		TableFormat:               TableFormatPebblev2,
+		ContinueOnValidationError: true,
+		MaxValidationErrors:       10,
+		KeyValidator:              validUTF8,
+	})
+	require.NoError(t, w.Set([]byte("a"), nil))
+	err := w.Set([]byte("b\xff"), nil)
+	require.EqualError(t, err, `pebble: invalid key b\xff: not valid UTF-8`)
+	require.True(t, errors.Is(err, errNotUTF8))
+	require.NoError(t, w.Set([]byte("c"), nil))
+	require.EqualError(t, w.DeleteRange([]byte("d"), []byte("e\xff")),
+		`pebble: invalid key e\xff: not valid UTF-8`)
+	require.NoError(t, w.DeleteRange([]byte("d"), []byte("e")))
+	require.EqualError(t, w.RangeKeySet([]byte("f\xff"), []byte("g"), nil, nil),
+		`pebble: invalid key f\xff: not valid UTF-8`)
+	require.Error(t, w.AddRangeKey(
+		base.MakeInternalKey([]byte("f"), 0, base.InternalKeyKindRangeKeyDelete), []byte("g\xff")))
+	require.NoError(t, w.RangeKeySet([]byte("f"), []byte("g"), nil, nil))
+	require.Len(t, w.TakeValidationErrors(), 4)
+	require.NoError(t, w.Close())
+	meta, err := w.Metadata()
+	require.NoError(t, err)
+	// The two valid point keys and the valid range deletion.
+	require.Equal(t, uint64(3), meta.Properties.NumEntries)
+	require.Equal(t, uint64(1), meta.Properties.NumRangeKeySets)
+
+	// By default, an invalid key is fatal to the Writer.
+	w = NewWriter(&memFile{}, WriterOptions{KeyValidator: validUTF8})
+	require.Error(t, w.Set([]byte("\xff"), nil))
+	require.Error(t, w.Close())
+}
+
+func TestWriterFirstBlockEntryCount(t *testing.T) {
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			f := &memFile{}
+			w := NewWriter(f, WriterOptions{
+				BlockSize:            64,
+				FirstBlockEntryCount: 20,
+				Parallelism:          parallelism,
+			})
+			for i := 0; i < 100; i++ {
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("value")))
+			}
+			require.NoError(t, w.Close())
+
+			r, err := NewMemReader(f.Data(), ReaderOptions{})
+			require.NoError(t, err)
+			defer r.Close()
+			l, err := r.Layout()
+			require.NoError(t, err)
+			require.Greater(t, len(l.Data), 2)
+			entries := func(bh BlockHandle) int {
+				h, err := r.readBlock(bh, nil /* transform */, nil /* readaheadState */, nil /* stats */)
+				require.NoError(t, err)
+				defer h.Release()
+				iter, err := newBlockIter(r.Compare, h.Get())
+				require.NoError(t, err)
+				var n int
+				for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+					n++
+				}
+				return n
+			}
+			// The first block holds exactly 20 entries, despite exceeding the
+			// block size, while the remaining blocks respect the block size.
+			require.Equal(t, 20, entries(l.Data[0].BlockHandle))
+			require.Less(t, entries(l.Data[1].BlockHandle), 20)
+		})
+	}
+}
+
+func TestEstimateIndexSize(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const keyLen = 16
+	for _, numKeys := range []int{0, 1000, 100000} {
+		keys := make([][]byte, numKeys)
+		for i := range keys {
+			keys[i] = make([]byte, keyLen)
+			rng.Read(keys[i])
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+		prev := uint64(math.MaxUint64)
+		for _, blockSize := range []int{256, 4096, 32768} {
+			w := NewWriter(&discardFile{}, WriterOptions{
+				BlockSize:      blockSize,
+				IndexBlockSize: math.MaxInt32,
+			})
+			for _, k := range keys {
+				require.NoError(t, w.Set(k, nil))
+			}
+			require.NoError(t, w.Close())
+			meta, err := w.Metadata()
+			require.NoError(t, err)
+
+			estimate := EstimateIndexSize(numKeys, keyLen, blockSize)
+			require.InEpsilon(t, meta.Properties.IndexSize, estimate, 0.25,
+				"keys=%d block-size=%d", numKeys, blockSize)
+			// Larger blocks require smaller indexes.
+			if numKeys > 0 {
+				require.Less(t, estimate, prev)
+			}
+			prev = estimate
+		}
+	}
+}
+
+func TestWriterMinDataBlocks(t *testing.T) {
+	testCases := []struct {
+		numKeys, firstBlockEntryCount, minDataBlocks int
+		expectedBlocks                               uint64
+	}{
+		{numKeys: 100, minDataBlocks: 0, expectedBlocks: 1},
+		{numKeys: 100, minDataBlocks: 1, expectedBlocks: 1},
+		{numKeys: 100, minDataBlocks: 5, expectedBlocks: 5},
+		{numKeys: 3, minDataBlocks: 5, expectedBlocks: 3},
+		// Data blocks flushed for other reasons count towards the minimum.
+		{numKeys: 100, firstBlockEntryCount: 50, minDataBlocks: 3, expectedBlocks: 3},
+	}
+	for _, tc := range testCases {
+		for _, parallelism := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%d-keys/min=%d/parallelism=%t", tc.numKeys, tc.minDataBlocks, parallelism), func(t *testing.T) {
+				f := &memFile{}
+				w := NewWriter(f, WriterOptions{
+					FirstBlockEntryCount: tc.firstBlockEntryCount,
+					MinDataBlocks:        tc.minDataBlocks,
+					Parallelism:          parallelism,
+				})
+				for i := 0; i < tc.numKeys; i++ {
+					require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("v")))
+				}
+				require.NoError(t, w.Close())
+
+				r, err := NewMemReader(f.Data(), ReaderOptions{})
+				require.NoError(t, err)
+				require.Equal(t, tc.expectedBlocks, r.Properties.NumDataBlocks)
+				require.EqualValues(t, tc.numKeys, r.Properties.NumEntries)
+				require.NoError(t, r.Close())
+			})
+		}
+	}
+}
+
+func TestWriterFixedBlockEntryCount(t *testing.T) {
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			const fixedBlockEntryCount = 16
+			f := &memFile{}
+			w := NewWriter(f, WriterOptions{
+				BlockSize:            64,
+				FixedBlockEntryCount: fixedBlockEntryCount,
+				Parallelism:          parallelism,
+			})
+			const numKeys = 100
+			for i := 0; i < numKeys; i++ {
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("value")))
+			}
+			require.NoError(t, w.Close())
+
+			r, err := NewMemReader(f.Data(), ReaderOptions{})
+			require.NoError(t, err)
+			defer r.Close()
+			l, err := r.Layout()
+			require.NoError(t, err)
+			require.Equal(t, (numKeys+fixedBlockEntryCount-1)/fixedBlockEntryCount, len(l.Data))
+			for i := range l.Data {
+				h, err := r.readBlock(l.Data[i].BlockHandle, nil /* transform */, nil /* readaheadState */, nil /* stats */)
+				require.NoError(t, err)
+				iter, err := newBlockIter(r.Compare, h.Get())
+				require.NoError(t, err)
+				var n int
+				for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+					n++
+				}
+				h.Release()
+				// Every block but the last holds exactly fixedBlockEntryCount
+				// entries.
+				if i < len(l.Data)-1 {
+					require.Equal(t, fixedBlockEntryCount, n)
+				} else {
+					require.Equal(t, numKeys%fixedBlockEntryCount, n)
+				}
+			}
+		})
+	}
+}
+
 func TestSizeEstimate(t *testing.T) {
 	var sizeEstimate sizeEstimate
 	datadriven.RunTest(t, "testdata/size_estimate",
@@ -354,6 +2517,109 @@ func TestSizeEstimate(t *testing.T) {
 			}
 		})
 }
+func TestWriterAddRawBlock(t *testing.T) {
+	for _, parallelism := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallelism=%t", parallelism), func(t *testing.T) {
+			f := &memFile{}
+			w := NewWriter(f, WriterOptions{
+				BlockSize:    64,
+				FilterPolicy: bloom.FilterPolicy(10),
+				Parallelism:  parallelism,
+			})
+			contents := map[string][]byte{
+				"custom.a": []byte(strings.Repeat("a", 100)),
+				"custom.b": []byte("b"),
+			}
+			for i := 0; i < 100; i++ {
+				require.NoError(t, w.Set([]byte(fmt.Sprintf("%08d", i)), []byte("value")))
+				if i == 50 {
+					bh, err := w.AddRawBlock(contents["custom.b"], NoCompression)
+					require.NoError(t, err)
+					require.NoError(t, w.AddMetaindexEntry("custom.b", bh))
+					bh, err = w.AddRawBlock(contents["custom.a"], SnappyCompression)
+					require.NoError(t, err)
+					require.NoError(t, w.AddMetaindexEntry("custom.a", bh))
+				}
+			}
+			require.EqualError(t, w.AddMetaindexEntry("custom.a", BlockHandle{}),
+				`pebble: duplicate metaindex entry "custom.a"`)
+			require.EqualError(t, w.AddMetaindexEntry("rocksdb.properties", BlockHandle{}),
+				`pebble: metaindex entry name "rocksdb.properties" is reserved`)
+			require.NoError(t, w.Close())
+
+			r, err := NewMemReader(f.Data(), ReaderOptions{
+				Filters: map[string]FilterPolicy{bloom.FilterPolicy(10).Name(): bloom.FilterPolicy(10)},
+			})
+			require.NoError(t, err)
+			defer r.Close()
+			require.NotZero(t, r.filterBH.Length)
+			iter, err := r.NewIter(nil, nil)
+			require.NoError(t, err)
+			var n int
+			for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+				n++
+			}
+			require.NoError(t, iter.Close())
+			require.Equal(t, 100, n)
+
+			// The metaindex holds the custom entries, sorted among the others.
+			l, err := r.Layout()
+			require.NoError(t, err)
+			h, err := r.readBlock(l.MetaIndex, nil /* transform */, nil /* readaheadState */, nil /* stats */)
+			require.NoError(t, err)
+			defer h.Release()
+			metaIter, err := newRawBlockIter(bytes.Compare, h.Get())
+			require.NoError(t, err)
+			var names []string
+			for valid := metaIter.First(); valid; valid = metaIter.Next() {
+				name := string(metaIter.Key().UserKey)
+				names = append(names, name)
+				if want, ok := contents[name]; ok {
+					bh, _ := decodeBlockHandle(metaIter.Value())
+					b, err := r.readBlock(bh, nil /* transform */, nil /* readaheadState */, nil /* stats */)
+					require.NoError(t, err)
+					require.Equal(t, want, b.Get())
+					b.Release()
+				}
+			}
+			require.NoError(t, metaIter.Close())
+			require.Equal(t, []string{
+				"custom.a", "custom.b", "fullfilter.rocksdb.BuiltinBloomFilter", "rocksdb.properties",
+			}, names)
+		})
+	}
+}
+
+func TestWriterSetFileNum(t *testing.T) {
+	c := cache.New(64 << 20)
+	defer c.Unref()
+	const cacheID, staleFileNum, fileNum = 1, 1, 2
+	poison := func(fileNum base.FileNum) {
+		v := c.Alloc(1)
+		c.Set(cacheID, fileNum, 0, v).Release()
+	}
+	cached := func(fileNum base.FileNum) bool {
+		h := c.Get(cacheID, fileNum, 0)
+		defer h.Release()
+		return h.Get() != nil
+	}
+	poison(staleFileNum)
+	poison(fileNum)
+
+	w := NewWriter(&memFile{}, WriterOptions{Cache: c, BlockSize: 1},
+		&cacheOpts{cacheID: cacheID, fileNum: staleFileNum})
+	require.NoError(t, w.Set([]byte("a"), []byte("a")))
+	require.NoError(t, w.SetFileNum(fileNum))
+	// Adding the second key flushes the first data block, at offset 0.
+	require.NoError(t, w.Set([]byte("b"), []byte("b")))
+	require.EqualError(t, w.SetFileNum(staleFileNum),
+		"pebble: cannot set file number after a block has been written")
+	require.NoError(t, w.Close())
+	require.True(t, cached(staleFileNum))
+	require.False(t, cached(fileNum))
+	require.Equal(t, errWriterClosed, w.SetFileNum(fileNum))
+}
+
 func TestWriterClearCache(t *testing.T) {
 	// Verify that Writer clears the cache of blocks that it writes.
 	mem := vfs.NewMem()
@@ -624,6 +2890,156 @@ func TestWriter_TableFormatCompatibility(t *testing.T) {
 	}
 }
 
+func TestWriterFeatureFlags(t *testing.T) {
+	testCases := []struct {
+		name      string
+		opts      WriterOptions
+		writeFn   func(w *Writer) error
+		expected  FeatureFlags
+		str       string
+		minFormat TableFormat
+	}{
+		{
+			name:      "none",
+			minFormat: TableFormatLevelDB,
+		},
+		{
+			name: "two-level index",
+			opts: WriterOptions{BlockSize: 32, IndexBlockSize: 64},
+			writeFn: func(w *Writer) error {
+				for i := 0; i < 100; i++ {
+					if err := w.Set([]byte(fmt.Sprintf("%08d", i)), nil); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			expected:  FeatureTwoLevelIndex,
+			str:       "two-level index",
+			minFormat: TableFormatRocksDBv2,
+		},
+		{
+			name: "block properties and range keys",
+			opts: WriterOptions{
+				BlockPropertyCollectors: []func() BlockPropertyCollector{
+					func() BlockPropertyCollector {
+						return NewBlockIntervalCollector(
+							"collector", &valueCharBlockIntervalCollector{charIdx: 0}, nil,
+						)
+					},
+				},
+				TableFormat: TableFormatPebblev2,
+			},
+			writeFn: func(w *Writer) error {
+				return w.RangeKeyDelete([]byte("a"), []byte("b"))
+			},
+			expected:  FeatureBlockProperties | FeatureRangeKeys,
+			str:       "block properties,range keys",
+			minFormat: TableFormatPebblev2,
+		},
+		{
+			name: "no point blocks",
+			opts: WriterOptions{
+				TableFormat:          TableFormatPebblev3,
+				OmitEmptyPointBlocks: true,
+			},
+			writeFn: func(w *Writer) error {
+				return w.DeleteRange([]byte("a"), []byte("b"))
+			},
+			expected:  FeatureNoPointBlocks,
+			str:       "no point blocks",
+			minFormat: TableFormatPebblev3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := NewWriter(&memFile{}, tc.opts)
+			if tc.writeFn != nil {
+				require.NoError(t, tc.writeFn(w))
+			}
+			require.NoError(t, w.Close())
+			meta, err := w.Metadata()
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, meta.FeatureFlags)
+			require.Equal(t, tc.str, meta.FeatureFlags.String())
+			require.Equal(t, tc.minFormat, meta.FeatureFlags.MinimumTableFormat())
+		})
+	}
+}
+
+func TestWriterIndexPartitionDataSizes(t *testing.T) {
+	write := func(partitionDataSizes bool) *Reader {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			BlockSize:      64,
+			IndexBlockSize: 128,
+			BlockPropertyCollectors: []func() BlockPropertyCollector{
+				func() BlockPropertyCollector {
+					return NewBlockIntervalCollector(
+						"collector", &valueCharBlockIntervalCollector{charIdx: 0}, nil,
+					)
+				},
+			},
+			IndexPartitionDataSizes: partitionDataSizes,
+			TableFormat:             TableFormatPebblev1,
+		})
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("%08d", i))
+			require.NoError(t, w.Set(key, []byte(fmt.Sprint(i/50%10))))
+		}
+		require.NoError(t, w.Close())
+		r, err := NewMemReader(f.Data(), ReaderOptions{})
+		require.NoError(t, err)
+		return r
+	}
+	// filtered returns the number of keys in blocks which may contain values
+	// of 3.
+	filtered := func(r *Reader) int {
+		filterer := NewBlockPropertiesFilterer(
+			[]BlockPropertyFilter{NewBlockIntervalFilter("collector", 3, 4)}, nil)
+		ok, err := filterer.IntersectsUserPropsAndFinishInit(r.Properties.UserProperties)
+		require.NoError(t, err)
+		require.True(t, ok)
+		iter, err := r.NewIterWithBlockPropertyFilters(nil, nil, filterer, false, nil)
+		require.NoError(t, err)
+		defer iter.Close()
+		var n int
+		for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+			n++
+		}
+		return n
+	}
+
+	r := write(true)
+	defer r.Close()
+	require.Contains(t, r.Properties.UserProperties, IndexPartitionDataSizePropertyName)
+	l, err := r.Layout()
+	require.NoError(t, err)
+	require.Greater(t, len(l.Index), 1)
+	require.Len(t, l.IndexDataSizes, len(l.Index))
+	var total uint64
+	for _, size := range l.IndexDataSizes {
+		require.NotZero(t, size)
+		total += size
+	}
+	var dataSize uint64
+	for _, bh := range l.Data {
+		dataSize += bh.Length + blockTrailerLen
+	}
+	require.Equal(t, dataSize, total)
+
+	// Block property filters are unaffected by the additional property.
+	r2 := write(false)
+	defer r2.Close()
+	l, err = r2.Layout()
+	require.NoError(t, err)
+	require.Nil(t, l.IndexDataSizes)
+	require.NotContains(t, r2.Properties.UserProperties, IndexPartitionDataSizePropertyName)
+	require.Equal(t, filtered(r2), filtered(r))
+	require.Less(t, filtered(r), 1000)
+}
+
 // Tests for races, such as https://github.com/cockroachdb/cockroach/issues/77194,
 // in the Writer.
 func TestWriterRace(t *testing.T) {
@@ -730,6 +3146,39 @@ func BenchmarkWriter(b *testing.B) {
 	}
 }
 
+func BenchmarkWriterAdaptiveRestartInterval(b *testing.B) {
+	keys := make([][]byte, 1e6)
+	for i := range keys {
+		keys[i] = make([]byte, 8)
+		binary.BigEndian.PutUint64(keys[i], uint64(i))
+	}
+
+	for _, adaptive := range []bool{false, true} {
+		b.Run(fmt.Sprintf("adaptive=%t", adaptive), func(b *testing.B) {
+			opts := WriterOptions{
+				BlockRestartInterval:    16,
+				BlockSize:               32 << 10,
+				Compression:             NoCompression,
+				AdaptiveRestartInterval: adaptive,
+			}
+			f := &discardFile{}
+			for i := 0; i < b.N; i++ {
+				f.wrote = 0
+				w := NewWriter(f, opts)
+				for j := range keys {
+					if err := w.Set(keys[j], nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(f.wrote), "table-bytes")
+		})
+	}
+}
+
 var test4bSuffixComparer = &base.Comparer{
 	Compare:   base.DefaultComparer.Compare,
 	Equal:     base.DefaultComparer.Equal,
@@ -743,3 +3192,350 @@ var test4bSuffixComparer = &base.Comparer{
 	},
 	Name: "comparer-split-4b-suffix",
 }
+
+func TestWriterPlainCompat(t *testing.T) {
+	w := NewWriter(&memFile{}, WriterOptions{PlainCompat: true})
+	require.Regexp(t, "range deletions not supported", w.DeleteRange([]byte("a"), []byte("b")))
+	w = NewWriter(&memFile{}, WriterOptions{PlainCompat: true})
+	require.Regexp(t, "range keys not supported", w.RangeKeySet([]byte("a"), []byte("b"), nil, nil))
+
+	f := &memFile{}
+	w = NewWriter(f, WriterOptions{
+		BlockSize:   64,
+		PlainCompat: true,
+	})
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		require.NoError(t, w.Set(key, key))
+	}
+	require.NoError(t, w.Close())
+
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, TableFormatLevelDB, r.tableFormat)
+	require.Zero(t, r.Properties.IndexPartitions)
+	iter, err := r.NewIter(nil, nil)
+	require.NoError(t, err)
+	n := 0
+	for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+		n++
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, 1000, n)
+
+	for _, o := range []WriterOptions{
+		{TableFormat: TableFormatRocksDBv2},
+		{Checksum: ChecksumTypeXXHash64},
+		{CompressProperties: true},
+		{OmitEmptyPointBlocks: true},
+	} {
+		o.PlainCompat = true
+		w := NewWriter(&memFile{}, o)
+		require.Regexp(t, "not supported with PlainCompat", w.Close())
+	}
+}
+
+func TestWriterAddWithExpiry(t *testing.T) {
+	f := &memFile{}
+	w := NewWriter(f, WriterOptions{
+		BlockSize:   256,
+		TableFormat: TableFormatPebblev2,
+	})
+	var want []KeyExpiry
+	for i := 0; i < 1000; i++ {
+		key := base.MakeInternalKey([]byte(fmt.Sprintf("%08d", i)), uint64(i), InternalKeyKindSet)
+		var expiry uint64
+		if i%3 == 0 {
+			expiry = uint64(1_700_000_000 + i)
+			want = append(want, KeyExpiry{Key: key, ExpiryUnix: expiry})
+		}
+		require.NoError(t, w.AddWithExpiry(key, []byte("value"), expiry))
+	}
+	require.NoError(t, w.Close())
+
+	r, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+	expiries, err := r.Expiries()
+	require.NoError(t, err)
+	require.Equal(t, want, expiries)
+
+	// The table is otherwise unaffected.
+	iter, err := r.NewIter(nil, nil)
+	require.NoError(t, err)
+	var n int
+	for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+		n++
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, 1000, n)
+
+	// Tables written without expirations record none.
+	f = &memFile{}
+	w = NewWriter(f, WriterOptions{})
+	require.NoError(t, w.Set([]byte("a"), nil))
+	require.NoError(t, w.Close())
+	r2, err := NewMemReader(f.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	expiries, err = r2.Expiries()
+	require.NoError(t, err)
+	require.Nil(t, expiries)
+	require.NoError(t, r2.Close())
+
+	w = NewWriter(&memFile{}, WriterOptions{})
+	require.Regexp(t, "only be added for point keys",
+		w.AddWithExpiry(base.MakeInternalKey([]byte("a"), 0, InternalKeyKindRangeDelete), []byte("b"), 1))
+}
+
+// instanceCountCollector is a block property collector whose data block
+// properties depend on the number of instances constructed, and so differ
+// between two instances fed the same keys.
+type instanceCountCollector struct {
+	keyCountCollector
+	instance int
+}
+
+func (c *instanceCountCollector) FinishDataBlock(buf []byte) ([]byte, error) {
+	buf, err := c.keyCountCollector.FinishDataBlock(buf)
+	return append(buf, byte(c.instance)), err
+}
+
+func TestWriterVerifyCollectorDeterminism(t *testing.T) {
+	write := func(collector func() BlockPropertyCollector) error {
+		w := NewWriter(&memFile{}, WriterOptions{
+			BlockSize:                  64,
+			BlockPropertyCollectors:    []func() BlockPropertyCollector{collector},
+			TableFormat:                TableFormatPebblev2,
+			VerifyCollectorDeterminism: true,
+		})
+		for i := 0; i < 100; i++ {
+			if err := w.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("value")); err != nil {
+				// The error is latched, and returned by Close too.
+				require.Equal(t, err, w.Close())
+				return err
+			}
+		}
+		return w.Close()
+	}
+
+	require.NoError(t, write(keyCountCollectorFn("count")))
+
+	var instances int
+	nondeterministic := func() BlockPropertyCollector {
+		instances++
+		return &instanceCountCollector{
+			keyCountCollector: keyCountCollector{name: "instances"},
+			instance:          instances,
+		}
+	}
+	require.Regexp(t, "block property collector instances is nondeterministic", write(nondeterministic))
+}
+
+// forwardSliceIter is an InternalIterator over a slice of keys, each with a
+// value equal to its user key, which supports only forward iteration. If err
+// is set, it is returned by Error and iteration stops after the first key.
+type forwardSliceIter struct {
+	base.InternalIterator
+	keys []InternalKey
+	pos  int
+	err  error
+}
+
+func (i *forwardSliceIter) First() (*InternalKey, []byte) {
+	i.pos = 0
+	return i.current()
+}
+
+func (i *forwardSliceIter) Next() (*InternalKey, []byte) {
+	if i.err != nil {
+		i.pos = len(i.keys)
+	}
+	i.pos++
+	return i.current()
+}
+
+func (i *forwardSliceIter) current() (*InternalKey, []byte) {
+	if i.pos >= len(i.keys) {
+		return nil, nil
+	}
+	return &i.keys[i.pos], i.keys[i.pos].UserKey
+}
+
+func (i *forwardSliceIter) Error() error { return i.err }
+
+func TestWriterWriteAll(t *testing.T) {
+	var keys []InternalKey
+	for i := 0; i < 1000; i++ {
+		kind := InternalKeyKindSet
+		if i%7 == 0 {
+			kind = InternalKeyKindDelete
+		}
+		keys = append(keys, base.MakeInternalKey([]byte(fmt.Sprintf("key%04d", i)), uint64(i), kind))
+	}
+	opts := WriterOptions{
+		BlockSize:    256,
+		FilterPolicy: bloom.FilterPolicy(10),
+		TableFormat:  TableFormatPebblev2,
+	}
+
+	// WriteAll produces the same table as the equivalent Add loop.
+	added := &memFile{}
+	w := NewWriter(added, opts)
+	for i := range keys {
+		require.NoError(t, w.Add(keys[i], keys[i].UserKey))
+	}
+	require.NoError(t, w.Close())
+
+	written := &memFile{}
+	w = NewWriter(written, opts)
+	require.NoError(t, w.WriteAll(&forwardSliceIter{keys: keys}))
+	require.NoError(t, w.Close())
+	require.Equal(t, added.Data(), written.Data())
+
+	// The table written by one Writer may be copied by WriteAll from a Reader.
+	r, err := NewMemReader(added.Data(), ReaderOptions{})
+	require.NoError(t, err)
+	iter, err := r.NewIter(nil, nil)
+	require.NoError(t, err)
+	copied := &memFile{}
+	w = NewWriter(copied, opts)
+	require.NoError(t, w.WriteAll(iter))
+	require.NoError(t, iter.Close())
+	require.NoError(t, r.Close())
+	require.NoError(t, w.Close())
+	require.Equal(t, added.Data(), copied.Data())
+
+	// Iterator errors are surfaced.
+	w = NewWriter(&memFile{}, opts)
+	require.EqualError(t, w.WriteAll(&forwardSliceIter{keys: keys, err: errors.New("boom")}), "boom")
+
+	// Ordering errors are surfaced, or, with ContinueOnValidationError, the
+	// offending keys are skipped, whether or not their errors are retained.
+	unordered := []InternalKey{keys[1], keys[0], keys[2]}
+	w = NewWriter(&memFile{}, opts)
+	require.Regexp(t, "keys must be added in strictly increasing order", w.WriteAll(&forwardSliceIter{keys: unordered}))
+	opts.ContinueOnValidationError = true
+	w = NewWriter(&memFile{}, opts)
+	require.NoError(t, w.WriteAll(&forwardSliceIter{keys: unordered}))
+	require.Empty(t, w.TakeValidationErrors())
+	require.NoError(t, w.Close())
+	meta, err := w.Metadata()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, meta.Properties.NumEntries)
+}
+
+func TestWriterForceFooterFormat(t *testing.T) {
+	write := func(force bool) ([]byte, error) {
+		f := &memFile{}
+		w := NewWriter(f, WriterOptions{
+			BlockPropertyCollectors: []func() BlockPropertyCollector{keyCountCollectorFn("count")},
+			TableFormat:             TableFormatRocksDBv2,
+		})
+		if force {
+			private.SSTableWriterForceFooterFormat(w, uint32(TableFormatLevelDB))
+		}
+		require.NoError(t, w.Set([]byte("a"), []byte("b")))
+		err := w.Close()
+		return f.Data(), err
+	}
+
+	// Block properties require a newer format than the Writer's.
+	_, err := write(false)
+	require.Regexp(t, "less than the minimum required version", err)
+
+	// The forced footer format is written regardless of the features used.
+	data, err := write(true)
+	require.NoError(t, err)
+	footer, err := readFooter(memReader{data, bytes.NewReader(data), sizeOnlyStat(int64(len(data)))})
+	require.NoError(t, err)
+	require.Equal(t, TableFormatLevelDB, footer.format)
+}
+
+func TestWriterSmallTableThreshold(t *testing.T) {
+	type table struct {
+		data []byte
+		meta *WriterMetadata
+	}
+	write := func(opts WriterOptions, numKeys int) table {
+		f := &memFile{}
+		w := NewWriter(f, opts)
+		for i := 0; i < numKeys; i++ {
+			require.NoError(t, w.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("value")))
+		}
+		require.NoError(t, w.DeleteRange([]byte("key9998"), []byte("key9999")))
+		require.NoError(t, w.Close())
+		meta, err := w.Metadata()
+		require.NoError(t, err)
+		return table{data: f.Data(), meta: meta}
+	}
+	check := func(tbl table, numKeys int, compact bool) {
+		require.Equal(t, uint64(len(tbl.data)), tbl.meta.Size)
+		require.Equal(t, compact, tbl.meta.FeatureFlags&FeatureCompactFooter != 0)
+		r, err := NewMemReader(tbl.data, ReaderOptions{})
+		require.NoError(t, err)
+		defer r.Close()
+		l, err := r.Layout()
+		require.NoError(t, err)
+		require.Equal(t, compact, l.CompactFooter)
+		require.NoError(t, r.ValidateBlockChecksums())
+		var buf bytes.Buffer
+		l.Describe(&buf, true /* verbose */, r, nil)
+		require.Equal(t, compact, strings.Contains(buf.String(), "compact-footer"))
+
+		iter, err := r.NewIter(nil, nil)
+		require.NoError(t, err)
+		var n int
+		for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
+			require.Equal(t, fmt.Sprintf("key%04d", n), string(k.UserKey))
+			n++
+		}
+		require.Equal(t, numKeys, n)
+		k, _ := iter.SeekGE([]byte(fmt.Sprintf("key%04d", numKeys/2)), base.SeekGEFlagsNone)
+		require.NotNil(t, k)
+		require.NoError(t, iter.Close())
+		rangeDelIter, err := r.NewRawRangeDelIter()
+		require.NoError(t, err)
+		require.NotNil(t, rangeDelIter.First())
+		require.NoError(t, rangeDelIter.Close())
+	}
+
+	// Quantify the savings over many small tables.
+	const numTables = 100
+	var regularSize, compactSize, dataSize uint64
+	for i := 0; i < numTables; i++ {
+		numKeys := 1 + i%20
+		regular := write(WriterOptions{TableFormat: TableFormatPebblev3}, numKeys)
+		check(regular, numKeys, false)
+		compact := write(WriterOptions{SmallTableThreshold: 2 << 10, TableFormat: TableFormatPebblev3}, numKeys)
+		check(compact, numKeys, true)
+		regularSize += regular.meta.Size
+		compactSize += compact.meta.Size
+		dataSize += compact.meta.Properties.DataSize
+	}
+	t.Logf("per-table overhead: %d bytes, %d bytes with compact footers",
+		(regularSize-dataSize)/numTables, (compactSize-dataSize)/numTables)
+	// The compact footer saves the trailers of the metaindex and index blocks
+	// and the padding of the footer.
+	require.GreaterOrEqual(t, (regularSize-compactSize)/numTables, uint64(30))
+
+	// Tables with more than one data block, or above the threshold, or in a
+	// format predating the compact footer, have regular footers.
+	check(write(WriterOptions{BlockSize: 64, SmallTableThreshold: 2 << 10, TableFormat: TableFormatPebblev3}, 20), 20, false)
+	check(write(WriterOptions{SmallTableThreshold: 64, TableFormat: TableFormatPebblev3}, 20), 20, false)
+	check(write(WriterOptions{SmallTableThreshold: 2 << 10, TableFormat: TableFormatPebblev2}, 20), 20, false)
+	check(write(WriterOptions{SmallTableThreshold: 2 << 10, TableFormat: TableFormatRocksDBv2}, 20), 20, false)
+
+	// The compact footer is checksummed.
+	tbl := write(WriterOptions{SmallTableThreshold: 2 << 10, TableFormat: TableFormatPebblev3}, 20)
+	tbl.data[tbl.meta.IndexOffset] ^= 0xff
+	_, err := NewMemReader(tbl.data, ReaderOptions{})
+	require.Regexp(t, "checksum mismatch", err)
+
+	// A compact footer is only valid in the Pebblev3 format or later.
+	tbl = write(WriterOptions{SmallTableThreshold: 2 << 10, TableFormat: TableFormatPebblev3}, 20)
+	versionOffset := len(tbl.data) - len(pebbleDBMagic) - 4
+	binary.LittleEndian.PutUint32(tbl.data[versionOffset:], 2|compactFooterVersionFlag)
+	_, err = NewMemReader(tbl.data, ReaderOptions{})
+	require.Regexp(t, "compact footer in format", err)
+}